@@ -5,6 +5,7 @@
 package service
 
 import (
+	"io"
 	"log"
 	"os"
 )
@@ -17,9 +18,67 @@ type consoleLogger struct {
 }
 
 func init() {
-	ConsoleLogger.info = log.New(os.Stderr, "I: ", log.Ltime)
-	ConsoleLogger.warn = log.New(os.Stderr, "W: ", log.Ltime)
-	ConsoleLogger.err = log.New(os.Stderr, "E: ", log.Ltime)
+	ConsoleLogger = newWriterLogger(os.Stderr)
+}
+
+// newWriterLogger returns a Logger that writes prefixed lines to w.
+func newWriterLogger(w io.Writer) consoleLogger {
+	return newConsoleLogger(w, ConsoleOptions{Timestamp: true, Level: true})
+}
+
+// ConsoleOptions configures the output of NewConsoleLogger.
+type ConsoleOptions struct {
+	// Color colors the level prefix, red for errors and yellow for
+	// warnings. It only applies when the writer is a terminal, so pipes
+	// and files get no escape codes.
+	Color bool
+	// Timestamp starts every line with the time.
+	Timestamp bool
+	// Level starts every line with "E:", "W:" or "I:".
+	Level bool
+}
+
+// NewConsoleLogger returns a Logger that writes lines to w, formatted as
+// opts describes. ConsoleLogger writes to os.Stderr with Timestamp and
+// Level set.
+func NewConsoleLogger(w io.Writer, opts ConsoleOptions) Logger {
+	return newConsoleLogger(w, opts)
+}
+
+func newConsoleLogger(w io.Writer, opts ConsoleOptions) consoleLogger {
+	flags := 0
+	if opts.Timestamp {
+		flags = log.Ltime
+	}
+	color := opts.Color && isTerminal(w)
+	prefix := func(level, code string) string {
+		switch {
+		case !opts.Level:
+			return ""
+		case color && code != "":
+			return "\x1b[" + code + "m" + level + ":\x1b[0m "
+		default:
+			return level + ": "
+		}
+	}
+	return consoleLogger{
+		info: log.New(w, prefix("I", ""), flags),
+		warn: log.New(w, prefix("W", "33"), flags),
+		err:  log.New(w, prefix("E", "31"), flags),
+	}
+}
+
+// isTerminal reports whether w is a character device, such as a
+// terminal, rather than a pipe or a file.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(interface {
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 func (c consoleLogger) Error(v ...interface{}) error {
@@ -46,3 +105,9 @@ func (c consoleLogger) Infof(format string, a ...interface{}) error {
 	c.info.Printf(format, a...)
 	return nil
 }
+func (c consoleLogger) WithFields(fields map[string]interface{}) Logger {
+	return fieldLogger{c, formatFields(fields)}
+}
+func (c consoleLogger) Close() error {
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configPather is implemented by services that install a configuration
+// file or script.
+type configPather interface {
+	configPath() (string, error)
+}
+
+// systemVersioner is implemented by services that can report the version
+// of the system service manager.
+type systemVersioner interface {
+	systemVersion() string
+}
+
+// containerDetector is implemented by systems that can tell whether the
+// process runs inside a container.
+type containerDetector interface {
+	InContainer() (bool, error)
+}
+
+// Diagnostics returns a human readable report of the environment as seen
+// by this package: the chosen and available systems, the service manager
+// version, whether the process runs as root, in a container or
+// interactively. If s is non-nil its status and configuration path are
+// included as well. The report is intended to be attached to bug reports.
+//
+// Like the other helpers, it is a function taking the service rather
+// than a method of Service, so that implementations of Service outside
+// this package keep compiling.
+func Diagnostics(s Service) (string, error) {
+	if system == nil {
+		return "", ErrNoServiceSystemDetected
+	}
+	var b strings.Builder
+	line := func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%-12s %v\n", key+":", value)
+	}
+
+	line("system", Platform())
+	available := make([]string, 0, len(AvailableSystems()))
+	for _, sys := range AvailableSystems() {
+		available = append(available, sys.String())
+	}
+	line("available", strings.Join(available, ", "))
+	line("root", os.Geteuid() == 0)
+	line("interactive", Interactive())
+	if cd, ok := system.(containerDetector); ok {
+		in, err := cd.InContainer()
+		if err != nil {
+			line("container", "unknown ("+err.Error()+")")
+		} else {
+			line("container", in)
+		}
+	}
+
+	if s == nil {
+		return b.String(), nil
+	}
+	if sv, ok := s.(systemVersioner); ok {
+		line("version", sv.systemVersion())
+	}
+	line("service", s.String())
+	status, err := s.Status()
+	if err != nil {
+		line("status", status.String()+" ("+err.Error()+")")
+	} else {
+		line("status", status)
+	}
+	if cp, ok := s.(configPather); ok {
+		if path, err := cp.configPath(); err == nil {
+			line("config", path)
+		} else {
+			line("config", "unknown ("+err.Error()+")")
+		}
+	}
+	return b.String(), nil
+}
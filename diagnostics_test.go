@@ -0,0 +1,42 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	origSystem, origRegistry, origRegistered := system, systemRegistry, registeredSystems
+	defer func() { system, systemRegistry, registeredSystems = origSystem, origRegistry, origRegistered }()
+	system, systemRegistry = stubSystem{}, []System{stubSystem{}}
+
+	out, err := Diagnostics(&stubService{name: "app", status: StatusRunning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"system:      stub\n",
+		"available:   stub\n",
+		"root:",
+		"interactive: true\n",
+		"service:     app\n",
+		"status:      running\n",
+		"config:      /etc/stub/app\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Diagnostics() missing %q:\n%s", want, out)
+		}
+	}
+
+	out, err = Diagnostics(&stubService{name: "app", err: ErrNotInstalled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "status:      unknown (the service is not installed)\n") {
+		t.Errorf("Diagnostics() does not report status error:\n%s", out)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"sync"
+)
+
+// FakeSystem is a System that keeps its services in memory instead of
+// registering them with the service manager of the host. It lets the
+// tests of a program check its install and control logic without root
+// or a real service manager:
+//
+//	fake, restore := service.UseFakeSystem()
+//	defer restore()
+//	s, _ := service.New(prg, cfg)
+//	service.Control(s, "install")
+//	fake.Service(cfg.Name).Calls() // [install]
+//
+// Services created with the same name share their state, as they would
+// on a real system. A FakeSystem is safe for concurrent use.
+type FakeSystem struct {
+	mu       sync.Mutex
+	services map[string]*FakeService
+}
+
+// NewFakeSystem returns a FakeSystem with no services installed.
+func NewFakeSystem() *FakeSystem {
+	return &FakeSystem{services: make(map[string]*FakeService)}
+}
+
+// UseFakeSystem makes a new FakeSystem the only available system and
+// returns it with a function that restores the previous systems.
+func UseFakeSystem() (*FakeSystem, func()) {
+	prevRegistry, prevRegistered, prevSystem := systemRegistry, registeredSystems, system
+	f := NewFakeSystem()
+	ChooseSystem(f)
+	return f, func() {
+		systemRegistry, registeredSystems, system = prevRegistry, prevRegistered, prevSystem
+	}
+}
+
+// String returns "fake".
+func (f *FakeSystem) String() string {
+	return "fake"
+}
+
+// Detect returns true.
+func (f *FakeSystem) Detect() bool {
+	return true
+}
+
+// Interactive returns true: no service manager runs the program.
+func (f *FakeSystem) Interactive() bool {
+	return true
+}
+
+// New returns the FakeService named c.Name, creating it if needed. The
+// service runs i and reports c from then on.
+func (f *FakeSystem) New(i Interface, c *Config) (Service, error) {
+	if len(c.Name) == 0 {
+		return nil, ErrNameFieldRequired
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.services[c.Name]
+	if s == nil {
+		s = &FakeService{}
+		f.services[c.Name] = s
+	}
+	s.mu.Lock()
+	s.i, s.config = i, c
+	s.mu.Unlock()
+	return s, nil
+}
+
+// Service returns the service created with the given name, or nil.
+func (f *FakeSystem) Service(name string) *FakeService {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.services[name]
+}
+
+// Reset forgets every service, so that the next test starts with
+// nothing installed.
+func (f *FakeSystem) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.services = make(map[string]*FakeService)
+}
+
+// FakeService is a Service of a FakeSystem. It records the calls made to
+// it and tracks the installed and running state they would produce:
+// Start, Stop and Restart fail with ErrNotInstalled unless the service
+// is installed and Install fails with ErrServiceExists if it is.
+type FakeService struct {
+	mu        sync.Mutex
+	i         Interface
+	config    *Config
+	installed bool
+	status    Status
+	calls     []string
+	stop      chan struct{}
+}
+
+// record appends the call to the history and returns ErrNotInstalled if
+// the call needs the service installed and it is not.
+func (s *FakeService) record(call string, needInstalled bool) error {
+	s.calls = append(s.calls, call)
+	if needInstalled && !s.installed {
+		return ErrNotInstalled
+	}
+	return nil
+}
+
+// Run starts the program, then blocks until Stop is called and stops it.
+// The OnExit option is honored.
+func (s *FakeService) Run() error {
+	s.mu.Lock()
+	s.record("run", false)
+	i, c := s.i, s.config
+	stop := make(chan struct{})
+	s.stop = stop
+	s.mu.Unlock()
+
+	if err := i.Start(s); err != nil {
+		return err
+	}
+	<-stop
+	return c.onExit(i.Stop(s))
+}
+
+// Start marks the service running.
+func (s *FakeService) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("start", true); err != nil {
+		return err
+	}
+	s.status = StatusRunning
+	return nil
+}
+
+// Stop marks the service stopped and returns from a pending Run.
+func (s *FakeService) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	if err := s.record("stop", true); err != nil {
+		return err
+	}
+	s.status = StatusStopped
+	return nil
+}
+
+// Restart marks the service running.
+func (s *FakeService) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("restart", true); err != nil {
+		return err
+	}
+	s.status = StatusRunning
+	return nil
+}
+
+// Install marks the service installed and stopped.
+func (s *FakeService) Install() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("install", false)
+	if s.installed {
+		return ErrServiceExists
+	}
+	s.installed = true
+	s.status = StatusStopped
+	return nil
+}
+
+// Uninstall marks the service not installed.
+func (s *FakeService) Uninstall() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("uninstall", true); err != nil {
+		return err
+	}
+	s.installed = false
+	s.status = StatusUnknown
+	return nil
+}
+
+// Logger returns ConsoleLogger.
+func (s *FakeService) Logger(errs chan<- error) (Logger, error) {
+	return ConsoleLogger, nil
+}
+
+// SystemLogger returns ConsoleLogger.
+func (s *FakeService) SystemLogger(errs chan<- error) (Logger, error) {
+	return ConsoleLogger, nil
+}
+
+// String returns the display name of the service, or its name.
+func (s *FakeService) String() string {
+	c := s.Config()
+	if len(c.DisplayName) > 0 {
+		return c.DisplayName
+	}
+	return c.Name
+}
+
+// Platform returns "fake".
+func (s *FakeService) Platform() string {
+	return "fake"
+}
+
+// Status returns the status set by the last call, or ErrNotInstalled.
+func (s *FakeService) Status() (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.installed {
+		return StatusUnknown, ErrNotInstalled
+	}
+	return s.status, nil
+}
+
+// LoadInstalledConfig returns the Config the service was last created with,
+// or ErrNotInstalled.
+func (s *FakeService) LoadInstalledConfig() (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.installed {
+		return nil, ErrNotInstalled
+	}
+	return s.config, nil
+}
+
+// Calls returns the names of the methods called so far, in order, such
+// as "install" and "start". Failed calls are included.
+func (s *FakeService) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// Config returns the Config the service was last created with.
+func (s *FakeService) Config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeProgram struct {
+	started, stopped bool
+}
+
+func (p *fakeProgram) Start(s Service) error { p.started = true; return nil }
+func (p *fakeProgram) Stop(s Service) error  { p.stopped = true; return nil }
+
+func TestFakeSystem(t *testing.T) {
+	fake, restore := UseFakeSystem()
+	defer restore()
+	if ChosenSystem() != System(fake) || Platform() != "fake" {
+		t.Fatalf("ChosenSystem() = %v, want the fake system", ChosenSystem())
+	}
+
+	s, err := New(&fakeProgram{}, &Config{Name: "app", DisplayName: "App"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != ErrNotInstalled {
+		t.Errorf("Start() before Install = %v, want ErrNotInstalled", err)
+	}
+	for _, action := range []string{"install", "start"} {
+		if err := Control(s, action); err != nil {
+			t.Fatalf("Control(%q) = %v", action, err)
+		}
+	}
+	if err := s.Install(); err != ErrServiceExists {
+		t.Errorf("second Install() = %v, want ErrServiceExists", err)
+	}
+
+	// A service created again with the same name shares the state.
+	again, err := New(&fakeProgram{}, &Config{Name: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := again.Status(); err != nil || status != StatusRunning {
+		t.Errorf("Status() = %v, %v, want StatusRunning", status, err)
+	}
+	if c, err := LoadInstalledConfig(again); err != nil || c.Name != "app" {
+		t.Errorf("LoadInstalledConfig() = %+v, %v", c, err)
+	}
+
+	want := []string{"start", "install", "start", "install"}
+	if got := fake.Service("app").Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %q, want %q", got, want)
+	}
+
+	fake.Reset()
+	if fake.Service("app") != nil {
+		t.Error("Reset() kept the service")
+	}
+}
+
+func TestFakeServiceRun(t *testing.T) {
+	fake := NewFakeSystem()
+	p := &fakeProgram{}
+	s, err := fake.New(p, &Config{Name: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run() }()
+	// Wait for Run to begin, so that Stop ends it.
+	for len(fake.Service("app").Calls()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !p.started || !p.stopped {
+		t.Errorf("Run() started %v, stopped %v, want both", p.started, p.stopped)
+	}
+}
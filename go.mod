@@ -1,6 +1,6 @@
 module github.com/kardianos/service
 
-go 1.12
+go 1.13
 
 require golang.org/x/sys v0.0.0-20201015000850-e3ed0017c211
 
@@ -0,0 +1,134 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LogLevel selects the Logger method a LogWriter writes with.
+type LogLevel int
+
+// Levels accepted by LogWriter.
+const (
+	LevelInfo LogLevel = iota
+	LevelWarning
+	LevelError
+)
+
+// LogWriter returns an io.Writer that logs each newline terminated line
+// written to it using l at the given level (LevelInfo if omitted).
+// Partial lines are buffered until their newline arrives. This allows
+// capturing the output of a subprocess:
+//
+//	cmd.Stdout = service.LogWriter(logger)
+//	cmd.Stderr = service.LogWriter(logger, service.LevelError)
+func LogWriter(l Logger, level ...LogLevel) io.Writer {
+	w := &logWriter{l: l, level: LevelInfo}
+	if len(level) > 0 {
+		w.level = level[0]
+	}
+	return w
+}
+
+type logWriter struct {
+	l     Logger
+	level LogLevel
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	var err error
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(w.buf[:i], []byte{'\r'}))
+		w.buf = w.buf[i+1:]
+		if lerr := w.log(line); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return len(p), err
+}
+
+func (w *logWriter) log(line string) error {
+	switch w.level {
+	case LevelError:
+		return w.l.Error(line)
+	case LevelWarning:
+		return w.l.Warning(line)
+	default:
+		return w.l.Info(line)
+	}
+}
+
+// fieldLogger prepends a fixed set of rendered fields to every message
+// before handing it to the wrapped Logger.
+type fieldLogger struct {
+	l      Logger
+	fields string
+}
+
+func (f fieldLogger) Error(v ...interface{}) error {
+	return f.l.Error(f.fields + fmt.Sprint(v...))
+}
+func (f fieldLogger) Warning(v ...interface{}) error {
+	return f.l.Warning(f.fields + fmt.Sprint(v...))
+}
+func (f fieldLogger) Info(v ...interface{}) error {
+	return f.l.Info(f.fields + fmt.Sprint(v...))
+}
+func (f fieldLogger) Errorf(format string, a ...interface{}) error {
+	return f.l.Error(f.fields + fmt.Sprintf(format, a...))
+}
+func (f fieldLogger) Warningf(format string, a ...interface{}) error {
+	return f.l.Warning(f.fields + fmt.Sprintf(format, a...))
+}
+func (f fieldLogger) Infof(format string, a ...interface{}) error {
+	return f.l.Info(f.fields + fmt.Sprintf(format, a...))
+}
+func (f fieldLogger) Close() error {
+	return f.l.Close()
+}
+func (f fieldLogger) WithFields(fields map[string]interface{}) Logger {
+	return fieldLogger{f.l, f.fields + formatFields(fields)}
+}
+
+// formatFields renders fields as "key=value " pairs sorted by key.
+// Values containing spaces, quotes or '=' are quoted.
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(v)
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordLogger is a Logger that records every message with its level.
+type recordLogger struct {
+	lines *[]string
+}
+
+func newRecordLogger() recordLogger {
+	return recordLogger{&[]string{}}
+}
+
+func (r recordLogger) add(level string, msg string) error {
+	*r.lines = append(*r.lines, level+": "+msg)
+	return nil
+}
+
+func (r recordLogger) Error(v ...interface{}) error   { return r.add("E", fmt.Sprint(v...)) }
+func (r recordLogger) Warning(v ...interface{}) error { return r.add("W", fmt.Sprint(v...)) }
+func (r recordLogger) Info(v ...interface{}) error    { return r.add("I", fmt.Sprint(v...)) }
+func (r recordLogger) Errorf(format string, a ...interface{}) error {
+	return r.add("E", fmt.Sprintf(format, a...))
+}
+func (r recordLogger) Warningf(format string, a ...interface{}) error {
+	return r.add("W", fmt.Sprintf(format, a...))
+}
+func (r recordLogger) Infof(format string, a ...interface{}) error {
+	return r.add("I", fmt.Sprintf(format, a...))
+}
+func (r recordLogger) Close() error { return nil }
+func (r recordLogger) WithFields(fields map[string]interface{}) Logger {
+	return fieldLogger{r, formatFields(fields)}
+}
+
+func TestLogWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  []LogLevel
+		chunks []string
+		want   []string
+	}{
+		{"whole-lines", nil, []string{"one\ntwo\n"}, []string{"I: one", "I: two"}},
+		{"chunked", []LogLevel{LevelError}, []string{"pa", "rt", "ial\nne", "xt\r\n", "tail"}, []string{"E: partial", "E: next"}},
+		{"warning", []LogLevel{LevelWarning}, []string{"\n", "w\n"}, []string{"W: ", "W: w"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRecordLogger()
+			w := LogWriter(l, tt.level...)
+			for _, c := range tt.chunks {
+				n, err := w.Write([]byte(c))
+				if err != nil || n != len(c) {
+					t.Fatalf("Write(%q) = %d, %v", c, n, err)
+				}
+			}
+			if !reflect.DeepEqual(*l.lines, tt.want) {
+				t.Errorf("logged %q, want %q", *l.lines, tt.want)
+			}
+		})
+	}
+}
+
+// ttyBuffer is a bytes.Buffer that claims to be a terminal.
+type ttyBuffer struct {
+	bytes.Buffer
+}
+
+func (*ttyBuffer) Stat() (os.FileInfo, error) { return ttyInfo{}, nil }
+
+type ttyInfo struct{ os.FileInfo }
+
+func (ttyInfo) Mode() os.FileMode { return os.ModeDevice | os.ModeCharDevice }
+
+func TestNewConsoleLogger(t *testing.T) {
+	tests := []struct {
+		name string
+		tty  bool
+		opts ConsoleOptions
+		want string
+	}{
+		{"plain", false, ConsoleOptions{}, "boom\nslow\nup\n"},
+		{"level", false, ConsoleOptions{Level: true}, "E: boom\nW: slow\nI: up\n"},
+		{"color-pipe", false, ConsoleOptions{Level: true, Color: true}, "E: boom\nW: slow\nI: up\n"},
+		{"color-tty", true, ConsoleOptions{Level: true, Color: true}, "\x1b[31mE:\x1b[0m boom\n\x1b[33mW:\x1b[0m slow\nI: up\n"},
+		{"tty-no-color", true, ConsoleOptions{Level: true}, "E: boom\nW: slow\nI: up\n"},
+	}
+	for _, tt := range tests {
+		var buf *bytes.Buffer
+		var l Logger
+		if tt.tty {
+			tty := &ttyBuffer{}
+			buf, l = &tty.Buffer, NewConsoleLogger(tty, tt.opts)
+		} else {
+			buf = &bytes.Buffer{}
+			l = NewConsoleLogger(buf, tt.opts)
+		}
+		l.Error("boom")
+		l.Warningf("%s", "slow")
+		l.Info("up")
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	NewConsoleLogger(&buf, ConsoleOptions{Timestamp: true, Level: true}).Info("up")
+	if got := buf.String(); !strings.HasPrefix(got, "I: ") || len(got) != len("I: 15:04:05 up\n") {
+		t.Errorf("output with timestamp = %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The metrics written to the MetricsFile option, in the text format of
+// the Prometheus node exporter textfile collector. Each sample carries
+// the service name as its service label.
+const (
+	metricStartTime = "service_start_time_seconds"
+	metricStopTime  = "service_last_stop_time_seconds"
+	metricRestarts  = "service_restarts_total"
+)
+
+// lifecycleMetrics holds the samples of the metrics file.
+type lifecycleMetrics struct {
+	StartTime float64
+	StopTime  float64
+	Restarts  int64
+}
+
+// readMetrics returns the samples in the metrics file at path. A missing
+// file or sample reads as zero.
+func readMetrics(path string) (lifecycleMetrics, error) {
+	var m lifecycleMetrics
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := fields[0]
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case metricStartTime:
+			m.StartTime = v
+		case metricStopTime:
+			m.StopTime = v
+		case metricRestarts:
+			m.Restarts = int64(v)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// writeMetrics replaces the metrics file at path with m. The file is
+// renamed into place, so the collector never reads a partial file.
+func writeMetrics(path, name string, m lifecycleMetrics) error {
+	label := fmt.Sprintf("{service=%q}", name)
+	var b strings.Builder
+	for _, s := range []struct {
+		name, help, typ, value string
+	}{
+		{metricStartTime, "Unix time the service last started.", "gauge", strconv.FormatFloat(m.StartTime, 'f', -1, 64)},
+		{metricStopTime, "Unix time the service last stopped.", "gauge", strconv.FormatFloat(m.StopTime, 'f', -1, 64)},
+		{metricRestarts, "Number of times the service started again after its first start.", "counter", strconv.FormatInt(m.Restarts, 10)},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n", s.name, s.help, s.name, s.typ, s.name, label, s.value)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".metrics")
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// TempFile creates the file 0600, the collector may run as another user.
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// recordLifecycle updates the MetricsFile option, if set, with a start
+// or a stop at now. Each start after the first counts as a restart.
+func (c *Config) recordLifecycle(started bool, now time.Time) error {
+	path := c.Option.string(optionMetricsFile, "")
+	if path == "" {
+		return nil
+	}
+	m, err := readMetrics(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", optionMetricsFile, err)
+	}
+	t := float64(now.UnixNano()) / float64(time.Second)
+	if started {
+		if m.StartTime > 0 {
+			m.Restarts++
+		}
+		m.StartTime = t
+	} else {
+		m.StopTime = t
+	}
+	if err = writeMetrics(path, c.Name, m); err != nil {
+		return fmt.Errorf("cannot write %s: %v", optionMetricsFile, err)
+	}
+	return nil
+}
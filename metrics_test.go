@@ -0,0 +1,69 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.prom")
+	c := &Config{Name: "app", Option: KeyValue{optionMetricsFile: path}}
+
+	if err := c.recordLifecycle(true, time.Unix(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP service_start_time_seconds Unix time the service last started.
+# TYPE service_start_time_seconds gauge
+service_start_time_seconds{service="app"} 1000
+# HELP service_last_stop_time_seconds Unix time the service last stopped.
+# TYPE service_last_stop_time_seconds gauge
+service_last_stop_time_seconds{service="app"} 0
+# HELP service_restarts_total Number of times the service started again after its first start.
+# TYPE service_restarts_total counter
+service_restarts_total{service="app"} 0
+`
+	if string(b) != want {
+		t.Errorf("metrics file =\n%s\nwant\n%s", b, want)
+	}
+
+	for i, step := range []struct {
+		started bool
+		at      time.Time
+	}{
+		{false, time.Unix(2000, 500000000)},
+		{true, time.Unix(3000, 0)},
+		{false, time.Unix(4000, 0)},
+		{true, time.Unix(5000, 0)},
+	} {
+		if err := c.recordLifecycle(step.started, step.at); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	got, err := readMetrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (lifecycleMetrics{StartTime: 5000, StopTime: 4000, Restarts: 2}); got != want {
+		t.Errorf("readMetrics() = %+v, want %+v", got, want)
+	}
+
+	if err := (&Config{Name: "app"}).recordLifecycle(true, time.Now()); err != nil {
+		t.Errorf("recordLifecycle() without %s = %v", optionMetricsFile, err)
+	}
+}
@@ -3,7 +3,7 @@
 // license that can be found in the LICENSE file.
 
 // Package service provides a simple way to create a system service.
-// Currently supports Windows, Linux/(systemd | Upstart | SysV | OpenRC), and OSX/Launchd.
+// Currently supports Windows, Linux/(systemd | Upstart | SysV | OpenRC | runit | s6), and OSX/Launchd.
 //
 // Windows controls services by setting up callbacks that is non-trivial. This
 // is very different then other systems. This package provides the same API
@@ -62,9 +62,17 @@
 package service // import "github.com/kardianos/service"
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"path/filepath"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 const (
@@ -76,28 +84,116 @@ const (
 	optionUserServiceDefault   = false
 	optionSessionCreate        = "SessionCreate"
 	optionSessionCreateDefault = false
+	optionDarwinRawPlist       = "DarwinRawPlist"
+	optionStartInterval        = "StartInterval"
+	optionThrottleInterval     = "ThrottleInterval"
+	optionSessionType          = "SessionType"
 	optionLogOutput            = "LogOutput"
 	optionLogOutputDefault     = false
 	optionPrefix               = "Prefix"
 	optionPrefixDefault        = "application"
 
+	optionRecoveryActions = "RecoveryActions"
+	optionRecoveryCommand = "RecoveryCommand"
+
+	optionDelayedAutoStart        = "DelayedAutoStart"
+	optionDelayedAutoStartDefault = false
+
+	optionResolveSymlinks        = "ResolveSymlinks"
+	optionResolveSymlinksDefault = false
+	optionDryRun                 = "DryRun"
+	optionDryRunDefault          = false
+	optionFailIfExists           = "FailIfExists"
+	optionFailIfExistsDefault    = false
+	optionOverwrite              = "Overwrite"
+	optionOverwriteDefault       = false
+	optionInteractiveOverride    = "InteractiveOverride"
+	optionCommandTimeout         = "CommandTimeout"
+	optionCommandTimeoutDefault  = 2 * time.Minute
+
 	optionRunWait            = "RunWait"
+	optionRunLogger          = "RunLogger"
+	optionOnExit             = "OnExit"
+	optionMetricsFile        = "MetricsFile"
+	optionInstance           = "Instance"
 	optionReloadSignal       = "ReloadSignal"
 	optionPIDFile            = "PIDFile"
 	optionLimitNOFILE        = "LimitNOFILE"
 	optionLimitNOFILEDefault = -1 // -1 = don't set in configuration
 	optionRestart            = "Restart"
+	optionRestartMaxSec      = "RestartMaxSec"
+	optionTasksMax           = "TasksMax"
+	optionCPUAffinity        = "CPUAffinity"
+	optionJoinsNamespaceOf   = "JoinsNamespaceOf"
+	optionStopBefore         = "StopBefore"
+	optionStopAfter          = "StopAfter"
+	optionRuntimeMaxSec      = "RuntimeMaxSec"
+	optionTransient          = "Transient"
+	optionExecStart          = "ExecStart"
+	optionTransientDefault   = false
+	optionDropInOnly         = "DropInOnly"
+	optionDropInOnlyDefault  = false
+	optionStopNoBlock        = "StopNoBlock"
+	optionStopNoBlockDefault = false
 
 	optionSuccessExitStatus = "SuccessExitStatus"
 
+	optionConditionPathExists   = "ConditionPathExists"
+	optionConditionFileNotEmpty = "ConditionFileNotEmpty"
+
+	optionWorkingDirectoryFallbacks     = "WorkingDirectoryFallbacks"
+	optionCreateWorkingDirectory        = "CreateWorkingDirectory"
+	optionCreateWorkingDirectoryDefault = false
+
+	optionCronWatchdog        = "CronWatchdog"
+	optionCronWatchdogDefault = false
+
+	optionStopTimeout        = "StopTimeout"
+	optionStopTimeoutDefault = 10 * time.Second
+
+	optionForceKill          = "ForceKill"
+	optionForceKillDefault   = false
+	optionKillTimeout        = "KillTimeout"
+	optionKillTimeoutDefault = 10 * time.Second
+
+	optionUMask = "UMask"
+
+	optionStartLock        = "StartLock"
+	optionStartLockDefault = false
+
+	optionTemplateFuncs = "TemplateFuncs"
+
+	optionSmokeTest = "SmokeTest"
+
+	optionRestartMaxSecDefault = time.Minute
+
 	optionSystemdScript = "SystemdScript"
 	optionSysvScript    = "SysvScript"
 	optionRCSScript     = "RCSScript"
 	optionUpstartScript = "UpstartScript"
 	optionLaunchdConfig = "LaunchdConfig"
 	optionOpenRCScript  = "OpenRCScript"
+	optionRunitScript   = "RunitScript"
+	optionS6Script      = "S6Script"
 
 	optionLogDirectory = "LogDirectory"
+
+	optionScriptPath   = "ScriptPath"
+	optionScriptLocale = "ScriptLocale"
+	optionArgumentsRaw = "ArgumentsRaw"
+	optionSystemdExtra = "SystemdExtra"
+	optionUpstartExtra = "UpstartExtra"
+
+	optionIncludeUsage        = "IncludeUsage"
+	optionIncludeUsageDefault = false
+
+	optionVerifyPID        = "VerifyPID"
+	optionVerifyPIDDefault = false
+
+	optionSyslogFacility       = "SyslogFacility"
+	optionSyslogNetwork        = "SyslogNetwork"
+	optionSyslogNetworkDefault = "udp"
+	optionSyslogAddr           = "SyslogAddr"
 )
 
 // Status represents service status as an byte value
@@ -108,18 +204,46 @@ const (
 	StatusUnknown Status = iota // Status is unable to be determined due to an error or it was not installed.
 	StatusRunning
 	StatusStopped
+	StatusStarting // The service manager is starting the service, such as a systemd unit activating.
+	StatusStopping // The service manager is stopping the service, such as a systemd unit deactivating.
 )
 
+// String returns a lower case description of the status.
+func (s Status) String() string {
+	switch s {
+	case StatusRunning:
+		return "running"
+	case StatusStopped:
+		return "stopped"
+	case StatusStarting:
+		return "starting"
+	case StatusStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+// StatusDetails describes the status of an installed service along with
+// any additional information the system service manager reports.
+type StatusDetails struct {
+	Name   string // Name of the service.
+	Status Status // Status of the service.
+	PID    int    // Main process ID, zero if not running or unknown.
+	State  string // System specific state, such as "active/running".
+}
+
 // Config provides the setup for a Service. The Name field is required.
 type Config struct {
 	Name        string   // Required name of the service. No spaces suggested.
 	DisplayName string   // Display name, spaces allowed.
-	Description string   // Long description of service.
+	Description string   // Long description of service, else DisplayName or Name.
 	UserName    string   // Run as username.
 	Arguments   []string // Run with arguments.
 
 	// Optional field to specify the executable for service.
-	// If empty the current executable is used.
+	// If empty the current executable is used. On Linux, Install fails
+	// unless it is an existing executable file.
 	Executable string
 
 	// Array of service dependencies.
@@ -130,8 +254,31 @@ type Config struct {
 	//     "Requires=syslog.target"
 	//     Note, such lines will be directly appended into the [Unit] of
 	//     the generated service config file, will not check their correctness.
+	//  2. The SysV and rcS scripts list the units named by Requires, Wants,
+	//     BindsTo and After lines in their LSB Required-Start and
+	//     Required-Stop headers, targets such as network.target as LSB
+	//     facilities like $network. A single word is listed as is.
 	Dependencies []string
 
+	// Version of the program, noted in the header comment of the files
+	// Install generates, such as "Generated by name v1.2.3 (service pkg)".
+	Version string
+
+	// Labels are metadata, such as the owner of the service, stored in
+	// the files Install generates and read back by LoadInstalledConfig.
+	// Supported by systemd, SysV and rcS.
+	Labels map[string]string
+
+	// StartAtBoot sets whether Install also enables the service to start
+	// at boot. It is a pointer so that nil keeps the behaviour of configs
+	// written before it existed: the service starts at boot. When false
+	// the service is installed and can be started by hand only: systemd
+	// skips systemctl enable, SysV, rcS and AIX skip the S links (so rcS
+	// ListInstalled does not list the service), OpenRC skips rc-update add,
+	// upstart leaves out the start on stanza, and runit and s6 get a down
+	// file in the service directory.
+	StartAtBoot *bool
+
 	// The following fields are not supported on Windows.
 	WorkingDirectory string // Initial working directory.
 	ChRoot           string
@@ -145,6 +292,9 @@ type Config struct {
 var (
 	system         System
 	systemRegistry []System
+	// registeredSystems holds every system passed to ChooseSystem, for
+	// SetSystemOrder to pick from, whatever an earlier call left out.
+	registeredSystems []System
 )
 
 var (
@@ -154,8 +304,81 @@ var (
 	ErrNoServiceSystemDetected = errors.New("No service system detected.")
 	// ErrNotInstalled is returned when the service is not installed.
 	ErrNotInstalled = errors.New("the service is not installed")
+	// ErrNotSupported is returned, wrapped with context, when an operation
+	// is not supported by the chosen system. Test for it with errors.Is.
+	ErrNotSupported = errors.New("not supported")
+	// ErrServiceExists is returned, wrapped with the conflicting path, when
+	// the FailIfExists option finds a same-named service.
+	ErrServiceExists = errors.New("a service with this name already exists")
+	// ErrCommandNotFound is returned, wrapped with the command name, when a
+	// command the system relies on, such as systemctl, is not installed.
+	// Callers may use it to fall back to another system.
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrUnknownAction is returned, wrapped, by Control for an action
+	// other than "status" and those listed in ControlAction.
+	ErrUnknownAction = errors.New("unknown action")
+	// ErrReadOnlyFilesystem is returned, wrapped with the path, by Install
+	// when the service definition would be written to a read-only
+	// filesystem, such as /etc on image based hosts.
+	ErrReadOnlyFilesystem = errors.New("read-only filesystem")
+	// ErrStopTimeout is returned, wrapped, by Stop when the stop command of
+	// a script backend is still running after the StopTimeout option.
+	ErrStopTimeout = errors.New("stop timed out")
+	// ErrInterrupted is returned, wrapped with the signal, by Install and
+	// Uninstall on Linux when an interrupt or termination signal arrived
+	// while they ran. Install stops and rolls back the changes it had made;
+	// Uninstall finishes removing the service first.
+	ErrInterrupted = errors.New("interrupted")
+	// ErrPIDMismatch is returned, wrapped with the pid, by Stop when the
+	// VerifyPID option finds the pid file names another program.
+	ErrPIDMismatch = errors.New("pid belongs to another program")
 )
 
+// notSupported returns an error wrapping ErrNotSupported for op.
+func notSupported(op string) error {
+	return fmt.Errorf("%s: %w", op, ErrNotSupported)
+}
+
+// joinErrors returns nil if every error is nil, the only error that is
+// not, or an error listing them that errors.Is matches against each. It
+// stands in for errors.Join, which needs Go 1.20.
+func joinErrors(errs ...error) error {
+	var joined multiError
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+// multiError is the error of joinErrors.
+type multiError []error
+
+func (e multiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is reports whether any of the errors matches target.
+func (e multiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // New creates a new service based on a service interface and configuration.
 func New(i Interface, c *Config) (Service, error) {
 	if len(c.Name) == 0 {
@@ -164,28 +387,271 @@ func New(i Interface, c *Config) (Service, error) {
 	if system == nil {
 		return nil, ErrNoServiceSystemDetected
 	}
+	setProcessOptions(c)
 	return system.New(i, c)
 }
 
+// commandTimeout limits how long the commands run by the systems, such
+// as systemctl, may take. It is set from the CommandTimeout option.
+var commandTimeout = optionCommandTimeoutDefault
+
+// setProcessOptions applies the options of c that affect the whole
+// process, if present.
+func setProcessOptions(c *Config) {
+	if d := c.Option.duration(optionCommandTimeout, 0); d > 0 {
+		commandTimeout = d
+	}
+}
+
+// interactive returns the InteractiveOverride option of c if it is set,
+// and detected, what the system detected, otherwise.
+func (c *Config) interactive(detected bool) bool {
+	switch v := c.Option[optionInteractiveOverride].(type) {
+	case bool:
+		return v
+	case *bool:
+		if v != nil {
+			return *v
+		}
+	}
+	return detected
+}
+
+// NewForSystem creates a new service using the registered system with the
+// given name, bypassing detection. This is useful to force a backend, for
+// example in CI or in install scripts asserting the expected backend.
+func NewForSystem(name string, i Interface, c *Config) (Service, error) {
+	if len(c.Name) == 0 {
+		return nil, ErrNameFieldRequired
+	}
+	for _, choice := range systemRegistry {
+		if choice.String() == name {
+			setProcessOptions(c)
+			return choice.New(i, c)
+		}
+	}
+	available := make([]string, 0, len(systemRegistry))
+	for _, choice := range systemRegistry {
+		available = append(available, choice.String())
+	}
+	return nil, fmt.Errorf("service system %q is not registered, available: %s", name, strings.Join(available, ", "))
+}
+
+// ServiceDef pairs the Interface and Config of one of the services a
+// program provides, for NewMulti.
+type ServiceDef struct {
+	Interface Interface
+	Config    *Config
+}
+
+// NewMulti creates a service for each definition, all using the detected
+// system, for a binary that provides several daemons. It fails if any
+// service cannot be created or two share a name.
+func NewMulti(defs []ServiceDef) ([]Service, error) {
+	services := make([]Service, 0, len(defs))
+	names := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		if def.Config == nil {
+			return nil, ErrNameFieldRequired
+		}
+		name := def.Config.instanceName()
+		if names[name] {
+			return nil, fmt.Errorf("service %q is defined twice", name)
+		}
+		names[name] = true
+		s, err := New(def.Interface, def.Config)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", name, err)
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// InstallAll installs services in order, stopping at the first failure.
+func InstallAll(services []Service) error {
+	for _, s := range services {
+		if err := s.Install(); err != nil {
+			return fmt.Errorf("Failed to install %v: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// StartAll starts services in order, stopping at the first failure.
+func StartAll(services []Service) error {
+	for _, s := range services {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("Failed to start %v: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// Reinstall replaces the installed service with the configuration of s,
+// such as after an upgrade. A service that is not installed yet is just
+// installed. A running service is stopped first and started again once
+// installed; otherwise it is left stopped. Install and Uninstall reload
+// the service manager where it needs it, as systemd does.
+//
+// It only needs the Status, Stop, Uninstall, Install and Start methods,
+// so it is a function of any Service instead of a new method that every
+// implementation outside this package would have to add.
+func Reinstall(s Service) error {
+	status, err := s.Status()
+	installed := !errors.Is(err, ErrNotInstalled)
+	running := err == nil && status == StatusRunning
+	if running {
+		if err = s.Stop(); err != nil {
+			return err
+		}
+	}
+	if installed {
+		if err = s.Uninstall(); err != nil && !errors.Is(err, ErrNotInstalled) && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = s.Install(); err != nil {
+		return err
+	}
+	if running {
+		return s.Start()
+	}
+	return nil
+}
+
+// startWaitPollInterval is the time between the checks of StartAndWait.
+var startWaitPollInterval = 100 * time.Millisecond
+
+// StartAndWait starts s and waits until it is ready. The service is not
+// ready while its status is StatusStarting or StatusStopped, such as a
+// systemd unit still activating, nor until ready, if not nil, returns
+// true. ready may fail while the service comes up; its last error is
+// reported if ctx ends before the service is ready.
+func StartAndWait(ctx context.Context, s Service, ready func() (bool, error)) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(startWaitPollInterval)
+	defer ticker.Stop()
+	var notReady error
+	for {
+		details, err := StatusEx(s)
+		switch {
+		case err == nil && (details.Status == StatusStarting || details.Status == StatusStopped):
+			notReady = fmt.Errorf("status is %v", details.Status)
+		case ready == nil:
+			return nil
+		default:
+			ok, err := ready()
+			if ok && err == nil {
+				return nil
+			}
+			notReady = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if notReady != nil {
+				return fmt.Errorf("%v is not ready: %w (%v)", s, ctx.Err(), notReady)
+			}
+			return fmt.Errorf("%v is not ready: %w", s, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
 // KeyValue provides a list of system specific options.
 //
 //   - OS X
 //
 //   - LaunchdConfig string ()                 - Use custom launchd config.
 //
-//   - KeepAlive     bool   (true)             - Prevent the system from stopping the service automatically.
+//   - KeepAlive     bool or map[string]bool (true) - Prevent the system from stopping the service
+//     automatically. map[string]bool{"SuccessfulExit": false} restarts it only after it
+//     exits with an error, such as a crash; true for SuccessfulExit only after it succeeds.
 //
 //   - RunAtLoad     bool   (false)            - Run the service after its job has been loaded.
 //
 //   - SessionCreate bool   (false)            - Create a full user session.
 //
+//   - DarwinRawPlist map[string]interface{} () - Keys added to the plist dict for settings
+//     not modeled here, such as SoftResourceLimits or Sockets. Values may be strings,
+//     bools, numbers, time.Time, []byte, slices and maps with string keys, nested freely.
+//     Keys the generated plist already sets are rejected.
+//
+//   - StartInterval int or duration ()        - Run the service every so many seconds instead of
+//     keeping it resident; KeepAlive then defaults to false. Must be whole seconds.
+//
+//   - ThrottleInterval int or duration ()     - Least time launchd waits between two launches of
+//     the service, to stop a crashing service from relaunching in a tight loop (launchd
+//     default 10s). Must be whole seconds. Both are ignored on other systems.
+//
+//   - SessionType   string ()                 - Install a LaunchAgent limited to this session type
+//     (LimitLoadToSessionType). "Aqua" runs it in the GUI session of the user so it can show
+//     UI, and "Background" in their non-GUI session; both are per-user agents in
+//     ~/Library/LaunchAgents and imply UserService, which may not be false. "LoginWindow"
+//     runs it at the login window from /Library/LaunchAgents, and UserService may not be true.
+//
 //   - Solaris
 //
 //   - Prefix        string ("application")    - Service FMRI prefix.
 //
+//   - All
+//
+//   - ResolveSymlinks bool (false)            - Resolve symlinks in the executable path at install time,
+//     whether it is Executable or the running binary.
+//     Resolving pins the installed service to the binary the link pointed to
+//     during install, e.g. /opt/app/v1.2.3/bin/app. Leaving it unset keeps the
+//     link, e.g. /opt/app/current/bin/app, so the service follows the link each
+//     time it starts.
+//
+//   - InteractiveOverride bool or *bool ()    - Make the service behave as if the process ran
+//     interactively (true) or under the service manager (false), instead of detecting it,
+//     such as when Logger picks the console. It only applies to the service created with it;
+//     Interactive and System.Interactive still report detection. A nil *bool detects.
+//
+//   - CommandTimeout duration (2m)            - Limit on how long a command run by the system,
+//     such as systemctl, may take before it and its children are killed. It applies to the
+//     whole process once a service is created with it.
+//
+//   - StartLock     bool   (false)            - The SysV and rcS scripts take an flock on
+//     pid_file.lock while starting, so concurrent starts do not race on the pid file. The
+//     others exit with "start already in progress". Requires flock(1).
+//
+//   - TemplateFuncs template.FuncMap ()       - Functions for custom Linux scripts and units,
+//     merged over the built-in ones: cmd, cmdEscape, cmdSystemd, join ({{join " " .Arguments}})
+//     and default ({{default "info" (index .Option "LogLevel")}}). A function of the same
+//     name replaces the built-in one.
+//
+//   - SmokeTest     []string ()               - Command and arguments, such as
+//     []string{"/usr/bin/app", "--version"}, that Install runs on Linux after writing
+//     the service file and before enabling the service. If it fails or exceeds
+//     CommandTimeout, the written file is removed and Install returns the error.
+//
+//   - DryRun        bool   (false)            - Install only renders and validates the service file
+//     without writing it or running any command. See InstallScript.
+//
+//   - FailIfExists bool   (false)             - Install also looks for a same-named service the
+//     system knows about outside the install location, such as a packaged systemd unit,
+//     and fails with ErrServiceExists if it finds one.
+//
+//   - Overwrite    bool   (false)             - Install replaces an existing service file
+//     instead of failing, and skips the FailIfExists check. Not supported on Windows.
+//
+//   - MetricsFile  string ()                  - Path of a file, such as
+//     /var/lib/node_exporter/textfile/app.prom, that Run updates when the service starts
+//     and stops, for the Prometheus textfile collector. It holds the gauges
+//     service_start_time_seconds and service_last_stop_time_seconds, in Unix seconds,
+//     and the counter service_restarts_total of starts after the first, each labeled
+//     service="<Name>". Failing to write it is logged to RunLogger and does not stop Run.
+//
 //   - POSIX
 //
 //   - UserService   bool   (false)            - Install as a current user service.
+//     systemd writes the unit to $XDG_CONFIG_HOME/systemd/user (~/.config/systemd/user),
+//     wanted by default.target, and controls it with systemctl --user. Install fails
+//     when there is no user session bus, as for a user who is not logged in.
 //
 //   - SystemdScript string ()                 - Use custom systemd script.
 //
@@ -195,35 +661,181 @@ func New(i Interface, c *Config) (Service, error) {
 //
 //   - OpenRCScript  string ()                 - Use custom OpenRC script.
 //
+//   - RunitScript   string ()                 - Use custom runit run script.
+//
+//   - S6Script      string ()                 - Use custom s6 run script.
+//
 //   - RunWait       func() (wait for SIGNAL)  - Do not install signal but wait for this function to return.
 //
+//   - RunLogger     Logger or io.Writer ()    - Receives Run lifecycle events, such as the stop signal and stop duration.
+//     On Windows the stop signal is the stop or shutdown request of the service manager.
+//
+//   - OnExit        func(error) ()            - Called by Run once Interface.Stop (or Shutdown) returned,
+//     with its error, which may be nil, before Run returns. A place to flush and close loggers.
+//     On unix the stop signals are no longer caught by then, so a second SIGTERM ends the
+//     process. It is not called when Interface.Start fails.
+//
+//   - SyslogFacility string ()                - Facility of the messages of the system logger on
+//     unix, such as "daemon" or "local0", so that syslog rules can route them. By default
+//     messages carry no facility, which syslog reads as "kern". Unknown names make
+//     Logger and SystemLogger fail.
+//
+//   - SyslogAddr   string ()                  - host:port of a syslog collector the system logger
+//     on unix sends to instead of the local syslog. If the logger cannot connect when it is
+//     opened, it writes to the local syslog and logs a warning saying so. Over udp, which
+//     sends without a connection, that only happens when the host does not resolve; an
+//     unreachable collector then goes unnoticed.
+//
+//   - SyslogNetwork string (udp)              - Protocol used to reach SyslogAddr, "udp" or "tcp".
+//
 //   - ReloadSignal  string () [USR1, ...]     - Signal to send on reload.
 //
-//   - PIDFile       string () [/run/prog.pid] - Location of the PID file.
+//   - PIDFile       string () [/run/prog.pid] - Location of the PID file. {{.Name}} stands for the
+//     name of the service, e.g. "/run/user/1000/{{.Name}}.pid". The SysV and rcS scripts
+//     write it instead of /var/run/name.pid, and Install checks its directory is writable.
 //
 //   - LogOutput     bool   (false)            - Redirect StdErr & StandardOutPath to files.
 //
 //   - Restart       string (always)           - How shall service be restarted.
+//     The SysV and rcS scripts support "on-failure" and "always", supervising the
+//     service and restarting it after it exits with an exponential backoff.
+//
+//   - KeepAlive     bool   ()                 - Restart the service whenever it exits: Restart=always
+//     on systemd, respawn on upstart and the supervisor with "always" on SysV and rcS.
+//     False disables restarting. map[string]bool{"SuccessfulExit": false} maps to
+//     "on-failure" and true to "on-success". An explicitly set Restart wins over KeepAlive.
+//
+//   - RestartMaxSec duration (1m)             - Maximum delay between restarts for the SysV
+//     and rcS supervisor.
+//
+//   - CronWatchdog bool (false)               - Add a crontab entry that runs the SysV or rcS
+//     script with "start" every minute, restarting the service if it died. Uninstall
+//     removes the entry when the option is set.
+//
+//   - StopTimeout  duration (10s)             - How long rcS Restart waits for the service to
+//     stop before starting it again. Restart fails if it is still running by then.
+//     When set, Stop of the SysV, rcS, OpenRC, upstart, runit and s6 backends also kills
+//     a stop command running longer and returns ErrStopTimeout; the scripts still give up
+//     waiting on their own after KillTimeout, so StopTimeout should be longer.
+//
+//   - KillTimeout  duration (10s)             - How long the stop action of the SysV and rcS
+//     scripts waits for the service to exit after SIGTERM. Whole seconds, rounded up.
+//
+//   - ForceKill    bool   (false)             - Send SIGKILL to a service still running after
+//     KillTimeout instead of giving up: the SysV and rcS scripts kill the supervised
+//     process and its supervisor, and systemd gets TimeoutStopSec=KillTimeout.
+//
+//   - UMask        string ()                  - Octal file mode creation mask of the service,
+//     such as "077". Rendered as systemd UMask=, an umask command before starting the
+//     service in the SysV, rcS, runit and s6 scripts and the upstart job, and the
+//     supervise-daemon --umask flag on OpenRC. Unset keeps the inherited umask, and
+//     022 for upstart.
 //
 //   - SuccessExitStatus string ()             - The list of exit status that shall be considered as successful,
 //     in addition to the default ones.
 //
+//   - ConditionPathExists string or []string () - Absolute paths that must exist for the service
+//     to start; a leading "!" requires the path to be missing. Rendered as systemd
+//     ConditionPathExists=; the SysV and rcS scripts skip starting and exit 0 when unmet.
+//
+//   - ConditionFileNotEmpty string or []string () - Like ConditionPathExists, for regular files
+//     that must exist and not be empty.
+//
 //   - LogDirectory string(/var/log)           - The path to the log files directory
+//     of the script backends. Install creates it if missing, owned by UserName if set.
+//
+//   - WorkingDirectoryFallbacks []string ()   - Directories to try, in order, when WorkingDirectory
+//     does not exist. The SysV, rcS, runit and s6 scripts pick the first existing one each
+//     time they start; systemd and upstart pick it at install, failing if none exists.
+//
+//   - CreateWorkingDirectory bool (false)     - Without fallbacks, Install fails on Linux if
+//     WorkingDirectory does not exist. With this option it creates it instead, owned by
+//     UserName if set.
+//
+//   - ScriptPath   string ()                  - PATH exported by generated init scripts (SysV, rcS, OpenRC).
+//
+//   - ScriptLocale string ()                  - LANG exported by generated init scripts (SysV, rcS, OpenRC).
+//
+//   - ArgumentsRaw []string ()                - Arguments appended after Arguments without quoting
+//     (SysV, rcS, runit, s6, upstart), so the shell expands globs and variables in them.
+//     They are shell code: never pass untrusted input, which could run arbitrary commands.
+//
+//   - SystemdExtra []string ()                - Advanced: lines added verbatim, in order, to the
+//     [Service] section of the systemd unit and drop-in, for directives not wrapped here.
+//     Each entry must be one line and may not start another section; nothing else is checked.
+//
+//   - UpstartExtra []string ()                - Advanced: stanzas added verbatim, in order, to the
+//     upstart job, one line each and not checked otherwise.
+//
+//   - IncludeUsage bool (false)               - Start the SysV and rcS scripts with a comment
+//     block naming the service and its description, script path, actions and log files.
+//
+//   - VerifyPID    bool   (false)             - Before Stop signals the pid in the pid file, check
+//     /proc/<pid>/exe is the service executable (the supervising shell with RestartPolicy),
+//     so a recycled pid of another process is never killed. Stop of the SysV and rcS
+//     backends then returns ErrPIDMismatch, and their scripts refuse to stop.
+//
+//   - StopBefore   []string ()                - Services to stop after this one at shutdown.
+//
+//   - StopAfter    []string ()                - Services to stop before this one at shutdown.
+//     systemd orders by unit names ("db" means "db.service") with After= for StopBefore
+//     and Before= for StopAfter, which also orders start up in reverse. SysV picks the
+//     priority of the K links from the links installed for the named services.
+//
+//   - Instance     string ()                  - Install one of several copies of the service (Linux).
+//     systemd installs the template unit name@.service and controls name@instance.service;
+//     arguments may refer to the instance as %i. Installing a second instance reuses the
+//     template. Uninstalling an instance disables it, and removes the template only when
+//     no other instance is enabled.
+//     The script backends install the service as name-instance, including its pid file.
 //
 //   - Linux (systemd)
 //
-//   - LimitNOFILE   int    (-1)               - Maximum open files (ulimit -n)
+//   - LimitNOFILE   int|string (-1)           - Maximum open files (ulimit -n)
 //     (https://serverfault.com/questions/628610/increasing-nproc-for-processes-launched-by-systemd-on-centos-7)
+//     A string may set the soft and hard limits separately as "soft:hard"; either may be
+//     "infinity". The SysV and rcS scripts apply it with ulimit -Hn and -Sn.
 //
-//   - Windows
+//   - TasksMax      int|string ()             - Maximum number of tasks (threads and processes), or "infinity".
+//     Only systemd applies it, as reported by CapabilitiesOf. The other Linux systems start
+//     the service as root, which the process limit of ulimit -u does not apply to, so Install
+//     fails with ErrNotSupported there unless it is "infinity".
+//
+//   - CPUAffinity   string ()                 - CPUs the service may run on, as a list of CPUs and
+//     ranges such as "0-3,6". The SysV and rcS scripts start the service with taskset -c.
+//
+//   - RuntimeMaxSec duration ()               - Stop the service after it ran this long, e.g. "24h". With
+//     the default Restart=always systemd starts it again, recycling long-running services.
 //
-//   - DelayedAutoStart  bool (false)                - After booting, start this service after some delay.
+//   - JoinsNamespaceOf []string ()            - Units whose namespaces the service joins, such as "main.service".
+//     Only effective with namespacing directives such as PrivateNetwork= or PrivateTmp=.
+//
+//   - Transient     bool   (false)            - Run the service as a transient unit with systemd-run.
+//     Install and Uninstall do nothing, Start creates the unit from the configuration and
+//     it disappears once stopped. Restart defaults to "no".
+//
+//   - ExecStart     string ()                 - Command line of ExecStart= in the unit, replacing the
+//     one built from the executable and Arguments, such as to wrap the service in a shell.
+//     The unit keeps every other directive. It is written verbatim, so a literal % must be
+//     escaped as %% or systemd expands it as a specifier. Transient units reject it.
+//
+//   - StopNoBlock   bool   (false)            - Stop returns once the stop job is queued
+//     (systemctl stop --no-block) instead of waiting for the service to stop.
+//
+//   - DropInOnly    bool   (false)            - Install writes only the drop-in
+//     name.service.d/override.conf next to an existing, hand-maintained unit. It holds the
+//     set options among Restart (or KeepAlive), LimitNOFILE, TasksMax, UMask, RuntimeMaxSec,
+//     StopTimeout, ExecStart, ConditionPathExists, ConditionFileNotEmpty, SystemdExtra and
+//     EnvVars. Install does not enable the unit and Uninstall removes only the drop-in.
+//
+//   - Windows
 //
 //   - Password  string ()                           - Password to use when interfacing with the system service manager.
 //
 //   - Interactive       bool (false)                - The service can interact with the desktop. (more information https://docs.microsoft.com/en-us/windows/win32/services/interactive-services)
 //
-//   - DelayedAutoStart        bool (false)          - after booting start this service after some delay.
+//   - DelayedAutoStart        bool (false)          - After booting, start this service after the other
+//     automatic services, such as once networking is up. Requires StartType automatic.
 //
 //   - StartType               string ("automatic")  - Start service type. (automatic | manual | disabled)
 //
@@ -232,6 +844,14 @@ func New(i Interface, c *Config) (Service, error) {
 //   - OnFailureDelayDuration  string ( "1s" )       - Delay before restarting the service, time.Duration string.
 //
 //   - OnFailureResetPeriod    int ( 10 )            - Reset period for errors, seconds.
+//
+//   - RecoveryActions         []string ()           - Actions on the first, second and subsequent
+//     failures, such as []string{"restart/30s", "restart/2m", "reboot"}: restart, run (the
+//     RecoveryCommand), reboot or noaction, each with an optional delay (60s). It replaces
+//     OnFailure. Without either, Restart (or KeepAlive) "always" or "on-failure" restarts the
+//     service after 60s, as on systemd. OnFailureResetPeriod applies to all of them.
+//
+//   - RecoveryCommand         string ()             - Command line the run recovery action starts.
 type KeyValue map[string]interface{}
 
 // bool returns the value of the given name, assuming the value is a boolean.
@@ -267,6 +887,34 @@ func (kv KeyValue) string(name string, defaultValue string) string {
 	return defaultValue
 }
 
+// strings returns the value of the given name, assuming the value is a []string.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) strings(name string, defaultValue []string) []string {
+	if v, found := kv[name]; found {
+		if castValue, is := v.([]string); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// duration returns the value of the given name, assuming the value is a
+// time.Duration or a string accepted by time.ParseDuration.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) duration(name string, defaultValue time.Duration) time.Duration {
+	if v, found := kv[name]; found {
+		switch castValue := v.(type) {
+		case time.Duration:
+			return castValue
+		case string:
+			if d, err := time.ParseDuration(castValue); err == nil {
+				return d
+			}
+		}
+	}
+	return defaultValue
+}
+
 // float64 returns the value of the given name, assuming the value is a float64.
 // If the value isn't found or is not of the type, the defaultValue is returned.
 func (kv KeyValue) float64(name string, defaultValue float64) float64 {
@@ -289,6 +937,49 @@ func (kv KeyValue) funcSingle(name string, defaultValue func()) func() {
 	return defaultValue
 }
 
+// funcError returns the value of the given name, assuming the value is a func(error).
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) funcError(name string, defaultValue func(error)) func(error) {
+	if v, found := kv[name]; found {
+		if castValue, is := v.(func(error)); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// onExit calls the OnExit option, if set, with the error Interface.Stop
+// returned and returns that error.
+func (c *Config) onExit(err error) error {
+	if f := c.Option.funcError(optionOnExit, nil); f != nil {
+		f(err)
+	}
+	return err
+}
+
+// logger returns the named option as a Logger, wrapping an io.Writer
+// if needed. It returns nil when the option is unset.
+func (kv KeyValue) logger(name string) Logger {
+	switch v := kv[name].(type) {
+	case Logger:
+		return v
+	case io.Writer:
+		return newWriterLogger(v)
+	}
+	return nil
+}
+
+// runLogf returns a function reporting a Run lifecycle event to the
+// RunLogger option, which does nothing if the option is not set.
+func (c *Config) runLogf() func(format string, a ...interface{}) {
+	l := c.Option.logger(optionRunLogger)
+	return func(format string, a ...interface{}) {
+		if l != nil {
+			l.Infof(format, a...)
+		}
+	}
+}
+
 // Platform returns a description of the system service.
 func Platform() string {
 	if system == nil {
@@ -297,6 +988,239 @@ func Platform() string {
 	return system.String()
 }
 
+// StatusEx returns the detailed status of s. Systems that can report
+// transitional states return StatusStarting or StatusStopping while the
+// service manager is starting or stopping the service, which lets callers
+// poll for readiness. Other systems report the result of s.Status.
+func StatusEx(s Service) (StatusDetails, error) {
+	if se, ok := s.(interface {
+		StatusEx() (StatusDetails, error)
+	}); ok {
+		return se.StatusEx()
+	}
+	status, err := s.Status()
+	return StatusDetails{Name: s.String(), Status: status}, err
+}
+
+// InstallScript returns the init file, such as the systemd unit or the
+// init script, that s.Install would write, without touching the file
+// system or running any command.
+func InstallScript(s Service) (string, error) {
+	if is, ok := s.(interface {
+		InstallScript() (string, error)
+	}); ok {
+		return is.InstallScript()
+	}
+	return "", notSupported("InstallScript on " + s.Platform())
+}
+
+// LogsFiltered writes the log entries of s that match every filter to
+// out. Filters are structured log fields, such as "PRIORITY": "3" to
+// select errors. It is supported by systemd, which reads the journal.
+func LogsFiltered(ctx context.Context, s Service, filters map[string]string, out io.Writer) error {
+	if l, ok := s.(interface {
+		LogsFiltered(ctx context.Context, filters map[string]string, out io.Writer) error
+	}); ok {
+		return l.LogsFiltered(ctx, filters, out)
+	}
+	return notSupported("LogsFiltered on " + s.Platform())
+}
+
+// ReadLogs returns up to the last lines lines of the output of s. systemd
+// reads the journal; the script backends read the tail of the log files
+// their scripts write, the standard output file first.
+func ReadLogs(s Service, lines int) ([]string, error) {
+	if lines <= 0 {
+		return nil, fmt.Errorf("invalid number of log lines %d: must be positive", lines)
+	}
+	if r, ok := s.(interface {
+		ReadLogs(lines int) ([]string, error)
+	}); ok {
+		return r.ReadLogs(lines)
+	}
+	return nil, notSupported("ReadLogs on " + s.Platform())
+}
+
+// ReadLogsSince returns the output of s logged at or after since. systemd
+// queries the journal; the log files of the script backends are filtered
+// by the timestamp leading each line, so lines the service wrote without
+// one are kept with the line before them.
+func ReadLogsSince(s Service, since time.Time) ([]string, error) {
+	if r, ok := s.(interface {
+		ReadLogsSince(since time.Time) ([]string, error)
+	}); ok {
+		return r.ReadLogsSince(since)
+	}
+	return nil, notSupported("ReadLogsSince on " + s.Platform())
+}
+
+// RestartHistory returns how many times s was restarted after exiting
+// and when it last was, the zero time if never. systemd counts the
+// automatic restarts of the unit; the SysV and rcS scripts count those of
+// their supervise loop since the service was last started, which needs a
+// Restart (or KeepAlive) policy.
+func RestartHistory(s Service) (int, time.Time, error) {
+	if r, ok := s.(interface {
+		RestartHistory() (int, time.Time, error)
+	}); ok {
+		return r.RestartHistory()
+	}
+	return 0, time.Time{}, notSupported("RestartHistory on " + s.Platform())
+}
+
+// LoadInstalledConfig returns the configuration recovered from the files
+// Install generated for s, or ErrNotInstalled. Only the settings the
+// system can read back are filled in: Name, Labels, Executable and
+// Arguments, and UserName on systemd. ArgumentsRaw are not recovered.
+func LoadInstalledConfig(s Service) (*Config, error) {
+	if ic, ok := s.(interface {
+		LoadInstalledConfig() (*Config, error)
+	}); ok {
+		return ic.LoadInstalledConfig()
+	}
+	return nil, notSupported("LoadInstalledConfig on " + s.Platform())
+}
+
+// Diff describes how the installed service s differs from what
+// installing desired would produce, one line per setting, such as
+// "Restart: always -> on-failure" or "LimitNOFILE: (unset) -> 65536".
+// It returns no lines when nothing differs.
+func Diff(s Service, desired *Config) ([]string, error) {
+	if d, ok := s.(interface {
+		Diff(desired *Config) ([]string, error)
+	}); ok {
+		return d.Diff(desired)
+	}
+	return nil, notSupported("Diff on " + s.Platform())
+}
+
+// CgroupPath returns the path of the cgroup the running service s is
+// placed in, such as "/sys/fs/cgroup/system.slice/name.service". It is
+// supported by systemd on the unified cgroup v2 hierarchy.
+func CgroupPath(s Service) (string, error) {
+	if c, ok := s.(interface {
+		CgroupPath() (string, error)
+	}); ok {
+		return c.CgroupPath()
+	}
+	return "", notSupported("CgroupPath on " + s.Platform())
+}
+
+// IsEnabled reports whether the installed service s starts at boot,
+// whatever its current status. It returns ErrNotInstalled if the main
+// file Install writes for s is missing.
+func IsEnabled(s Service) (bool, error) {
+	if e, ok := s.(interface {
+		IsEnabled() (bool, error)
+	}); ok {
+		return e.IsEnabled()
+	}
+	return false, notSupported("IsEnabled on " + s.Platform())
+}
+
+// Capabilities describes what the system managing a service supports, so
+// that a program can offer only the settings that work there.
+type Capabilities struct {
+	UserService    bool // The UserService option installs a per-user service.
+	RestartPolicy  bool // The Restart option controls restarting the service after it exits.
+	ResourceLimits bool // The LimitNOFILE option limits the open files of the service.
+	TasksMax       bool // The TasksMax option limits the tasks of the service.
+
+	StatusDetails       bool // StatusEx is supported.
+	InstallScript       bool // InstallScript is supported.
+	ReadLogs            bool // ReadLogs and ReadLogsSince are supported.
+	LogsFiltered        bool // LogsFiltered is supported.
+	RestartHistory      bool // RestartHistory is supported.
+	LoadInstalledConfig bool // LoadInstalledConfig is supported.
+	IsEnabled           bool // IsEnabled is supported.
+	Diff                bool // Diff is supported.
+	CgroupPath          bool // CgroupPath is supported.
+}
+
+// CapabilitiesOf returns what the system managing s supports. A function
+// reported as supported may still fail for a given configuration, such as
+// RestartHistory without a restart policy.
+//
+// It is not a Capabilities method of Service: most of the answer is which
+// optional interfaces s implements, and a new method would have to be
+// written by every Service implemented outside this package. The type
+// already takes the name Capabilities, hence the Of.
+func CapabilitiesOf(s Service) Capabilities {
+	var c Capabilities
+	if o, ok := s.(interface {
+		optionCapabilities() Capabilities
+	}); ok {
+		c = o.optionCapabilities()
+	}
+	_, c.StatusDetails = s.(interface {
+		StatusEx() (StatusDetails, error)
+	})
+	_, c.InstallScript = s.(interface {
+		InstallScript() (string, error)
+	})
+	_, c.ReadLogs = s.(interface {
+		ReadLogs(lines int) ([]string, error)
+	})
+	_, c.LogsFiltered = s.(interface {
+		LogsFiltered(ctx context.Context, filters map[string]string, out io.Writer) error
+	})
+	_, c.RestartHistory = s.(interface {
+		RestartHistory() (int, time.Time, error)
+	})
+	_, c.LoadInstalledConfig = s.(interface {
+		LoadInstalledConfig() (*Config, error)
+	})
+	_, c.IsEnabled = s.(interface {
+		IsEnabled() (bool, error)
+	})
+	_, c.Diff = s.(interface {
+		Diff(desired *Config) ([]string, error)
+	})
+	_, c.CgroupPath = s.(interface {
+		CgroupPath() (string, error)
+	})
+	return c
+}
+
+// renderScript returns what write writes as a string.
+func renderScript(write func(w io.Writer) error) (string, error) {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// StatusAll returns the status of every service installed on the host
+// by this package, keyed by service name. The chosen system queries the
+// service manager in as few calls as possible.
+func StatusAll() (map[string]StatusDetails, error) {
+	if system == nil {
+		return nil, ErrNoServiceSystemDetected
+	}
+	if sa, ok := system.(interface {
+		StatusAll() (map[string]StatusDetails, error)
+	}); ok {
+		return sa.StatusAll()
+	}
+	return nil, notSupported("StatusAll on " + system.String())
+}
+
+// ListInstalled returns the names of the services installed on the host
+// that the chosen system can manage. It returns an empty list when there
+// are none.
+func ListInstalled() ([]string, error) {
+	if system == nil {
+		return nil, ErrNoServiceSystemDetected
+	}
+	if li, ok := system.(interface {
+		ListInstalled() ([]string, error)
+	}); ok {
+		return li.ListInstalled()
+	}
+	return nil, notSupported("ListInstalled on " + system.String())
+}
+
 // Interactive returns false if running under the OS service manager
 // and true otherwise.
 func Interactive() bool {
@@ -320,10 +1244,70 @@ func newSystem() System {
 // SystemServices are considered in the order they are suggested.
 // Calling this may change what Interactive and Platform return.
 func ChooseSystem(a ...System) {
+	registeredSystems = a
+	useSystems(a)
+}
+
+// useSystems makes a the available systems and detects the system again.
+func useSystems(a []System) {
 	systemRegistry = a
 	system = newSystem()
 }
 
+// SetSystemPriority reorders the available systems so that the named
+// systems are considered first, in the given order, followed by the
+// remaining systems in their previous order. Unknown names are ignored.
+// The system is then detected again; systems whose Detect returns false
+// are still skipped.
+//
+// On Linux the default order is linux-systemd, linux-upstart,
+// linux-openrc, linux-runit, linux-s6, linux-rcs and unix-systemv.
+// For example, to prefer OpenRC over a leftover SysV setup:
+//
+//	service.SetSystemPriority([]string{"linux-openrc"})
+func SetSystemPriority(names []string) {
+	ordered := make([]System, 0, len(systemRegistry))
+	used := make([]bool, len(systemRegistry))
+	for _, name := range names {
+		for i, choice := range systemRegistry {
+			if !used[i] && choice.String() == name {
+				ordered = append(ordered, choice)
+				used[i] = true
+			}
+		}
+	}
+	for i, choice := range systemRegistry {
+		if !used[i] {
+			ordered = append(ordered, choice)
+		}
+	}
+	useSystems(ordered)
+}
+
+// SetSystemOrder restricts the available systems to the named ones,
+// considered in the given order, and detects the system again. Unlisted
+// systems are dropped and unknown names are ignored. Unlike
+// SetSystemPriority it lets a host rule out a system that would be
+// detected wrongly. For example, on a host with a stale systemctl:
+//
+//	service.SetSystemOrder("linux-openrc", "unix-systemv")
+//
+// The names are looked up among all the systems given to ChooseSystem,
+// so a later call may bring back a system an earlier one dropped.
+func SetSystemOrder(names ...string) {
+	ordered := make([]System, 0, len(names))
+	used := make([]bool, len(registeredSystems))
+	for _, name := range names {
+		for i, choice := range registeredSystems {
+			if !used[i] && choice.String() == name {
+				ordered = append(ordered, choice)
+				used[i] = true
+			}
+		}
+	}
+	useSystems(ordered)
+}
+
 // ChosenSystem returns the system that service will use.
 func ChosenSystem() System {
 	return system
@@ -386,6 +1370,16 @@ type Shutdowner interface {
 	Shutdown(s Service) error
 }
 
+// SignalHandler represents a service interface for a program that handles
+// signals itself. When Run waits for a stop signal, HandleSignal receives
+// every signal caught: SIGHUP, SIGUSR1, SIGUSR2, and SIGTERM and SIGINT
+// before they stop the program. An error is logged to the RunLogger and
+// does not stop the program. It is not called on Windows.
+type SignalHandler interface {
+	Interface
+	HandleSignal(sig os.Signal) error
+}
+
 // TODO: Add Configure to Service interface.
 
 // Service represents a service that can be run or controlled.
@@ -437,7 +1431,14 @@ type Service interface {
 // ControlAction list valid string texts to use in Control.
 var ControlAction = [5]string{"start", "stop", "restart", "install", "uninstall"}
 
-// Control issues control functions to the service from a given action string.
+// controlStatus is the Control action reading the status. It is not part
+// of ControlAction, whose array type callers may depend on.
+const controlStatus = "status"
+
+// Control issues control functions to the service from a given action string,
+// one of ControlAction or "status". The "status" action only reports whether the status could be read, such
+// as ErrNotInstalled; call Status for the status itself. Other actions
+// fail with an error wrapping ErrUnknownAction.
 func Control(s Service, action string) error {
 	var err error
 	switch action {
@@ -451,11 +1452,13 @@ func Control(s Service, action string) error {
 		err = s.Install()
 	case ControlAction[4]:
 		err = s.Uninstall()
+	case controlStatus:
+		_, err = s.Status()
 	default:
-		err = fmt.Errorf("Unknown action %s", action)
+		err = fmt.Errorf("%w %q", ErrUnknownAction, action)
 	}
 	if err != nil {
-		return fmt.Errorf("Failed to %s %v: %v", action, s, err)
+		return fmt.Errorf("Failed to %s %v: %w", action, s, err)
 	}
 	return nil
 }
@@ -469,12 +1472,153 @@ type Logger interface {
 	Errorf(format string, a ...interface{}) error
 	Warningf(format string, a ...interface{}) error
 	Infof(format string, a ...interface{}) error
+
+	// WithFields returns a Logger that prepends the given fields,
+	// rendered as sorted key=value pairs, to every message.
+	WithFields(fields map[string]interface{}) Logger
+
+	// Close releases any resources held by the logger, such as the
+	// connection to the system log. It is safe to call more than once.
+	Close() error
 }
 
+// Validate checks that the configuration can be installed. It rejects
+// names that no system accepts, such as names containing a path
+// separator. Each system also runs it, together with its own naming
+// rules, when a service is created.
+func (c *Config) Validate() error {
+	if len(c.Name) == 0 {
+		return ErrNameFieldRequired
+	}
+	bad := invalidNameChars(c.Name, func(r rune) bool {
+		return r != '/' && r != '\\' && !unicode.IsControl(r)
+	})
+	if bad != "" {
+		return fmt.Errorf("invalid service name %q: contains %s", c.Name, bad)
+	}
+	if len(c.Name) > maxNameLength {
+		return fmt.Errorf("invalid service name %q: longer than %d bytes", c.Name, maxNameLength)
+	}
+	return nil
+}
+
+// maxNameLength is the longest file name most file systems accept.
+const maxNameLength = 255
+
+// invalidNameChars returns the distinct runes of name that valid rejects,
+// quoted and separated by commas, or "" if it accepts them all.
+func invalidNameChars(name string, valid func(r rune) bool) string {
+	var bad []string
+	seen := make(map[rune]bool)
+	for _, r := range name {
+		if !valid(r) && !seen[r] {
+			seen[r] = true
+			bad = append(bad, strconv.QuoteRune(r))
+		}
+	}
+	return strings.Join(bad, ", ")
+}
+
+// restartPolicy returns the Restart option when set. Otherwise a set
+// KeepAlive option maps to "always" or "no", or as a SuccessfulExit map
+// to "on-success" or "on-failure", and def is the fallback.
+func (c *Config) restartPolicy(def string) string {
+	if restart := c.Option.string(optionRestart, ""); restart != "" {
+		return restart
+	}
+	if m, ok := c.Option[optionKeepAlive].(map[string]bool); ok {
+		if m["SuccessfulExit"] {
+			return "on-success"
+		}
+		return "on-failure"
+	}
+	if _, found := c.Option[optionKeepAlive]; found {
+		if c.Option.bool(optionKeepAlive, optionKeepAliveDefault) {
+			return "always"
+		}
+		return "no"
+	}
+	return def
+}
+
+// workingDirectories returns WorkingDirectory followed by the
+// WorkingDirectoryFallbacks option, or nil when there are no fallbacks.
+func (c *Config) workingDirectories() []string {
+	fallbacks := c.Option.strings(optionWorkingDirectoryFallbacks, nil)
+	if len(fallbacks) == 0 {
+		return nil
+	}
+	var dirs []string
+	if c.WorkingDirectory != "" {
+		dirs = append(dirs, c.WorkingDirectory)
+	}
+	return append(dirs, fallbacks...)
+}
+
+// workingDirectory returns the working directory to install. With
+// fallbacks, that is the first of workingDirectories that exists.
+func (c *Config) workingDirectory() (string, error) {
+	dirs := c.workingDirectories()
+	if dirs == nil {
+		return c.WorkingDirectory, nil
+	}
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("none of the working directories exist: %s", strings.Join(dirs, ", "))
+}
+
+// description returns the description generated files give the service:
+// Description, falling back to DisplayName and then Name.
+func (c *Config) description() string {
+	switch {
+	case c.Description != "":
+		return c.Description
+	case c.DisplayName != "":
+		return c.DisplayName
+	}
+	return c.Name
+}
+
+// startAtBoot reports whether Install enables the service to start at
+// boot: StartAtBoot, true when unset.
+func (c *Config) startAtBoot() bool {
+	return c.StartAtBoot == nil || *c.StartAtBoot
+}
+
+// instance returns the value of the Instance option.
+func (c *Config) instance() string {
+	return c.Option.string(optionInstance, "")
+}
+
+// instanceName returns the name the service is installed under: Name,
+// or Name-Instance when the Instance option is set.
+func (c *Config) instanceName() string {
+	if instance := c.instance(); instance != "" {
+		return c.Name + "-" + instance
+	}
+	return c.Name
+}
+
+// execPath returns the absolute path of the executable to install:
+// Executable if set, otherwise the running binary. When the
+// ResolveSymlinks option is set, symlinks in either path are resolved;
+// os.Executable may return a symlink on some systems.
 func (c *Config) execPath() (string, error) {
-	if len(c.Executable) != 0 {
-		return filepath.Abs(c.Executable)
+	var path string
+	var err error
+	if len(c.Executable) == 0 {
+		path, err = os.Executable()
+	} else {
+		path, err = filepath.Abs(c.Executable)
+	}
+	if err != nil {
+		return "", err
+	}
+	if c.Option.bool(optionResolveSymlinks, optionResolveSymlinksDefault) {
+		return filepath.EvalSymlinks(path)
 	}
-	
-	return "", nil
+	return path, nil
 }
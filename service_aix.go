@@ -8,15 +8,11 @@
 package service
 
 import (
-	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
-	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
 	"time"
 )
@@ -37,6 +33,9 @@ func (aixSystem) Interactive() bool {
 	return interactive
 }
 func (aixSystem) New(i Interface, c *Config) (Service, error) {
+	if err := c.validateScriptName("S50" + c.Name); err != nil {
+		return nil, err
+	}
 	s := &aixService{
 		i:      i,
 		Config: c,
@@ -46,11 +45,9 @@ func (aixSystem) New(i Interface, c *Config) (Service, error) {
 }
 
 func getArgsFromPid(pid int) string {
-	cmd := exec.Command("ps", "-o", "args", "-p", strconv.Itoa(pid))
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err == nil {
-		lines := strings.Split(out.String(), "\n")
+	_, out, err := runWithOutput("ps", "-o", "args", "-p", strconv.Itoa(pid))
+	if err == nil {
+		lines := strings.Split(out, "\n")
 		if len(lines) > 1 {
 			return strings.TrimSpace(lines[1])
 		}
@@ -134,7 +131,7 @@ func (s *aixService) Install() error {
 		return err
 	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
@@ -160,15 +157,16 @@ func (s *aixService) Install() error {
 	if err = os.Chmod(confPath, 0755); err != nil {
 		return err
 	}
-	rcd := "/etc/rc"
-	if _, err = os.Stat("/etc/rc.d/rc2.d"); err == nil {
-		rcd = "/etc/rc.d/rc"
-	}
+	overwrite := s.Option.bool(optionOverwrite, optionOverwriteDefault)
+	rcd := aixRCPrefix()
+	startAtBoot := s.startAtBoot()
 	for _, i := range [...]string{"2", "3"} {
-		if err = os.Symlink(confPath, rcd+i+".d/S50"+s.Name); err != nil {
-			continue
+		if startAtBoot {
+			if err = symlink(confPath, rcd+i+".d/S50"+s.Name, overwrite); err != nil {
+				continue
+			}
 		}
-		if err = os.Symlink(confPath, rcd+i+".d/K02"+s.Name); err != nil {
+		if err = symlink(confPath, rcd+i+".d/K02"+s.Name, overwrite); err != nil {
 			continue
 		}
 	}
@@ -179,16 +177,12 @@ func (s *aixService) Install() error {
 func (s *aixService) Uninstall() error {
 	s.Stop()
 
-	err := run("rmssys", "-s", s.Name)
-	if err != nil {
-		return err
-	}
-
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	return os.Remove(confPath)
+	// Remove the script even if the subsystem is already gone.
+	return joinErrors(run("rmssys", "-s", s.Name), removePaths(confPath))
 }
 
 func (s *aixService) Status() (Status, error) {
@@ -225,6 +219,25 @@ func (s *aixService) Status() (Status, error) {
 	return StatusUnknown, ErrNotInstalled
 }
 
+// aixRCPrefix returns the path the runlevel directories are named by
+// appending the runlevel and ".d" to.
+func aixRCPrefix() string {
+	if _, err := os.Stat("/etc/rc.d/rc2.d"); err == nil {
+		return "/etc/rc.d/rc"
+	}
+	return "/etc/rc"
+}
+
+// IsEnabled reports whether a start link of the service exists.
+func (s *aixService) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	rcd := aixRCPrefix()
+	return linkEnabled(confPath, rcd+"2.d/S50"+s.Name, rcd+"3.d/S50"+s.Name)
+}
+
 func (s *aixService) Start() error {
 	return run("startsrc", "-s", s.Name)
 }
@@ -241,33 +254,21 @@ func (s *aixService) Restart() error {
 }
 
 func (s *aixService) Run() error {
-	var err error
-
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *aixService) Logger(errs chan<- error) (Logger, error) {
-	if interactive {
+	if s.interactive(interactive) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *aixService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
 var svcConfig = `#!/bin/ksh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
 case "$1" in
 start )
         startsrc -s {{.Name}}
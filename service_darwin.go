@@ -5,15 +5,19 @@
 package service
 
 import (
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
 	"time"
 )
@@ -40,16 +44,47 @@ func (darwinSystem) Interactive() bool {
 }
 
 func (darwinSystem) New(i Interface, c *Config) (Service, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	userService, err := launchdUserService(c.Option)
+	if err != nil {
+		return nil, err
+	}
 	s := &darwinLaunchdService{
 		i:      i,
 		Config: c,
 
-		userService: c.Option.bool(optionUserService, optionUserServiceDefault),
+		userService: userService,
+		sessionType: c.Option.string(optionSessionType, ""),
 	}
 
 	return s, nil
 }
 
+// launchdUserService returns whether the service is a per-user agent,
+// from the UserService option and the session type it must agree with.
+func launchdUserService(kv KeyValue) (bool, error) {
+	userService := kv.bool(optionUserService, optionUserServiceDefault)
+	_, userServiceSet := kv[optionUserService]
+	switch sessionType := kv.string(optionSessionType, ""); sessionType {
+	case "":
+		return userService, nil
+	case "Aqua", "Background":
+		if userServiceSet && !userService {
+			return false, fmt.Errorf("%s %q requires a per-user agent, %s may not be false", optionSessionType, sessionType, optionUserService)
+		}
+		return true, nil
+	case "LoginWindow":
+		if userService {
+			return false, fmt.Errorf("%s %q runs before any user logs in, %s may not be true", optionSessionType, sessionType, optionUserService)
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid %s %q: must be Aqua, Background or LoginWindow", optionSessionType, sessionType)
+	}
+}
+
 func init() {
 	ChooseSystem(darwinSystem{})
 }
@@ -74,6 +109,7 @@ type darwinLaunchdService struct {
 	*Config
 
 	userService bool
+	sessionType string
 }
 
 func (s *darwinLaunchdService) String() string {
@@ -87,6 +123,12 @@ func (s *darwinLaunchdService) Platform() string {
 	return version
 }
 
+// optionCapabilities reports the options launchd honors. Restarting is
+// set with KeepAlive instead of Restart.
+func (s *darwinLaunchdService) optionCapabilities() Capabilities {
+	return Capabilities{UserService: true}
+}
+
 func (s *darwinLaunchdService) getHomeDir() (string, error) {
 	u, err := user.Current()
 	if err == nil {
@@ -109,9 +151,16 @@ func (s *darwinLaunchdService) getServiceFilePath() (string, error) {
 		}
 		return homeDir + "/Library/LaunchAgents/" + s.Name + ".plist", nil
 	}
+	if s.sessionType == "LoginWindow" {
+		return "/Library/LaunchAgents/" + s.Name + ".plist", nil
+	}
 	return "/Library/LaunchDaemons/" + s.Name + ".plist", nil
 }
 
+func (s *darwinLaunchdService) configPath() (string, error) {
+	return s.getServiceFilePath()
+}
+
 func (s *darwinLaunchdService) logDir() (string, error) {
 	if customDir := s.Option.string(optionLogDirectory, ""); customDir != "" {
 		return customDir, nil
@@ -152,13 +201,22 @@ func (s *darwinLaunchdService) template() *template.Template {
 	return template.Must(template.New("").Funcs(functions).Parse(launchdConfig))
 }
 
+// InstallScript returns the file Install would write, without writing it.
+func (s *darwinLaunchdService) InstallScript() (string, error) {
+	return renderScript(s.writePlist)
+}
+
 func (s *darwinLaunchdService) Install() error {
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
@@ -176,31 +234,222 @@ func (s *darwinLaunchdService) Install() error {
 	}
 	defer f.Close()
 
+	return s.writePlist(f)
+}
+
+// writePlist renders the launchd property list for the service to w.
+func (s *darwinLaunchdService) writePlist(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
 
+	rawPlist, err := rawPlistEntries(s.Option)
+	if err != nil {
+		return err
+	}
+	if err = checkKeepAlive(s.Option); err != nil {
+		return err
+	}
+	startInterval, err := launchdSeconds(s.Option, optionStartInterval)
+	if err != nil {
+		return err
+	}
+	throttleInterval, err := launchdSeconds(s.Option, optionThrottleInterval)
+	if err != nil {
+		return err
+	}
+	// The map form is rendered here; KeepAlive stays a bool for the
+	// LaunchdConfig templates written against it.
+	keepAlive, _ := launchdKeepAlive(s.Option).(bool)
+	var keepAliveDict strings.Builder
+	if m, ok := launchdKeepAlive(s.Option).(map[string]bool); ok {
+		if err = writePlistValue(&keepAliveDict, m, 1); err != nil {
+			return err
+		}
+	}
+
 	stdOutPath, stdErrPath, _ := s.getLogPaths()
 	var to = &struct {
 		*Config
-		Path string
-
-		KeepAlive, RunAtLoad bool
-		SessionCreate        bool
-		StandardOutPath      string
-		StandardErrorPath    string
+		Path     string
+		RawPlist string
+
+		KeepAlive         bool
+		KeepAliveDict     string
+		RunAtLoad         bool
+		SessionCreate     bool
+		StandardOutPath   string
+		StandardErrorPath string
+		SessionType       string
+		StartInterval     int64
+		ThrottleInterval  int64
+		Description       string
 	}{
 		Config:            s.Config,
 		Path:              path,
-		KeepAlive:         s.Option.bool(optionKeepAlive, optionKeepAliveDefault),
+		RawPlist:          rawPlist,
+		KeepAlive:         keepAlive,
+		KeepAliveDict:     keepAliveDict.String(),
 		RunAtLoad:         s.Option.bool(optionRunAtLoad, optionRunAtLoadDefault),
 		SessionCreate:     s.Option.bool(optionSessionCreate, optionSessionCreateDefault),
 		StandardOutPath:   stdOutPath,
 		StandardErrorPath: stdErrPath,
+		SessionType:       s.sessionType,
+		StartInterval:     startInterval,
+		ThrottleInterval:  throttleInterval,
+		// "--" may not appear in an XML comment.
+		Description: strings.Replace(s.description(), "--", "- -", -1),
 	}
 
-	return s.template().Execute(f, to)
+	return s.template().Execute(w, to)
+}
+
+// launchdKeepAlive returns the KeepAlive option, a bool or a map keyed
+// on SuccessfulExit. It defaults to true, or false for a service started
+// every StartInterval.
+func launchdKeepAlive(kv KeyValue) interface{} {
+	if m, ok := kv[optionKeepAlive].(map[string]bool); ok {
+		return m
+	}
+	_, periodic := kv[optionStartInterval]
+	return kv.bool(optionKeepAlive, optionKeepAliveDefault && !periodic)
+}
+
+// launchdSeconds returns the option name, an int number of seconds or a
+// time.Duration, as whole seconds, or 0 if it is not set.
+func launchdSeconds(kv KeyValue, name string) (int64, error) {
+	var d time.Duration
+	switch v := kv[name].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		d = time.Duration(v) * time.Second
+	case time.Duration:
+		d = v
+	default:
+		return 0, fmt.Errorf("invalid %s %v: must be an int of seconds or a time.Duration", name, v)
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid %s %v: must be a positive number of whole seconds", name, kv[name])
+	}
+	return int64(d / time.Second), nil
+}
+
+// checkKeepAlive returns an error unless the KeepAlive option is unset,
+// a bool or a map with just the SuccessfulExit key.
+func checkKeepAlive(kv KeyValue) error {
+	switch v := kv[optionKeepAlive].(type) {
+	case nil, bool:
+		return nil
+	case map[string]bool:
+		if _, ok := v["SuccessfulExit"]; ok && len(v) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %v: must be a bool or map[string]bool{\"SuccessfulExit\": ...}", optionKeepAlive, kv[optionKeepAlive])
+}
+
+// launchdKeys are the keys the launchd template may set, which the
+// DarwinRawPlist option must not repeat.
+var launchdKeys = []string{
+	"Disabled", "EnvironmentVariables", "KeepAlive", "Label", "LimitLoadToSessionType", "ProgramArguments",
+	"RootDirectory", "RunAtLoad", "SessionCreate", "StandardErrorPath", "StandardOutPath", "StartInterval",
+	"ThrottleInterval", "UserName", "WorkingDirectory",
+}
+
+// rawPlistEntries renders the keys of the DarwinRawPlist option, sorted,
+// as entries of the top level dict of the plist.
+func rawPlistEntries(kv KeyValue) (string, error) {
+	raw, _ := kv[optionDarwinRawPlist].(map[string]interface{})
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		for _, known := range launchdKeys {
+			if k == known {
+				return "", fmt.Errorf("%s key %q is set by the service configuration", optionDarwinRawPlist, k)
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		if err := writePlistEntry(&b, k, raw[k], 1); err != nil {
+			return "", fmt.Errorf("%s key %q: %v", optionDarwinRawPlist, k, err)
+		}
+	}
+	return b.String(), nil
+}
+
+// writePlistEntry writes key and the plist value of v to b, each on a
+// new line indented by depth tabs.
+func writePlistEntry(b *strings.Builder, key string, v interface{}, depth int) error {
+	indent := "\n" + strings.Repeat("\t", depth)
+	b.WriteString(indent + "<key>")
+	xml.EscapeText(b, []byte(key))
+	b.WriteString("</key>")
+	return writePlistValue(b, v, depth)
+}
+
+// writePlistValue writes the plist value of v to b on a new line
+// indented by depth tabs.
+func writePlistValue(b *strings.Builder, v interface{}, depth int) error {
+	indent := "\n" + strings.Repeat("\t", depth)
+	switch t := v.(type) {
+	case string:
+		b.WriteString(indent + "<string>")
+		xml.EscapeText(b, []byte(t))
+		b.WriteString("</string>")
+		return nil
+	case bool:
+		b.WriteString(indent + "<" + strconv.FormatBool(t) + "/>")
+		return nil
+	case []byte:
+		b.WriteString(indent + "<data>" + base64.StdEncoding.EncodeToString(t) + "</data>")
+		return nil
+	case time.Time:
+		b.WriteString(indent + "<date>" + t.UTC().Format(time.RFC3339) + "</date>")
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteString(indent + "<integer>" + strconv.FormatInt(rv.Int(), 10) + "</integer>")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b.WriteString(indent + "<integer>" + strconv.FormatUint(rv.Uint(), 10) + "</integer>")
+	case reflect.Float32, reflect.Float64:
+		b.WriteString(indent + "<real>" + strconv.FormatFloat(rv.Float(), 'g', -1, 64) + "</real>")
+	case reflect.Slice, reflect.Array:
+		b.WriteString(indent + "<array>")
+		for i := 0; i < rv.Len(); i++ {
+			if err := writePlistValue(b, rv.Index(i).Interface(), depth+1); err != nil {
+				return err
+			}
+		}
+		b.WriteString(indent + "</array>")
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", rv.Type().Key())
+		}
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		b.WriteString(indent + "<dict>")
+		for _, k := range keys {
+			value := rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface()
+			if err := writePlistEntry(b, k, value, depth+1); err != nil {
+				return err
+			}
+		}
+		b.WriteString(indent + "</dict>")
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+	return nil
 }
 
 func (s *darwinLaunchdService) Uninstall() error {
@@ -216,9 +465,7 @@ func (s *darwinLaunchdService) Uninstall() error {
 func (s *darwinLaunchdService) Status() (Status, error) {
 	exitCode, out, err := runWithOutput("launchctl", "list", s.Name)
 	if exitCode == 0 && err != nil {
-		if !strings.Contains(err.Error(), "failed with stderr") {
-			return StatusUnknown, err
-		}
+		return StatusUnknown, err
 	}
 
 	re := regexp.MustCompile(`"PID" = ([0-9]+);`)
@@ -239,12 +486,25 @@ func (s *darwinLaunchdService) Status() (Status, error) {
 	return StatusUnknown, ErrNotInstalled
 }
 
+// runLaunchctl runs launchctl, which can fail with a zero exit status.
+// Output on stderr is therefore treated as a failure too.
+func runLaunchctl(arguments ...string) error {
+	_, _, stderr, err := runWithOutputAll("launchctl", arguments...)
+	if err != nil {
+		return err
+	}
+	if len(stderr) > 0 && !strings.HasSuffix(stderr, "Operation now in progress\n") {
+		return fmt.Errorf("%q failed with stderr: %s", "launchctl", stderr)
+	}
+	return nil
+}
+
 func (s *darwinLaunchdService) Start() error {
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
 		return err
 	}
-	return run("launchctl", "load", confPath)
+	return runLaunchctl("load", confPath)
 }
 
 func (s *darwinLaunchdService) Stop() error {
@@ -252,7 +512,7 @@ func (s *darwinLaunchdService) Stop() error {
 	if err != nil {
 		return err
 	}
-	return run("launchctl", "unload", confPath)
+	return runLaunchctl("unload", confPath)
 }
 
 func (s *darwinLaunchdService) Restart() error {
@@ -265,32 +525,22 @@ func (s *darwinLaunchdService) Restart() error {
 }
 
 func (s *darwinLaunchdService) Run() error {
-	err := s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *darwinLaunchdService) Logger(errs chan<- error) (Logger, error) {
-	if interactive {
+	if s.interactive(interactive) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 
 func (s *darwinLaunchdService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
 var launchdConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg) -->
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0">
 <dict>
@@ -306,9 +556,16 @@ var launchdConfig = `<?xml version="1.0" encoding="UTF-8"?>
 	</dict>
 	{{- end}}
 	<key>KeepAlive</key>
+	{{- if .KeepAliveDict}}{{.KeepAliveDict}}{{else}}
 	<{{bool .KeepAlive}}/>
+	{{- end}}
+	<!-- {{.Description}} -->
 	<key>Label</key>
 	<string>{{html .Name}}</string>
+	{{- if .SessionType}}
+	<key>LimitLoadToSessionType</key>
+	<string>{{.SessionType}}</string>
+	{{- end}}
 	<key>ProgramArguments</key>
 	<array>
 		<string>{{html .Path}}</string>
@@ -334,6 +591,14 @@ var launchdConfig = `<?xml version="1.0" encoding="UTF-8"?>
 	<key>StandardOutPath</key>
 	<string>{{html .StandardOutPath}}</string>
 	{{- end}}
+	{{- if .StartInterval}}
+	<key>StartInterval</key>
+	<integer>{{.StartInterval}}</integer>
+	{{- end}}
+	{{- if .ThrottleInterval}}
+	<key>ThrottleInterval</key>
+	<integer>{{.ThrottleInterval}}</integer>
+	{{- end}}
 	{{- if .UserName}}
 	<key>UserName</key>
 	<string>{{html .UserName}}</string>
@@ -342,6 +607,7 @@ var launchdConfig = `<?xml version="1.0" encoding="UTF-8"?>
 	<key>WorkingDirectory</key>
 	<string>{{html .WorkingDirectory}}</string>
 	{{- end}}
+	{{- .RawPlist}}
 </dict>
 </plist>
 `
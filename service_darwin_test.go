@@ -0,0 +1,187 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawPlistEntries(t *testing.T) {
+	kv := KeyValue{optionDarwinRawPlist: map[string]interface{}{
+		"SoftResourceLimits": map[string]interface{}{"NumberOfFiles": 4096, "Core": 0},
+		"Sockets": map[string]interface{}{
+			"Listeners": []interface{}{map[string]string{"SockServiceName": "8080"}},
+		},
+		"ExitTimeOut":   1.5,
+		"LowPriorityIO": true,
+		"Program":       "a<b",
+	}}
+	want := `
+	<key>ExitTimeOut</key>
+	<real>1.5</real>
+	<key>LowPriorityIO</key>
+	<true/>
+	<key>Program</key>
+	<string>a&lt;b</string>
+	<key>Sockets</key>
+	<dict>
+		<key>Listeners</key>
+		<array>
+			<dict>
+				<key>SockServiceName</key>
+				<string>8080</string>
+			</dict>
+		</array>
+	</dict>
+	<key>SoftResourceLimits</key>
+	<dict>
+		<key>Core</key>
+		<integer>0</integer>
+		<key>NumberOfFiles</key>
+		<integer>4096</integer>
+	</dict>`
+	got, err := rawPlistEntries(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("rawPlistEntries() = %s\nwant %s", got, want)
+	}
+
+	for _, raw := range []map[string]interface{}{
+		{"Label": "other"},
+		{"Bad": struct{}{}},
+		{"Bad": map[int]string{1: "a"}},
+	} {
+		if _, err := rawPlistEntries(KeyValue{optionDarwinRawPlist: raw}); err == nil {
+			t.Errorf("rawPlistEntries(%v) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestLaunchdKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "\n\t<true/>"},
+		{false, "\n\t<false/>"},
+		{map[string]bool{"SuccessfulExit": false}, "\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>"},
+	} {
+		kv := KeyValue{}
+		if tt.value != nil {
+			kv[optionKeepAlive] = tt.value
+		}
+		if err := checkKeepAlive(kv); err != nil {
+			t.Errorf("checkKeepAlive(%v) = %v", tt.value, err)
+		}
+		var b strings.Builder
+		if err := writePlistValue(&b, launchdKeepAlive(kv), 1); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("KeepAlive %v renders %q, want %q", tt.value, b.String(), tt.want)
+		}
+	}
+
+	for _, value := range []interface{}{"yes", map[string]bool{}, map[string]bool{"Crashed": true}} {
+		if err := checkKeepAlive(KeyValue{optionKeepAlive: value}); err == nil {
+			t.Errorf("checkKeepAlive(%v) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestLaunchdIntervals(t *testing.T) {
+	s := &darwinLaunchdService{Config: &Config{Name: "app", Executable: "/usr/local/bin/app", Option: KeyValue{
+		optionStartInterval:    3600,
+		optionThrottleInterval: 30 * time.Second,
+	}}}
+	var buf bytes.Buffer
+	if err := s.writePlist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\t<key>KeepAlive</key>\n\t<false/>\n",
+		"\t<key>StartInterval</key>\n\t<integer>3600</integer>\n",
+		"\t<key>ThrottleInterval</key>\n\t<integer>30</integer>\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("plist missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	for _, value := range []interface{}{0, -5, 1500 * time.Millisecond, "60"} {
+		s.Option = KeyValue{optionStartInterval: value}
+		if err := s.writePlist(&buf); err == nil {
+			t.Errorf("writePlist() with %s %v succeeded, want an error", optionStartInterval, value)
+		}
+	}
+}
+
+func TestLaunchdSessionType(t *testing.T) {
+	for _, tt := range []struct {
+		options KeyValue
+		user    bool
+		wantErr bool
+	}{
+		{KeyValue{}, false, false},
+		{KeyValue{optionSessionType: "Aqua"}, true, false},
+		{KeyValue{optionSessionType: "Background", optionUserService: true}, true, false},
+		{KeyValue{optionSessionType: "Aqua", optionUserService: false}, false, true},
+		{KeyValue{optionSessionType: "LoginWindow"}, false, false},
+		{KeyValue{optionSessionType: "LoginWindow", optionUserService: true}, false, true},
+		{KeyValue{optionSessionType: "System"}, false, true},
+	} {
+		user, err := launchdUserService(tt.options)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("launchdUserService(%v) error = %v, wantErr %v", tt.options, err, tt.wantErr)
+			continue
+		}
+		if user != tt.user {
+			t.Errorf("launchdUserService(%v) = %v, want %v", tt.options, user, tt.user)
+		}
+	}
+
+	s := &darwinLaunchdService{
+		Config:      &Config{Name: "app", Executable: "/usr/local/bin/app"},
+		sessionType: "LoginWindow",
+	}
+	if p, err := s.getServiceFilePath(); err != nil || p != "/Library/LaunchAgents/app.plist" {
+		t.Errorf("getServiceFilePath() = %q, %v, want /Library/LaunchAgents/app.plist", p, err)
+	}
+	var buf bytes.Buffer
+	if err := s.writePlist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\t<key>LimitLoadToSessionType</key>\n\t<string>LoginWindow</string>\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("plist missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestLaunchdKeepAliveTemplate(t *testing.T) {
+	s := &darwinLaunchdService{Config: &Config{Name: "app", Executable: "/usr/local/bin/app", Option: KeyValue{
+		optionKeepAlive: map[string]bool{"SuccessfulExit": false},
+	}}}
+	var buf bytes.Buffer
+	if err := s.writePlist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("plist missing %q:\n%s", want, buf.String())
+	}
+
+	// Custom configs written against the bool KeepAlive still render.
+	s.Option = KeyValue{optionLaunchdConfig: "<key>KeepAlive</key><{{bool .KeepAlive}}/>"}
+	buf.Reset()
+	if err := s.writePlist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<key>KeepAlive</key><true/>"; buf.String() != want {
+		t.Errorf("custom plist = %q, want %q", buf.String(), want)
+	}
+}
@@ -5,11 +5,10 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
 	"text/template"
 )
 
@@ -28,6 +27,9 @@ func (freebsdSystem) Interactive() bool {
 	return interactive
 }
 func (freebsdSystem) New(i Interface, c *Config) (Service, error) {
+	if err := c.validateScriptName(c.Name); err != nil {
+		return nil, err
+	}
 	s := &freebsdService{
 		i:      i,
 		Config: c,
@@ -110,7 +112,7 @@ func (s *freebsdService) Install() error {
 		return err
 	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
@@ -158,7 +160,7 @@ func (s *freebsdService) Status() (Status, error) {
 		return StatusStopped, ErrNotInstalled
 	}
 
-	status, _, err := runCommand("service", false, s.Name, "status")
+	status, _, _, err := runCommand(context.Background(), "service", false, s.Name, "status")
 	if status == 1 {
 		return StatusStopped, nil
 	} else if err != nil {
@@ -180,34 +182,22 @@ func (s *freebsdService) Restart() error {
 }
 
 func (s *freebsdService) Run() error {
-	var err error
-
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *freebsdService) Logger(errs chan<- error) (Logger, error) {
-	if interactive {
+	if s.interactive(interactive) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 
 func (s *freebsdService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
 var rcScript = `#!/bin/sh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
 
 # PROVIDE: {{.Name}}
 # REQUIRE: SERVERS
@@ -0,0 +1,416 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_notSupported(t *testing.T) {
+	err := notSupported("Reload")
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("errors.Is(%v, ErrNotSupported) = false", err)
+	}
+	if errors.Unwrap(err) != ErrNotSupported {
+		t.Errorf("errors.Unwrap(%v) = %v, want ErrNotSupported", err, errors.Unwrap(err))
+	}
+	if !strings.Contains(err.Error(), "Reload") {
+		t.Errorf("error %q lacks operation context", err)
+	}
+}
+
+func TestStatusAllNotSupported(t *testing.T) {
+	orig := system
+	defer func() { system = orig }()
+
+	system = stubSystem{}
+	if _, err := StatusAll(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("StatusAll() error = %v, want ErrNotSupported", err)
+	}
+}
+
+// stubSystem is a System with no optional capabilities.
+type stubSystem struct{}
+
+func (stubSystem) String() string    { return "stub" }
+func (stubSystem) Detect() bool      { return true }
+func (stubSystem) Interactive() bool { return true }
+func (stubSystem) New(i Interface, c *Config) (Service, error) {
+	return nil, ErrNoServiceSystemDetected
+}
+
+// stubService is a Service reporting a fixed status. Control methods
+// record their name in calls.
+type stubService struct {
+	name   string
+	status Status
+	err    error
+	calls  []string
+}
+
+func (s *stubService) record(call string) error {
+	s.calls = append(s.calls, call)
+	return nil
+}
+
+func (s *stubService) Run() error                                { return s.record("run") }
+func (s *stubService) Start() error                              { return s.record("start") }
+func (s *stubService) Stop() error                               { return s.record("stop") }
+func (s *stubService) Restart() error                            { return s.record("restart") }
+func (s *stubService) Install() error                            { return s.record("install") }
+func (s *stubService) Uninstall() error                          { return s.record("uninstall") }
+func (s *stubService) Logger(chan<- error) (Logger, error)       { return ConsoleLogger, nil }
+func (s *stubService) SystemLogger(chan<- error) (Logger, error) { return ConsoleLogger, nil }
+func (s *stubService) String() string                            { return s.name }
+func (s *stubService) Platform() string                          { return "stub" }
+func (s *stubService) Status() (Status, error)                   { s.record("status"); return s.status, s.err }
+func (s *stubService) configPath() (string, error)               { return "/etc/stub/" + s.name, nil }
+
+func TestControl(t *testing.T) {
+	tests := []struct {
+		action  string
+		err     error
+		wantErr error
+	}{
+		{"start", nil, nil},
+		{"stop", nil, nil},
+		{"restart", nil, nil},
+		{"install", nil, nil},
+		{"uninstall", nil, nil},
+		{"status", nil, nil},
+		{"status", ErrNotInstalled, ErrNotInstalled},
+		{"reload", nil, ErrUnknownAction},
+		{"", nil, ErrUnknownAction},
+	}
+	for _, tt := range tests {
+		s := &stubService{name: "app", err: tt.err}
+		err := Control(s, tt.action)
+		if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("Control(%q) error = %v, want %v", tt.action, err, tt.wantErr)
+		}
+		wantCalls := []string{tt.action}
+		if errors.Is(tt.wantErr, ErrUnknownAction) {
+			wantCalls = nil
+		}
+		if !reflect.DeepEqual(s.calls, wantCalls) {
+			t.Errorf("Control(%q) called %v, want %v", tt.action, s.calls, wantCalls)
+		}
+	}
+	for _, action := range append(ControlAction[:], controlStatus) {
+		if err := Control(&stubService{name: "app"}, action); err != nil {
+			t.Errorf("Control(%q) error = %v", action, err)
+		}
+	}
+}
+
+func TestConfigExecPathSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := filepath.Join(dir, "v1.2.3")
+	if err := os.MkdirAll(filepath.Join(release, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(release, "bin", "app"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	current := filepath.Join(dir, "current")
+	if err := os.Symlink(release, current); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    string
+	}{
+		{"default-keeps-link", nil, filepath.Join(current, "bin", "app")},
+		{"resolve", KeyValue{optionResolveSymlinks: true}, filepath.Join(release, "bin", "app")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Executable: filepath.Join(current, "bin", "app"), Option: tt.options}
+			got, err := c.execPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("execPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.EvalSymlinks(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{Option: KeyValue{optionResolveSymlinks: true}}
+	if got, err := c.execPath(); err != nil || got != want {
+		t.Errorf("execPath() of the running binary = %q, %v, want %q", got, err, want)
+	}
+}
+
+// namedSystem is a System with a configurable name and detection result.
+type namedSystem struct {
+	name   string
+	detect bool
+}
+
+func (n namedSystem) String() string                              { return n.name }
+func (n namedSystem) Detect() bool                                { return n.detect }
+func (n namedSystem) Interactive() bool                           { return true }
+func (n namedSystem) New(i Interface, c *Config) (Service, error) { return nil, nil }
+
+// stubServiceSystem is a System creating stubServices.
+type stubServiceSystem struct{ namedSystem }
+
+func (stubServiceSystem) New(i Interface, c *Config) (Service, error) {
+	return &stubService{name: c.Name}, nil
+}
+
+func TestNewMulti(t *testing.T) {
+	origSystem := system
+	defer func() { system = origSystem }()
+	system = stubServiceSystem{namedSystem{"stub", true}}
+
+	services, err := NewMulti([]ServiceDef{
+		{nil, &Config{Name: "api"}},
+		{nil, &Config{Name: "worker"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].String() != "api" || services[1].String() != "worker" {
+		t.Fatalf("NewMulti() = %v, want api and worker", services)
+	}
+	if err := InstallAll(services); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartAll(services); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range services {
+		if calls := s.(*stubService).calls; !reflect.DeepEqual(calls, []string{"install", "start"}) {
+			t.Errorf("%v calls = %v, want install and start", s, calls)
+		}
+	}
+
+	for _, defs := range [][]ServiceDef{
+		{{nil, &Config{Name: "api"}}, {nil, &Config{Name: "api"}}},
+		{{nil, &Config{Name: "api"}}, {nil, &Config{}}},
+		{{nil, nil}},
+	} {
+		if _, err := NewMulti(defs); err == nil {
+			t.Errorf("NewMulti(%v) succeeded, want an error", defs)
+		}
+	}
+}
+
+func TestReinstall(t *testing.T) {
+	tests := []struct {
+		name   string
+		status Status
+		err    error
+		want   []string
+	}{
+		{"fresh", StatusUnknown, ErrNotInstalled, []string{"status", "install"}},
+		{"upgrade-running", StatusRunning, nil, []string{"status", "stop", "uninstall", "install", "start"}},
+		{"upgrade-stopped", StatusStopped, nil, []string{"status", "uninstall", "install"}},
+	}
+	for _, tt := range tests {
+		s := &stubService{name: "app", status: tt.status, err: tt.err}
+		if err := Reinstall(s); err != nil {
+			t.Errorf("%s: Reinstall() = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(s.calls, tt.want) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, s.calls, tt.want)
+		}
+	}
+}
+
+// startingService reports the statuses in order, then the last one.
+type startingService struct {
+	stubService
+	statuses []Status
+}
+
+func (s *startingService) Status() (Status, error) {
+	st := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	return st, nil
+}
+
+func TestStartAndWait(t *testing.T) {
+	defer func(d time.Duration) { startWaitPollInterval = d }(startWaitPollInterval)
+	startWaitPollInterval = time.Millisecond
+
+	s := &startingService{
+		stubService: stubService{name: "app"},
+		statuses:    []Status{StatusStarting, StatusStarting, StatusRunning},
+	}
+	checks := 0
+	ready := func() (bool, error) {
+		checks++
+		if checks < 3 {
+			return false, errors.New("connection refused")
+		}
+		return true, nil
+	}
+	if err := StartAndWait(context.Background(), s, ready); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.calls) != 1 || s.calls[0] != "start" {
+		t.Errorf("calls = %v, want start", s.calls)
+	}
+	if checks != 3 {
+		t.Errorf("ready called %d times, want 3", checks)
+	}
+
+	s.statuses = []Status{StatusStopped, StatusStarting, StatusRunning}
+	if err := StartAndWait(context.Background(), s, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s.statuses = []Status{StatusRunning}
+	err := StartAndWait(ctx, s, func() (bool, error) { return false, errors.New("connection refused") })
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("StartAndWait() of a service never ready = %v, want the deadline and the last check", err)
+	}
+
+}
+
+func TestSetSystemPriority(t *testing.T) {
+	origSystem, origRegistry, origRegistered := system, systemRegistry, registeredSystems
+	defer func() { system, systemRegistry, registeredSystems = origSystem, origRegistry, origRegistered }()
+
+	systemd := namedSystem{"linux-systemd", false}
+	openrc := namedSystem{"linux-openrc", true}
+	sysv := namedSystem{"unix-systemv", true}
+
+	ChooseSystem(systemd, sysv, openrc)
+	if got := ChosenSystem(); got != sysv {
+		t.Fatalf("default ChosenSystem() = %v, want %v", got, sysv)
+	}
+
+	SetSystemPriority([]string{"linux-openrc", "unknown"})
+	if got := ChosenSystem(); got != openrc {
+		t.Errorf("ChosenSystem() = %v, want %v", got, openrc)
+	}
+	want := []System{openrc, systemd, sysv}
+	for i, got := range AvailableSystems() {
+		if got != want[i] {
+			t.Errorf("AvailableSystems()[%d] = %v, want %v", i, got, want[i])
+		}
+	}
+
+	// Systems failing detection are skipped even when prioritized.
+	SetSystemPriority([]string{"linux-systemd"})
+	if got := ChosenSystem(); got != openrc {
+		t.Errorf("ChosenSystem() = %v, want %v", got, openrc)
+	}
+}
+
+func TestSetSystemOrder(t *testing.T) {
+	origSystem, origRegistry, origRegistered := system, systemRegistry, registeredSystems
+	defer func() { system, systemRegistry, registeredSystems = origSystem, origRegistry, origRegistered }()
+
+	systemd := namedSystem{"linux-systemd", true}
+	openrc := namedSystem{"linux-openrc", true}
+	sysv := namedSystem{"unix-systemv", true}
+
+	ChooseSystem(systemd, openrc, sysv)
+	SetSystemOrder("unix-systemv", "unknown", "linux-openrc")
+	if got := ChosenSystem(); got != sysv {
+		t.Errorf("ChosenSystem() = %v, want %v", got, sysv)
+	}
+	want := []System{sysv, openrc}
+	if got := AvailableSystems(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailableSystems() = %v, want %v", got, want)
+	}
+
+	// Excluded systems are not considered, but a later order can bring
+	// them back.
+	SetSystemPriority([]string{"linux-openrc"})
+	SetSystemOrder("unknown")
+	if got := ChosenSystem(); got != nil {
+		t.Errorf("ChosenSystem() after excluding all = %v, want nil", got)
+	}
+	SetSystemOrder("linux-systemd")
+	if got := ChosenSystem(); got != systemd {
+		t.Errorf("ChosenSystem() after ordering an excluded system = %v, want %v", got, systemd)
+	}
+}
+
+func TestNewForSystem(t *testing.T) {
+	origSystem, origRegistry, origRegistered := system, systemRegistry, registeredSystems
+	defer func() { system, systemRegistry, registeredSystems = origSystem, origRegistry, origRegistered }()
+	ChooseSystem(namedSystem{"linux-systemd", true}, stubSystem{})
+
+	// linux-systemd is detected first, but stub can still be forced; its
+	// New returns ErrNoServiceSystemDetected.
+	if _, err := NewForSystem("stub", nil, &Config{Name: "app"}); err != ErrNoServiceSystemDetected {
+		t.Errorf("NewForSystem(stub) error = %v, want the stub system's error", err)
+	}
+	if _, err := NewForSystem("linux-systemd", nil, &Config{Name: "app"}); err != nil {
+		t.Errorf("NewForSystem(linux-systemd) error = %v", err)
+	}
+	_, err := NewForSystem("linux-missing", nil, &Config{Name: "app"})
+	if err == nil || !strings.Contains(err.Error(), "linux-missing") || !strings.Contains(err.Error(), "linux-systemd, stub") {
+		t.Errorf("NewForSystem(linux-missing) error = %v", err)
+	}
+	if _, err := NewForSystem("stub", nil, &Config{}); err != ErrNameFieldRequired {
+		t.Errorf("NewForSystem() without name error = %v, want ErrNameFieldRequired", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"app", ""},
+		{"My App", ""},
+		{"", ErrNameFieldRequired.Error()},
+		{"etc/app", `contains '/'`},
+		{`a\b/c\d`, `contains '\\', '/'`},
+		{"app\x00", `contains '\x00'`},
+		{strings.Repeat("a", 256), "longer than 255 bytes"},
+	}
+	for _, tt := range tests {
+		err := (&Config{Name: tt.name}).Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Validate(%q) = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Validate(%q) = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -6,19 +6,39 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 var cgroupFile = "/proc/1/cgroup"
 
+var procVersionFile = "/proc/version"
+
+// supervisorBinaries are the names of parent processes which indicate the
+// process is being run by a service manager.
+var supervisorBinaries = []string{"systemd", "runsv", "s6-supervise"}
+
 type linuxSystemService struct {
 	name        string
 	detect      func() bool
 	interactive func() bool
 	new         func(i Interface, platform string, c *Config) (Service, error)
+	statusAll   func() (map[string]StatusDetails, error)
+	listInstall func() ([]string, error)
 }
 
 func (sc linuxSystemService) String() string {
@@ -33,6 +53,21 @@ func (sc linuxSystemService) Interactive() bool {
 func (sc linuxSystemService) New(i Interface, c *Config) (Service, error) {
 	return sc.new(i, sc.String(), c)
 }
+func (sc linuxSystemService) InContainer() (bool, error) {
+	return isInContainer(cgroupFile)
+}
+func (sc linuxSystemService) StatusAll() (map[string]StatusDetails, error) {
+	if sc.statusAll == nil {
+		return nil, notSupported("StatusAll on " + sc.name)
+	}
+	return sc.statusAll()
+}
+func (sc linuxSystemService) ListInstalled() ([]string, error) {
+	if sc.listInstall == nil {
+		return nil, notSupported("ListInstalled on " + sc.name)
+	}
+	return sc.listInstall()
+}
 
 func init() {
 	ChooseSystem(linuxSystemService{
@@ -42,7 +77,9 @@ func init() {
 			is, _ := isInteractive()
 			return is
 		},
-		new: newSystemdService,
+		new:         newSystemdService,
+		statusAll:   systemdStatusAll,
+		listInstall: systemdListInstalled,
 	},
 		linuxSystemService{
 			name:   "linux-upstart",
@@ -62,6 +99,24 @@ func init() {
 			},
 			new: newOpenRCService,
 		},
+		linuxSystemService{
+			name:   "linux-runit",
+			detect: isRunit,
+			interactive: func() bool {
+				is, _ := isInteractive()
+				return is
+			},
+			new: newRunitService,
+		},
+		linuxSystemService{
+			name:   "linux-s6",
+			detect: isS6,
+			interactive: func() bool {
+				is, _ := isInteractive()
+				return is
+			},
+			new: newS6Service,
+		},
 		linuxSystemService{
 			name:   "linux-rcs",
 			detect: isRCS,
@@ -69,7 +124,8 @@ func init() {
 				is, _ := isInteractive()
 				return is
 			},
-			new: newRCSService,
+			new:         newRCSService,
+			listInstall: rcsListInstalled,
 		},
 		linuxSystemService{
 			name:   "unix-systemv",
@@ -78,7 +134,8 @@ func init() {
 				is, _ := isInteractive()
 				return is
 			},
-			new: newSystemVService,
+			new:         newSystemVService,
+			listInstall: sysvListInstalled,
 		},
 	)
 }
@@ -98,6 +155,11 @@ func binaryName(pid int) (string, error) {
 }
 
 func isInteractive() (bool, error) {
+	if isWSL() {
+		// WSL has no real init system; its PID 1 is provided by Windows.
+		return true, nil
+	}
+
 	inContainer, err := isInContainer(cgroupFile)
 	if err != nil {
 		return false, err
@@ -113,11 +175,39 @@ func isInteractive() (bool, error) {
 	}
 
 	binary, _ := binaryName(ppid)
-	return binary != "systemd", nil
+	for _, supervisor := range supervisorBinaries {
+		if binary == supervisor {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isWSL reports whether the process runs under the Windows Subsystem
+// for Linux.
+func isWSL() bool {
+	version, err := ioutil.ReadFile(procVersionFile)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(version)), "microsoft")
 }
 
-// isInContainer checks if the service is being executed in docker or lxc
-// container.
+// containerKeywords are matched against the cgroup paths of PID 1 to
+// detect that it runs inside a container.
+var containerKeywords = []string{"docker", "lxc", "containerd", "podman", "crio", "kubepods"}
+
+// containerMarkerFiles are files container runtimes create in the root
+// of the containers they start.
+var containerMarkerFiles = []string{"/.dockerenv", "/run/.containerenv"}
+
+// isInContainer checks if the service is being executed in a container,
+// such as docker, lxc, podman or a kubernetes pod.
+//
+// The cgroup path of each controller is checked first. On a cgroup v2
+// host the file is usually a single "0::/" line without any hint, so the
+// "container" environment variable and the marker files created by
+// docker and podman are consulted as well.
 func isInContainer(cgroupPath string) (bool, error) {
 	const maxlines = 5 // maximum lines to scan
 
@@ -130,8 +220,14 @@ func isInContainer(cgroupPath string) (bool, error) {
 
 	lines := 0
 	for scan.Scan() && !(lines > maxlines) {
-		if strings.Contains(scan.Text(), "docker") || strings.Contains(scan.Text(), "lxc") {
-			return true, nil
+		// Lines are "hierarchy-ID:controller-list:cgroup-path"; cgroup v2
+		// uses an ID of 0 and an empty controller list.
+		fields := strings.SplitN(scan.Text(), ":", 3)
+		path := fields[len(fields)-1]
+		for _, keyword := range containerKeywords {
+			if strings.Contains(path, keyword) {
+				return true, nil
+			}
 		}
 		lines++
 	}
@@ -139,6 +235,15 @@ func isInContainer(cgroupPath string) (bool, error) {
 		return false, err
 	}
 
+	if os.Getenv("container") != "" {
+		return true, nil
+	}
+	for _, marker := range containerMarkerFiles {
+		if _, err := os.Stat(marker); err == nil {
+			return true, nil
+		}
+	}
+
 	return false, nil
 }
 
@@ -149,4 +254,1212 @@ var tf = map[string]interface{}{
 	"cmdEscape": func(s string) string {
 		return strings.Replace(s, " ", `\x20`, -1)
 	},
+	"cmdSystemd": cmdSystemd,
+	"rawcmd": func(s string) string {
+		return s
+	},
+	"join": func(sep string, a []string) string {
+		return strings.Join(a, sep)
+	},
+	"default": func(def, v interface{}) interface{} {
+		if isEmpty(v) {
+			return def
+		}
+		return v
+	},
+}
+
+// isEmpty reports whether v is nil, false, zero, or has a length of zero.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// funcs returns the functions available to the templates: tf, with the
+// functions of the TemplateFuncs option merged over it.
+func (c *Config) funcs() map[string]interface{} {
+	var user map[string]interface{}
+	switch v := c.Option[optionTemplateFuncs].(type) {
+	case template.FuncMap:
+		user = v
+	case map[string]interface{}:
+		user = v
+	}
+	if len(user) == 0 {
+		return tf
+	}
+	funcs := make(map[string]interface{}, len(tf)+len(user))
+	for name, f := range tf {
+		funcs[name] = f
+	}
+	for name, f := range user {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// systemdArgReplacer escapes the characters systemd treats specially
+// inside a double quoted ExecStart= argument.
+var systemdArgReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\t", `\t`,
+	"$", "$$",
+)
+
+// cmdSystemd quotes s as a single ExecStart= argument following the
+// quoting rules of systemd.service(5). Backslashes, quotes and control
+// characters are escaped and "$" is doubled to prevent variable
+// expansion. Specifiers such as "%i" are left for systemd to expand.
+func cmdSystemd(s string) string {
+	return `"` + systemdArgReplacer.Replace(s) + `"`
+}
+
+// parseScript parses an init script template. The script may use the
+// shared "supervise", "cd", "startlock" and "usage" templates and the
+// functions of c.funcs.
+func (c *Config) parseScript(script string) *template.Template {
+	t := template.Must(template.New("").Funcs(c.funcs()).Parse(superviseScript))
+	t = template.Must(t.Parse(cdScript))
+	t = template.Must(t.Parse(startLockScript))
+	t = template.Must(t.Parse(usageScript))
+	t = template.Must(t.Parse(pidOwnerScript))
+	return template.Must(t.Parse(script))
+}
+
+// usageScript describes the service to operators reading its init
+// script when .Usage is set. It continues the comment line it follows.
+const usageScript = `{{define "usage"}}{{if .Usage}}
+#
+# Service:     {{.Name}}{{if ne .Description .Name}} - {{.Description}}{{end}}
+# Script:      {{.ConfigPath}}
+# Usage:       {{.ConfigPath}} {start|stop|restart|status}
+# Logs:        {{.LogDirectory}}/{{.Name}}.log (output), {{.LogDirectory}}/{{.Name}}.err (errors)
+#{{end}}{{end}}`
+
+// cdScript changes to the first of .WorkingDirectories that exists when
+// the script runs. The final cd fails if none does.
+const cdScript = `{{define "cd" -}}
+for dir in{{range .WorkingDirectories}} {{.|cmd}}{{end}}; do [ -d "$dir" ] && break; done; cd "$dir"
+{{- end}}`
+
+// limitNOFILE returns the soft and hard open file limits set by the
+// LimitNOFILE option, each a number or "infinity" as accepted by systemd.
+// Both are empty when the option is not set.
+func (c *Config) limitNOFILE() (soft, hard string, err error) {
+	v, found := c.Option[optionLimitNOFILE]
+	if !found {
+		return "", "", nil
+	}
+	limit := func(s string) (uint64, bool) {
+		if s == "infinity" {
+			return math.MaxUint64, true
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		return n, err == nil
+	}
+	switch t := v.(type) {
+	case int:
+		if t == optionLimitNOFILEDefault {
+			return "", "", nil
+		}
+		if t >= 0 {
+			return strconv.Itoa(t), strconv.Itoa(t), nil
+		}
+	case string:
+		soft, hard = t, t
+		if i := strings.IndexByte(t, ':'); i >= 0 {
+			soft, hard = t[:i], t[i+1:]
+		}
+		s, okSoft := limit(soft)
+		h, okHard := limit(hard)
+		if okSoft && okHard && s <= h {
+			return soft, hard, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid %s %v: must be a limit or \"soft:hard\", where a limit is a non-negative integer or \"infinity\" and soft is at most hard", optionLimitNOFILE, v)
+}
+
+// tasksMax returns the validated TasksMax value, or an empty string if
+// the option is not set.
+func (c *Config) tasksMax() (string, error) {
+	v, found := c.Option[optionTasksMax]
+	if !found {
+		return "", nil
+	}
+	switch t := v.(type) {
+	case int:
+		if t > 0 {
+			return strconv.Itoa(t), nil
+		}
+	case string:
+		if t == "infinity" {
+			return t, nil
+		}
+		if n, err := strconv.Atoi(t); err == nil && n > 0 {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %v: must be a positive integer or \"infinity\"", optionTasksMax, v)
+}
+
+// checkNoTasksMax returns an error if the TasksMax option sets a limit,
+// for the script backends. They start the service as root, or switch
+// users with tools that do not set limits, and ulimit -u does not limit
+// root, so only systemd applies it.
+func (c *Config) checkNoTasksMax(platform string) error {
+	tasksMax, err := c.tasksMax()
+	if err != nil || tasksMax == "" || tasksMax == "infinity" {
+		return err
+	}
+	return notSupported(optionTasksMax + " on " + platform)
+}
+
+// umask returns the UMask option as four octal digits, or an empty string
+// if the option is not set.
+func (c *Config) umask() (string, error) {
+	v, found := c.Option[optionUMask]
+	if !found {
+		return "", nil
+	}
+	if s, ok := v.(string); ok {
+		if n, err := strconv.ParseUint(s, 8, 32); err == nil && n <= 0777 {
+			return fmt.Sprintf("%04o", n), nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %v: must be an octal string from 0 to 0777", optionUMask, v)
+}
+
+// cpuListRegexp matches a list of CPUs and CPU ranges, such as "0-3,6".
+var cpuListRegexp = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+// startCondition is an entry of the ConditionPathExists or
+// ConditionFileNotEmpty options, which are named after the systemd
+// directives they render.
+type startCondition struct {
+	Directive string
+	Path      string
+	Negate    bool
+}
+
+// SystemdValue returns the directive value, escaping specifiers.
+func (sc startCondition) SystemdValue() string {
+	v := strings.Replace(sc.Path, "%", "%%", -1)
+	if sc.Negate {
+		return "!" + v
+	}
+	return v
+}
+
+// ShellUnmet returns a shell command that succeeds when the condition is
+// not met.
+func (sc startCondition) ShellUnmet() string {
+	p := shellQuote(sc.Path)
+	var met, unmet string
+	if sc.Directive == optionConditionFileNotEmpty {
+		met = "{ [ -f " + p + " ] && [ -s " + p + " ]; }"
+		unmet = "{ [ ! -f " + p + " ] || [ ! -s " + p + " ]; }"
+	} else {
+		met = "[ -e " + p + " ]"
+		unmet = "[ ! -e " + p + " ]"
+	}
+	if sc.Negate {
+		return met
+	}
+	return unmet
+}
+
+// ShellValue returns the condition as a quoted shell word for messages.
+func (sc startCondition) ShellValue() string {
+	v := sc.Directive + "=" + sc.Path
+	if sc.Negate {
+		v = sc.Directive + "=!" + sc.Path
+	}
+	return shellQuote(v)
+}
+
+// shellQuote quotes s as a single shell word that is not expanded.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// startConditions returns the validated ConditionPathExists and
+// ConditionFileNotEmpty entries, each given as a string or a []string.
+func (c *Config) startConditions() ([]startCondition, error) {
+	var conds []startCondition
+	for _, directive := range []string{optionConditionPathExists, optionConditionFileNotEmpty} {
+		var paths []string
+		switch v := c.Option[directive].(type) {
+		case nil:
+		case string:
+			paths = []string{v}
+		case []string:
+			paths = v
+		default:
+			return nil, fmt.Errorf("invalid %s %v: must be a string or []string", directive, v)
+		}
+		for _, p := range paths {
+			sc := startCondition{Directive: directive, Path: p}
+			if strings.HasPrefix(p, "!") {
+				sc.Path, sc.Negate = p[1:], true
+			}
+			if !filepath.IsAbs(sc.Path) || strings.ContainsAny(sc.Path, "\r\n") {
+				return nil, fmt.Errorf("invalid %s %q: must be an absolute path, optionally starting with \"!\"", directive, p)
+			}
+			conds = append(conds, sc)
+		}
+	}
+	return conds, nil
+}
+
+// cpuAffinity returns the validated CPUAffinity list, or an empty string
+// if the option is not set.
+func (c *Config) cpuAffinity() (string, error) {
+	v := c.Option.string(optionCPUAffinity, "")
+	if v == "" {
+		return "", nil
+	}
+	if cpuListRegexp.MatchString(v) {
+		valid := true
+		for _, r := range strings.Split(v, ",") {
+			if i := strings.Index(r, "-"); i >= 0 {
+				lo, _ := strconv.Atoi(r[:i])
+				hi, _ := strconv.Atoi(r[i+1:])
+				valid = valid && lo <= hi
+			}
+		}
+		if valid {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %q: must be a comma separated list of CPUs or ranges such as \"0-3\"", optionCPUAffinity, v)
+}
+
+// lsbFacilities maps systemd targets to the LSB facilities standing for
+// them in init script headers.
+var lsbFacilities = map[string]string{
+	"local-fs.target":       "$local_fs",
+	"network.target":        "$network",
+	"network-online.target": "$network",
+	"nss-lookup.target":     "$named",
+	"remote-fs.target":      "$remote_fs",
+	"rpcbind.target":        "$portmap",
+	"syslog.target":         "$syslog",
+	"time-sync.target":      "$time",
+}
+
+// lsbDependencies returns the boot facilities the service requires, for
+// the Required-Start and Required-Stop headers of the init scripts. They
+// come from the Requires, Wants, BindsTo and After lines of Dependencies,
+// with targets mapped to LSB facilities and the .service suffix dropped;
+// other units are left out. A single word, such as "$network", is used
+// as is.
+func (c *Config) lsbDependencies() []string {
+	var deps []string
+	seen := make(map[string]bool)
+	add := func(dep string) {
+		if dep != "" && !seen[dep] {
+			seen[dep] = true
+			deps = append(deps, dep)
+		}
+	}
+	for _, line := range c.Dependencies {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, "=")
+		if i < 0 {
+			if !strings.ContainsAny(line, " \t") {
+				add(line)
+			}
+			continue
+		}
+		switch strings.TrimSpace(line[:i]) {
+		case "Requires", "Wants", "BindsTo", "After":
+		default:
+			continue
+		}
+		for _, unit := range strings.Fields(line[i+1:]) {
+			if facility, ok := lsbFacilities[unit]; ok {
+				add(facility)
+			} else if strings.HasSuffix(unit, ".service") {
+				add(strings.TrimSuffix(unit, ".service"))
+			}
+		}
+	}
+	return deps
+}
+
+// labelKeyRegexp matches the key of a label.
+var labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]*$`)
+
+// checkLabels returns an error unless the Labels can be written to a
+// generated file and read back.
+func (c *Config) checkLabels() error {
+	for k, v := range c.Labels {
+		if !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value of label %q: must be a single line", k)
+		}
+	}
+	return nil
+}
+
+// generatedHeader returns the comment line Install starts the files it
+// writes with, which marks them as generated by this package.
+func (c *Config) generatedHeader() string {
+	version := ""
+	if c.Version != "" {
+		version = " v" + c.Version
+	}
+	return "# Generated by " + c.Name + version + " (service pkg)\n"
+}
+
+// isGeneratedHeader reports whether line is a header of generatedHeader.
+func isGeneratedHeader(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "# Generated by ") && strings.HasSuffix(line, "(service pkg)")
+}
+
+// generatedByPackage reports whether the file at path starts with the
+// header of generatedHeader, after the #! line of a script.
+func generatedByPackage(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, _ := r.ReadString('\n')
+	if strings.HasPrefix(line, "#!") {
+		line, _ = r.ReadString('\n')
+	}
+	return isGeneratedHeader(line)
+}
+
+// readInstalledConfig returns the configuration recorded in the file at
+// path that Install generated: the labels on the lines starting with
+// labelPrefix, each followed by key=value, and what parseLine recovers
+// from the other lines. It returns ErrNotInstalled if the file does not
+// exist.
+func readInstalledConfig(path, labelPrefix string, parseLine func(c *Config, line string)) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotInstalled
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, labelPrefix) {
+			parseLine(c, line)
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, labelPrefix), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[kv[0]] = kv[1]
+	}
+	return c, nil
+}
+
+// parseScriptLine recovers the executable and Arguments from the cmd
+// line of the SysV and rcS scripts. The ArgumentsRaw, which are not
+// quoted, are left out.
+func parseScriptLine(c *Config, line string) {
+	if !strings.HasPrefix(line, `cmd="`) || !strings.HasSuffix(line, `"`) || len(line) < len(`cmd=""`) {
+		return
+	}
+	cmd := line[len(`cmd="`) : len(line)-1]
+	if strings.HasPrefix(cmd, "taskset -c ") {
+		fields := strings.SplitN(cmd, " ", 4)
+		if len(fields) < 4 {
+			return
+		}
+		cmd = fields[3]
+	}
+	path := cmd
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		path, cmd = cmd[:i], cmd[i:]
+	} else {
+		cmd = ""
+	}
+	c.Executable = path
+	for cmd != "" {
+		cmd = strings.TrimLeft(cmd, " ")
+		if !strings.HasPrefix(cmd, `"`) {
+			// An unquoted word of ArgumentsRaw.
+			if i := strings.IndexByte(cmd, ' '); i >= 0 {
+				cmd = cmd[i:]
+				continue
+			}
+			break
+		}
+		var arg strings.Builder
+		i := 1
+		for ; i < len(cmd) && cmd[i] != '"'; i++ {
+			if cmd[i] == '\\' && i+1 < len(cmd) && cmd[i+1] == '"' {
+				i++
+			}
+			arg.WriteByte(cmd[i])
+		}
+		c.Arguments = append(c.Arguments, arg.String())
+		if i >= len(cmd) {
+			break
+		}
+		cmd = cmd[i+1:]
+	}
+}
+
+// scriptLabelPrefix starts the comment lines holding the Labels in the
+// init scripts.
+const scriptLabelPrefix = "# label: "
+
+// ulimitNOFILE returns the limits of limitNOFILE as accepted by ulimit.
+func (c *Config) ulimitNOFILE() (soft, hard string, err error) {
+	soft, hard, err = c.limitNOFILE()
+	unlimited := func(s string) string {
+		if s == "infinity" {
+			return "unlimited"
+		}
+		return s
+	}
+	return unlimited(soft), unlimited(hard), err
+}
+
+// createLogDirectory creates the LogDirectory the scripts write the
+// output of the service to. A directory it creates is owned by UserName,
+// if set, so the service can write to it; an existing one is left as is.
+func (c *Config) createLogDirectory() error {
+	dir := c.Option.string(optionLogDirectory, defaultLogDirectory)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create log directory: %v", err)
+	}
+	if err := chownToUser(dir, c.UserName); err != nil {
+		return fmt.Errorf("cannot chown log directory: %v", err)
+	}
+	return nil
+}
+
+// statfs reads the mount flags of a filesystem. Tests replace it.
+var statfs = syscall.Statfs
+
+// stRDONLY is the ST_RDONLY flag statfs reports for read-only mounts.
+const stRDONLY = 0x1
+
+// checkWritable returns an error wrapping ErrReadOnlyFilesystem if path
+// would be written to a read-only filesystem. The closest existing
+// directory above path is checked, as Install may create the rest.
+func checkWritable(path string) error {
+	dir := filepath.Dir(path)
+	var st syscall.Statfs_t
+	for {
+		err := statfs(dir, &st)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			// Leave other failures to the write itself.
+			return nil
+		}
+		dir = parent
+	}
+	if st.Flags&stRDONLY != 0 {
+		return fmt.Errorf("%w: cannot write %s; remount %s read-write or install a systemd user service with the UserService option", ErrReadOnlyFilesystem, path, dir)
+	}
+	return nil
+}
+
+// statExecutable stats the executable to install. Tests replace it.
+var statExecutable = os.Stat
+
+// checkExecutable returns an error unless the executable to install is an
+// executable regular file, looked up inside ChRoot when set.
+func (c *Config) checkExecutable() error {
+	path, err := c.execPath()
+	if err != nil {
+		return err
+	}
+	fi, err := statExecutable(filepath.Join(c.ChRoot, path))
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("executable %s does not exist", path)
+	case err != nil:
+		return fmt.Errorf("cannot check executable: %v", err)
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("executable %s is not a regular file", path)
+	case fi.Mode().Perm()&0111 == 0:
+		return fmt.Errorf("executable %s is not executable", path)
+	}
+	return nil
+}
+
+// checkWorkingDirectory returns an error unless WorkingDirectory is an
+// existing directory. With the CreateWorkingDirectory option, a missing
+// one is created, owned by UserName if set. With fallbacks the scripts
+// pick the directory when the service starts, so nothing is checked.
+func (c *Config) checkWorkingDirectory() error {
+	dir := c.WorkingDirectory
+	if dir == "" || c.workingDirectories() != nil {
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil
+	case err == nil:
+		return fmt.Errorf("working directory %s is not a directory", dir)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("cannot check working directory: %v", err)
+	case !c.Option.bool(optionCreateWorkingDirectory, optionCreateWorkingDirectoryDefault):
+		return fmt.Errorf("working directory %s does not exist", dir)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create working directory: %v", err)
+	}
+	if err = chownToUser(dir, c.UserName); err != nil {
+		return fmt.Errorf("cannot chown working directory: %v", err)
+	}
+	return nil
+}
+
+// chownToUser makes userName the owner of path. It does nothing if
+// userName is empty.
+func chownToUser(path, userName string) error {
+	if userName == "" {
+		return nil
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of %s", u.Uid, userName)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of %s", u.Gid, userName)
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// smokeTest runs the SmokeTest command, if set, after Install wrote the
+// service file at confPath and before the service is enabled. If the
+// command fails, confPath is removed, unless empty, and an error returned.
+func (c *Config) smokeTest(confPath string) error {
+	args := c.Option.strings(optionSmokeTest, nil)
+	if len(args) == 0 {
+		return nil
+	}
+	err := run(args[0], args[1:]...)
+	if err == nil {
+		return nil
+	}
+	if confPath != "" {
+		os.Remove(confPath)
+	}
+	return fmt.Errorf("smoke test %q failed: %w", strings.Join(args, " "), err)
+}
+
+// pidFile returns the PIDFile option, or def if it is not set. {{.Name}}
+// in the path stands for the name of the service, including its instance.
+func (c *Config) pidFile(def string) (string, error) {
+	p := c.Option.string(optionPIDFile, def)
+	if !strings.Contains(p, "{{") {
+		return p, nil
+	}
+	t, err := template.New("").Parse(p)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", optionPIDFile, p, err)
+	}
+	var b strings.Builder
+	if err = t.Execute(&b, struct{ Name string }{c.instanceName()}); err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", optionPIDFile, p, err)
+	}
+	return b.String(), nil
+}
+
+// checkPIDFileDir returns an error unless the directory of the PIDFile
+// option, if set, exists and is writable.
+func (c *Config) checkPIDFileDir() error {
+	p, err := c.pidFile("")
+	if err != nil || p == "" {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".pid")
+	if err != nil {
+		return fmt.Errorf("pid file directory is not writable: %v", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// extraLines returns the entries of the option name, written verbatim
+// into a generated file. Each entry must be a single line that does not
+// start a section.
+func (c *Config) extraLines(name string) ([]string, error) {
+	lines := c.Option.strings(name, nil)
+	for _, l := range lines {
+		if strings.ContainsAny(l, "\r\n") {
+			return nil, fmt.Errorf("invalid %s entry %q: must be a single line", name, l)
+		}
+		if strings.HasPrefix(strings.TrimSpace(l), "[") {
+			return nil, fmt.Errorf("invalid %s entry %q: must not start a section", name, l)
+		}
+	}
+	return lines, nil
+}
+
+// checkPIDOwner returns an error wrapping ErrPIDMismatch if the process
+// in the pid file, def unless PIDFile is set, is alive in procDir but
+// runs another program than the service. An upgraded executable still
+// matches.
+func (c *Config) checkPIDOwner(procDir, def string) error {
+	p, err := c.pidFile(def)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return nil
+	}
+	exe, err := os.Readlink(filepath.Join(procDir, strconv.Itoa(pid), "exe"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot check pid %d: %v", pid, err)
+	}
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
+	want, err := c.execPath()
+	if err != nil {
+		return err
+	}
+	if policy, _, _ := c.restartBackoff(); policy != "" {
+		want = "/bin/sh"
+	}
+	if resolved, err := filepath.EvalSymlinks(want); err == nil {
+		want = resolved
+	}
+	if exe != want {
+		return fmt.Errorf("%w: pid %d in %s runs %s, not %s", ErrPIDMismatch, pid, p, exe, want)
+	}
+	return nil
+}
+
+// pidOwnerScript defines owns_pid, which succeeds if the process in the
+// pid file runs the service executable, or the shell supervising it.
+const pidOwnerScript = `{{define "ownspid" -}}
+owns_pid() {
+    [ "$(readlink -f /proc/$(get_pid)/exe)" = "$(readlink -f {{if .RestartPolicy}}/bin/sh{{else}}{{.Path|cmd}}{{end}})" ]
+}
+{{- end}}`
+
+// startLockScript takes an flock on a lock file next to the pid file, so
+// only one start runs at a time. The lock is held on descriptor 9 until
+// the script exits; the service must not inherit it.
+const startLockScript = `{{define "startlock" -}}
+exec 9> "$pid_file.lock"
+        if ! flock -n 9; then
+            echo "start already in progress"
+            exit 1
+        fi
+{{- end}}`
+
+// readLogFiles returns up to the last lines lines of each log file the
+// scripts write to LogDirectory, in the order of exts. Missing files are
+// skipped.
+func (c *Config) readLogFiles(lines int, exts ...string) ([]string, error) {
+	return c.readNamedLogFiles(c.instanceName(), lines, exts...)
+}
+
+// readNamedLogFiles is readLogFiles for log files named name plus an
+// extension, where that is not the service name.
+func (c *Config) readNamedLogFiles(name string, lines int, exts ...string) ([]string, error) {
+	dir := c.Option.string(optionLogDirectory, defaultLogDirectory)
+	var logs []string
+	for _, ext := range exts {
+		tail, err := tailFile(filepath.Join(dir, name+ext), lines)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		logs = append(logs, tail...)
+	}
+	return logs, nil
+}
+
+// readLogFilesSince returns the lines of the log files of the service
+// with the given extensions logged at or after since.
+func (c *Config) readLogFilesSince(since time.Time, exts ...string) ([]string, error) {
+	return c.readNamedLogFilesSince(c.instanceName(), since, exts...)
+}
+
+// readNamedLogFilesSince is readLogFilesSince for log files named name
+// plus an extension.
+func (c *Config) readNamedLogFilesSince(name string, since time.Time, exts ...string) ([]string, error) {
+	dir := c.Option.string(optionLogDirectory, defaultLogDirectory)
+	var logs []string
+	for _, ext := range exts {
+		lines, err := linesSince(filepath.Join(dir, name+ext), since)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		logs = append(logs, lines...)
+	}
+	return logs, nil
+}
+
+// logTimestampLayouts are the timestamps recognised at the start of a log
+// line: RFC 3339 and the default of the standard log package. Layouts
+// without a zone are read in local time.
+var logTimestampLayouts = []string{time.RFC3339Nano, "2006/01/02 15:04:05", "2006-01-02 15:04:05"}
+
+// logLineTime returns the timestamp leading line, if any.
+func logLineTime(line string) (time.Time, bool) {
+	fields := strings.SplitN(line, " ", 3)
+	for _, layout := range logTimestampLayouts {
+		n := strings.Count(layout, " ") + 1
+		if len(fields) < n {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, strings.Join(fields[:n], " "), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// linesSince returns the lines of the file at path timestamped at or after
+// since. A line without a timestamp is kept if the line before it was;
+// lines before the first timestamp are kept as their age is unknown.
+func linesSince(path string, since time.Time) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	keep := true
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t, ok := logLineTime(line); ok {
+			keep = !t.Before(since)
+		}
+		if keep {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// tailFile returns up to the last n lines of the file at path.
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ring := make([]string, n)
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ring[count%n] = scanner.Text()
+		count++
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if count < n {
+		return ring[:count], nil
+	}
+	return append(ring[count%n:], ring[:count%n]...), nil
+}
+
+// restartBackoff returns the restart policy of the init script
+// supervisor, "on-failure" or "always", and the cap on the restart delay
+// in seconds. The policy is "" when the script does not supervise the
+// service.
+func (c *Config) restartBackoff() (string, int, error) {
+	policy := c.restartPolicy("no")
+	if policy != "on-failure" && policy != "always" {
+		return "", 0, nil
+	}
+	max := c.Option.duration(optionRestartMaxSec, optionRestartMaxSecDefault)
+	if max < time.Second {
+		return "", 0, fmt.Errorf("invalid %s %v: must be at least one second", optionRestartMaxSec, c.Option[optionRestartMaxSec])
+	}
+	return policy, int(max / time.Second), nil
+}
+
+// killTimeout returns how long stopping the service waits for it to exit
+// after SIGTERM and whether it is then killed with SIGKILL, following the
+// KillTimeout and ForceKill options.
+func (c *Config) killTimeout() (time.Duration, bool, error) {
+	d := c.Option.duration(optionKillTimeout, optionKillTimeoutDefault)
+	if d < time.Second {
+		return 0, false, fmt.Errorf("invalid %s %v: must be at least one second", optionKillTimeout, c.Option[optionKillTimeout])
+	}
+	return d, c.Option.bool(optionForceKill, optionForceKillDefault), nil
+}
+
+// scriptSeconds rounds d up to whole seconds for the shell scripts.
+func scriptSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// superviseScript defines a shell function that runs $cmd and restarts
+// it after a non-zero exit, or after any exit with the "always" policy.
+// The delay between restarts doubles from one
+// second up to RestartMaxSec, and resets once the service stayed up that
+// long. TERM stops the service and ends the loop, so the pid file can
+// hold the pid of the loop.
+const superviseScript = `{{define "supervise" -}}
+supervise() {
+    delay=1
+    child=
+    restarts=0
+    echo "$restarts" > "$pid_file.restarts"
+    stopping=
+    trap 'stopping=1; [ -n "$child" ] && kill $child 2> /dev/null' TERM INT
+    while [ -z "$stopping" ]; do
+        started=$(date +%s)
+        $cmd &
+        child=$!
+        wait $child
+        status=$?
+        if [ -n "$stopping" ]; then
+            wait $child
+            break
+        fi
+        {{- if ne .RestartPolicy "always"}}
+        [ $status -eq 0 ] && break
+        {{- end}}
+        if [ $(($(date +%s) - started)) -ge {{.RestartMaxSec}} ]; then
+            delay=1
+        fi
+        echo "$name exited with status $status, restarting in ${delay}s" >&2
+        restarts=$((restarts + 1))
+        echo "$restarts $(date +%s)" > "$pid_file.restarts"
+        sleep $delay &
+        child=$!
+        wait $child
+        delay=$((delay * 2))
+        if [ $delay -gt {{.RestartMaxSec}} ]; then
+            delay={{.RestartMaxSec}}
+        fi
+    done
+    rm -f "$pid_file"
+}
+{{- end}}`
+
+// restartHistory returns the restart count and time the supervise loop
+// writes to the restarts file next to the pid file, def unless PIDFile is
+// set. A service never started has no restarts.
+func (c *Config) restartHistory(def string) (int, time.Time, error) {
+	if policy, _, err := c.restartBackoff(); err != nil || policy == "" {
+		if err == nil {
+			err = notSupported("RestartHistory without a restart policy")
+		}
+		return 0, time.Time{}, err
+	}
+	p, err := c.pidFile(def)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	b, err := ioutil.ReadFile(p + ".restarts")
+	if os.IsNotExist(err) {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, time.Time{}, nil
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid restarts file %s: %v", p+".restarts", err)
+	}
+	var last time.Time
+	if len(fields) > 1 {
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid restarts file %s: %v", p+".restarts", err)
+		}
+		last = time.Unix(sec, 0)
+	}
+	return count, last, nil
+}
+
+// cronWatchdogEntry returns the crontab line that starts the service with
+// its init script every minute. Starting a running service does nothing.
+func cronWatchdogEntry(script string) string {
+	return "*/1 * * * * " + script + " start > /dev/null 2>&1"
+}
+
+// installCronWatchdog adds the watchdog entry of script to the crontab of
+// the current user, unless it is there already.
+func installCronWatchdog(script string) error {
+	entry := cronWatchdogEntry(script)
+	return updateCrontab(func(lines []string) []string {
+		for _, line := range lines {
+			if line == entry {
+				return lines
+			}
+		}
+		return append(lines, entry)
+	})
+}
+
+// removeCronWatchdog removes the watchdog entry of script from the
+// crontab of the current user.
+func removeCronWatchdog(script string) error {
+	entry := cronWatchdogEntry(script)
+	return updateCrontab(func(lines []string) []string {
+		kept := lines[:0]
+		for _, line := range lines {
+			if line != entry {
+				kept = append(kept, line)
+			}
+		}
+		return kept
+	})
+}
+
+// updateCrontab replaces the crontab of the current user with the lines
+// returned by edit. A missing crontab is treated as empty.
+func updateCrontab(edit func(lines []string) []string) error {
+	exitStatus, out, stderr, err := runWithOutputAll("crontab", "-l")
+	if err != nil {
+		if exitStatus == 0 || !strings.Contains(stderr, "no crontab") {
+			return err
+		}
+		out = ""
+	}
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	lines = edit(lines)
+
+	f, err := ioutil.TempFile("", "crontab")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return run("crontab", f.Name())
+}
+
+// startLinkPrefix prefixes the start links the script backends install.
+const startLinkPrefix = "S50"
+
+// listStartLinks returns the names of the services with a start link in
+// dir, which need not exist.
+func listStartLinks(dir string) ([]string, error) {
+	names := []string{}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, startLinkPrefix) && len(name) > len(startLinkPrefix) {
+			names = append(names, strings.TrimPrefix(name, startLinkPrefix))
+		}
+	}
+	return names, nil
+}
+
+// writeDownFile creates the down file of the runit or s6 service directory
+// dir, which keeps the supervisor from starting the service until it is
+// started by hand, when the service should not start at boot. Otherwise it
+// removes a down file left by an earlier install.
+func (c *Config) writeDownFile(rb *installRollback, dir string) error {
+	path := filepath.Join(dir, "down")
+	if !c.startAtBoot() {
+		return rb.writeFile(path, 0644, func(io.Writer) error { return nil })
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	return rb.step(func(context.Context) error {
+		return os.Remove(path)
+	}, func() {
+		ioutil.WriteFile(path, nil, 0644)
+	})
+}
+
+// installRollback records how to undo the changes an Install made, for
+// guardInstall.
+type installRollback struct {
+	ctx  context.Context
+	undo []func()
+}
+
+// step runs do unless Install was interrupted and, once it succeeded,
+// records undo, if not nil, to revert its change.
+func (rb *installRollback) step(do func(ctx context.Context) error, undo func()) error {
+	if err := rb.ctx.Err(); err != nil {
+		return err
+	}
+	if err := do(rb.ctx); err != nil {
+		return err
+	}
+	if undo != nil {
+		rb.undo = append(rb.undo, undo)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory dir and its parents. Rolling back
+// removes dir if it did not exist.
+func (rb *installRollback) mkdirAll(dir string, perm os.FileMode) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	return rb.step(func(context.Context) error {
+		return os.MkdirAll(dir, perm)
+	}, func() {
+		os.RemoveAll(dir)
+	})
+}
+
+// writeFile writes the file at path with write and sets its permissions.
+// Rolling back restores its previous content, or removes it.
+func (rb *installRollback) writeFile(path string, perm os.FileMode, write func(io.Writer) error) error {
+	if err := rb.ctx.Err(); err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+	rb.undo = append(rb.undo, func() {
+		if existed {
+			ioutil.WriteFile(path, old, perm)
+		} else {
+			os.Remove(path)
+		}
+	})
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// guardInstall runs install and, if it fails, undoes the changes it
+// recorded, newest first. An interrupt or termination signal received
+// meanwhile kills the command being run and fails the install the same
+// way, returning an error wrapping ErrInterrupted instead of exiting the
+// process half way.
+func guardInstall(install func(rb *installRollback) error) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigs:
+			interrupted <- sig
+			cancel()
+		case <-done:
+		}
+	}()
+
+	rb := &installRollback{ctx: ctx}
+	err := install(rb)
+	if err == nil {
+		return nil
+	}
+	for i := len(rb.undo) - 1; i >= 0; i-- {
+		rb.undo[i]()
+	}
+	select {
+	case sig := <-interrupted:
+		return fmt.Errorf("install %w by %v, changes rolled back", ErrInterrupted, sig)
+	default:
+		return err
+	}
+}
+
+// guardUninstall runs uninstall to the end even if an interrupt or
+// termination signal arrives meanwhile, so the service is not left half
+// removed, and then returns an error wrapping ErrInterrupted.
+func guardUninstall(uninstall func() error) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	err := uninstall()
+	select {
+	case sig := <-sigs:
+		return joinErrors(err, fmt.Errorf("uninstall %w by %v, completed first", ErrInterrupted, sig))
+	default:
+		return err
+	}
 }
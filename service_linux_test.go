@@ -5,10 +5,22 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"text/template"
+	"time"
 )
 
 // createTestCgroupFiles creates mock files for tests
@@ -36,6 +48,34 @@ func createTestCgroupFiles() (*os.File, *os.File, error) {
 	return hDockerGrp, hLinuxGrp, nil
 }
 
+// noContainerMarkers hides the container marker files and environment of
+// the host running the tests. It returns a function restoring them.
+func noContainerMarkers() func() {
+	origMarkers := containerMarkerFiles
+	origEnv, hasEnv := os.LookupEnv("container")
+	containerMarkerFiles = nil
+	os.Unsetenv("container")
+	return func() {
+		containerMarkerFiles = origMarkers
+		if hasEnv {
+			os.Setenv("container", origEnv)
+		}
+	}
+}
+
+// writeTestFile writes content to a new temporary file.
+func writeTestFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
 // removeTestFile closes and removes the provided file
 func removeTestFile(hFile *os.File) {
 	hFile.Close()
@@ -45,6 +85,7 @@ func removeTestFile(hFile *os.File) {
 func Test_isInContainer(t *testing.T) {
 
 	// setup
+	defer noContainerMarkers()()
 	hDockerGrp, hLinuxGrp, err := createTestCgroupFiles()
 	if err != nil {
 		t.Fatal(err)
@@ -82,6 +123,89 @@ func Test_isInContainer(t *testing.T) {
 	}
 }
 
+func Test_isInContainerCgroupV2(t *testing.T) {
+	defer noContainerMarkers()()
+
+	v2Docker := writeTestFile(t, "0::/system.slice/docker-bc9f0894926991e3064b731c26d86af6.scope\n")
+	defer os.Remove(v2Docker)
+	v2Root := writeTestFile(t, "0::/\n")
+	defer os.Remove(v2Root)
+	kubepods := writeTestFile(t, "12:pids:/kubepods/besteffort/pod6f7b7a3c/0f1e2d3c4b5a\n0::/\n")
+	defer os.Remove(kubepods)
+	marker := writeTestFile(t, "")
+	defer os.Remove(marker)
+
+	tests := []struct {
+		name    string
+		cgroup  string
+		markers []string
+		env     string
+		want    bool
+	}{
+		{"v2-docker-scope", v2Docker, nil, "", true},
+		{"v2-root", v2Root, nil, "", false},
+		{"kubepods", kubepods, nil, "", true},
+		{"v2-root-marker-file", v2Root, []string{"/nonexistent", marker}, "", true},
+		{"v2-root-container-env", v2Root, nil, "podman", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containerMarkerFiles = tt.markers
+			if tt.env != "" {
+				os.Setenv("container", tt.env)
+				defer os.Unsetenv("container")
+			}
+			got, err := isInContainer(tt.cgroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("isInContainer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isWSL(t *testing.T) {
+	wsl := writeTestFile(t, "Linux version 5.15.90.1-microsoft-standard-WSL2 (oe-user@oe-host) (gcc 11.2.0) #1 SMP\n")
+	defer os.Remove(wsl)
+	wsl1 := writeTestFile(t, "Linux version 4.4.0-19041-Microsoft (Microsoft@Microsoft.com) (gcc version 5.4.0) #1237\n")
+	defer os.Remove(wsl1)
+	native := writeTestFile(t, "Linux version 6.1.0-18-amd64 (debian-kernel@lists.debian.org) (gcc-12 12.2.0) #1 SMP\n")
+	defer os.Remove(native)
+
+	orig := procVersionFile
+	defer func() { procVersionFile = orig }()
+
+	tests := []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"wsl2", wsl, true},
+		{"wsl1", wsl1, true},
+		{"native", native, false},
+		{"missing", "/nonexistent/version", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procVersionFile = tt.file
+			if got := isWSL(); got != tt.want {
+				t.Errorf("isWSL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Under WSL the process is interactive even if the cgroup file is
+	// unreadable.
+	origCgroup := cgroupFile
+	defer func() { cgroupFile = origCgroup }()
+	procVersionFile, cgroupFile = wsl, "/nonexistent/cgroup"
+	if got, err := isInteractive(); err != nil || !got {
+		t.Errorf("isInteractive() under WSL = %v, %v, want true", got, err)
+	}
+}
+
 func Test_isInteractive(t *testing.T) {
 
 	// setup
@@ -143,6 +267,1772 @@ func Test_isInteractive(t *testing.T) {
 	}
 }
 
+// scriptWriters returns the shell based Linux backends for c.
+func scriptWriters(c *Config) map[string]interface{ writeScript(io.Writer) error } {
+	if c.Executable == "" {
+		c.Executable = "/usr/bin/app"
+	}
+	return map[string]interface{ writeScript(io.Writer) error }{
+		"sysv":   &sysv{Config: c},
+		"rcs":    &rcs{Config: c},
+		"openrc": &openrc{Config: c},
+		"runit":  &runit{Config: c},
+		"s6":     &s6{Config: c},
+	}
+}
+
+func Test_scriptEnvironment(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    []string
+		notWant []string
+	}{
+		{"default", KeyValue{}, nil, []string{"export PATH=", "export LANG="}},
+		{"path-and-locale",
+			KeyValue{optionScriptPath: "/usr/local/bin:/usr/bin:/bin", optionScriptLocale: "en_US.UTF-8"},
+			[]string{"\nexport PATH=\"/usr/local/bin:/usr/bin:/bin\"\n", "\nexport LANG=\"en_US.UTF-8\"\n"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		for backend, w := range scriptWriters(&Config{Name: "app", Option: tt.options}) {
+			t.Run(tt.name+"/"+backend, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := w.writeScript(&buf); err != nil {
+					t.Fatal(err)
+				}
+				script := buf.String()
+				for _, want := range tt.want {
+					if !strings.Contains(script, want) {
+						t.Errorf("script missing %q:\n%s", want, script)
+					}
+				}
+				for _, notWant := range tt.notWant {
+					if strings.Contains(script, notWant) {
+						t.Errorf("script unexpectedly contains %q:\n%s", notWant, script)
+					}
+				}
+			})
+		}
+	}
+}
+
+func Test_scriptRestartHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restarts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "app.pid")
+	c := &Config{Name: "app", Option: KeyValue{optionRestart: "on-failure", optionPIDFile: pidFile}}
+	s := &rcs{Config: c}
+	if n, last, err := RestartHistory(s); err != nil || n != 0 || !last.IsZero() {
+		t.Errorf("RestartHistory() before start = %d, %v, %v, want 0, zero time", n, last, err)
+	}
+
+	// Run the supervise loop of the scripts on a command that always
+	// fails, until it has restarted it once.
+	var buf bytes.Buffer
+	buf.WriteString("name=app\npid_file=" + pidFile + "\ncmd=false\n")
+	if err := c.parseScript("").ExecuteTemplate(&buf, "supervise", struct {
+		RestartPolicy string
+		RestartMaxSec int
+	}{"on-failure", 60}); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("\nsupervise 2> /dev/null\n")
+	cmd := exec.Command("sh", "-c", buf.String())
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	var n int
+	var last time.Time
+	for deadline := time.Now().Add(5 * time.Second); n == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if n, last, err = RestartHistory(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	if n != 1 || last.Before(begin.Truncate(time.Second)) {
+		t.Errorf("RestartHistory() after a restart = %d, %v, want 1 after %v", n, last, begin)
+	}
+
+	c.Option = KeyValue{optionPIDFile: pidFile}
+	if _, _, err := RestartHistory(s); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("RestartHistory() without a restart policy error = %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func Test_rcsForceKill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forcekill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The service ignores SIGTERM, so only SIGKILL stops it.
+	app := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(app, []byte("#!/bin/sh\ntrap '' TERM\nwhile :; do sleep 1; done\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "app.pid")
+	script := filepath.Join(dir, "app.rc")
+
+	for _, tt := range []struct {
+		options  KeyValue
+		wantStop bool
+	}{
+		{KeyValue{}, false},
+		{KeyValue{optionForceKill: true}, true},
+		{KeyValue{optionForceKill: true, optionRestart: "always"}, true},
+	} {
+		tt.options[optionKillTimeout] = time.Second
+		tt.options[optionPIDFile] = pidFile
+		tt.options[optionLogDirectory] = dir
+		s := &rcs{Config: &Config{Name: "app", Executable: app, Option: tt.options}}
+		var buf bytes.Buffer
+		if err := s.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(script, buf.Bytes(), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command("sh", script, "start").CombinedOutput(); err != nil {
+			t.Fatalf("start: %v\n%s", err, out)
+		}
+		pid, ok := s.runningPID()
+		if !ok {
+			t.Fatal("service did not start")
+		}
+		out, err := exec.Command("sh", script, "stop").CombinedOutput()
+		if stopped := err == nil; stopped != tt.wantStop {
+			t.Errorf("%v: stop error = %v, want stopped %v\n%s", tt.options, err, tt.wantStop, out)
+		}
+		if !tt.wantStop {
+			syscall.Kill(pid, syscall.SIGKILL)
+			os.Remove(pidFile)
+		}
+	}
+
+	if err := (&rcs{Config: &Config{Name: "app", Option: KeyValue{optionKillTimeout: time.Duration(0)}}}).writeScript(ioutil.Discard); err == nil {
+		t.Error("writeScript() with a zero KillTimeout succeeded")
+	}
+}
+
+func Test_rcsStartSupervised(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(init string, timeout time.Duration) {
+		rcsInitDir, commandTimeout = init, timeout
+	}(rcsInitDir, commandTimeout)
+	rcsInitDir = filepath.Join(dir, "init.d")
+	if err := os.Mkdir(rcsInitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	commandTimeout = 10 * time.Second
+	app := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(app, []byte("#!/bin/sh\nwhile :; do sleep 1; done\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &rcs{Config: &Config{Name: "app", Executable: app, Option: KeyValue{
+		optionRestart:      "always",
+		optionPIDFile:      filepath.Join(dir, "app.pid"),
+		optionLogDirectory: dir,
+	}}}
+	var buf bytes.Buffer
+	if err := s.writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rcsInitDir, s.instanceName()), buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The supervise loop keeps running after the script exits, which
+	// must not hold up Start until the command times out.
+	start := time.Now()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Start() returned after %v", elapsed)
+	}
+	if _, ok := s.runningPID(); !ok {
+		t.Fatal("service did not start")
+	}
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+}
+
+func Test_scriptConditions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "it's.conf")
+	pidFile := filepath.Join(dir, "app.pid")
+	script := filepath.Join(dir, "app.rc")
+
+	for _, tt := range []struct {
+		options  KeyValue
+		contents string
+		wantSkip bool
+	}{
+		{KeyValue{optionConditionPathExists: conf}, "", true},
+		{KeyValue{optionConditionPathExists: "!" + conf}, "x", true},
+		{KeyValue{optionConditionFileNotEmpty: conf}, "", true},
+		{KeyValue{optionConditionFileNotEmpty: conf}, "x", false},
+		{KeyValue{optionConditionPathExists: []string{conf, "!" + filepath.Join(dir, "missing")}}, "", false},
+	} {
+		os.Remove(conf)
+		if tt.contents != "" || !tt.wantSkip {
+			if err := ioutil.WriteFile(conf, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tt.options[optionPIDFile] = pidFile
+		tt.options[optionLogDirectory] = dir
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: &Config{Name: "app", Executable: "/bin/true", Option: tt.options}},
+			"rcs":  &rcs{Config: &Config{Name: "app", Executable: "/bin/true", Option: tt.options}},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(script, buf.Bytes(), 0755); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command("sh", script, "start").CombinedOutput()
+			if skipped := strings.Contains(string(out), "Not starting "); err != nil && skipped || skipped != tt.wantSkip {
+				t.Errorf("%s start with %v, %q = %v\n%s", backend, tt.options, tt.contents, err, out)
+			}
+			os.Remove(pidFile)
+		}
+	}
+}
+
+func Test_scriptTasksMax(t *testing.T) {
+	// The scripts start the service as root, which ulimit -u does not
+	// limit, so only "infinity" is accepted, on every script backend.
+	for _, value := range []interface{}{512, "512"} {
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionTasksMax: value}}
+		for backend, w := range scriptWriters(c) {
+			if err := w.writeScript(ioutil.Discard); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("%s writeScript() with %s %v = %v, want ErrNotSupported", backend, optionTasksMax, value, err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionTasksMax: "infinity"}}
+	if err := (&rcs{Config: c}).writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "ulimit -u") {
+		t.Errorf("script with %s infinity sets a limit:\n%s", optionTasksMax, buf.String())
+	}
+
+	c.Option[optionTasksMax] = 0
+	if err := (&sysv{Config: c}).writeScript(ioutil.Discard); err == nil || errors.Is(err, ErrNotSupported) {
+		t.Errorf("writeScript() with %s 0 = %v, want invalid value", optionTasksMax, err)
+	}
+}
+
+func Test_scriptUMask(t *testing.T) {
+	c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionUMask: "077"}}
+	for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+		"sysv":    &sysv{Config: c},
+		"rcs":     &rcs{Config: c},
+		"runit":   &runit{Config: c},
+		"s6":      &s6{Config: c},
+		"upstart": &upstart{Config: c},
+		"openrc":  &openrc{Config: c},
+	} {
+		want := "umask 0077\n"
+		if backend == "openrc" {
+			want = " --umask 0077\""
+		}
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s script with %s 077 missing %q:\n%s", backend, optionUMask, want, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	c.Option = KeyValue{}
+	if err := (&rcs{Config: c}).writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "umask") {
+		t.Errorf("script without %s sets it:\n%s", optionUMask, buf.String())
+	}
+
+	for _, value := range []interface{}{"", "8", "0o77", "1000", 077} {
+		c.Option = KeyValue{optionUMask: value}
+		if err := (&sysv{Config: c}).writeScript(ioutil.Discard); err == nil {
+			t.Errorf("writeScript() with %s %#v succeeded", optionUMask, value)
+		}
+	}
+}
+
+func Test_scriptRestartOnFailure(t *testing.T) {
+	writers := func(options KeyValue) map[string]interface{ writeScript(io.Writer) error } {
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: options}
+		return map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: c},
+			"rcs":  &rcs{Config: c},
+		}
+	}
+
+	for backend, w := range writers(KeyValue{optionRestart: "on-failure", optionRestartMaxSec: "30s"}) {
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		script := buf.String()
+		for _, want := range []string{
+			"\nsupervise() {\n",
+			"trap 'stopping=1;",
+			"delay=$((delay * 2))",
+			"if [ $delay -gt 30 ]; then\n            delay=30\n",
+			"rm -f \"$pid_file\"\n}",
+			"(supervise) >> \"$stdout_log\" 2>> \"$stderr_log\" < /dev/null &\n            echo $! > \"$pid_file\"",
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s script missing %q:\n%s", backend, want, script)
+			}
+		}
+	}
+
+	for backend, w := range writers(KeyValue{}) {
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "supervise") {
+			t.Errorf("%s script supervises without Restart=on-failure:\n%s", backend, buf.String())
+		}
+	}
+
+	for backend, w := range writers(KeyValue{optionRestart: "on-failure", optionRestartMaxSec: "500ms"}) {
+		if err := w.writeScript(ioutil.Discard); err == nil {
+			t.Errorf("%s writeScript() with a sub-second RestartMaxSec = nil, want an error", backend)
+		}
+	}
+}
+
+func Test_scriptLimitNOFILE(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"unset", nil, ""},
+		{"single", 4096, "ulimit -Hn 4096 && ulimit -Sn 4096 || exit 1\n"},
+		{"split", "1024:infinity", "ulimit -Hn unlimited && ulimit -Sn 1024 || exit 1\n"},
+	}
+	for _, tt := range tests {
+		opts := KeyValue{}
+		if tt.value != nil {
+			opts[optionLimitNOFILE] = tt.value
+		}
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: opts}
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: c},
+			"rcs":  &rcs{Config: c},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatalf("%s/%s: %v", tt.name, backend, err)
+			}
+			script := buf.String()
+			if tt.want == "" && strings.Contains(script, "ulimit") {
+				t.Errorf("%s/%s: script unexpectedly contains ulimit:\n%s", tt.name, backend, script)
+			}
+			if tt.want != "" && !strings.Contains(script, tt.want) {
+				t.Errorf("%s/%s: script missing %q:\n%s", tt.name, backend, tt.want, script)
+			}
+		}
+	}
+}
+
+func Test_scriptArgumentsRaw(t *testing.T) {
+	c := &Config{
+		Name:       "app",
+		Executable: "/usr/bin/app",
+		Arguments:  []string{"-dir", "/var/lib/my app"},
+		Option:     KeyValue{optionArgumentsRaw: []string{"/var/spool/app/*.job", "$HOME"}},
+	}
+	for backend, tt := range map[string]struct {
+		w    interface{ writeScript(io.Writer) error }
+		want string
+	}{
+		"sysv":    {&sysv{Config: c}, `cmd="/usr/bin/app "-dir" "/var/lib/my app" /var/spool/app/*.job $HOME"`},
+		"rcs":     {&rcs{Config: c}, `cmd="/usr/bin/app "-dir" "/var/lib/my app" /var/spool/app/*.job $HOME"`},
+		"runit":   {&runit{Config: c}, `/usr/bin/app "-dir" "/var/lib/my app" /var/spool/app/*.job $HOME >>`},
+		"s6":      {&s6{Config: c}, `/usr/bin/app "-dir" "/var/lib/my app" /var/spool/app/*.job $HOME >>`},
+		"upstart": {&upstart{Config: c}, `/usr/bin/app "-dir" "/var/lib/my app" /var/spool/app/*.job $HOME` + "\n"},
+	} {
+		var buf bytes.Buffer
+		if err := tt.w.writeScript(&buf); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("%s: script missing %q:\n%s", backend, tt.want, buf.String())
+		}
+	}
+}
+
+func Test_descriptionFallback(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *Config
+		want string
+	}{
+		{"description", &Config{Name: "app", DisplayName: "App", Description: "The app service"}, "The app service"},
+		{"display name", &Config{Name: "app", DisplayName: "App"}, "App"},
+		{"name", &Config{Name: "app"}, "app"},
+	}
+	for _, tt := range tests {
+		tt.c.Executable = "/usr/bin/app"
+		unit, err := renderUnit(tt.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "Description=" + tt.want + "\n"; !strings.Contains(unit, want) {
+			t.Errorf("%s: unit missing %q:\n%s", tt.name, want, unit)
+		}
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv":    &sysv{Config: tt.c},
+			"rcs":     &rcs{Config: tt.c},
+			"openrc":  &openrc{Config: tt.c},
+			"upstart": &upstart{Config: tt.c},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatalf("%s/%s: %v", tt.name, backend, err)
+			}
+			want := map[string]string{
+				"sysv":    "# description: " + tt.want + "\n",
+				"rcs":     "# Description:       " + tt.want + "\n",
+				"openrc":  `description="` + tt.want + `"`,
+				"upstart": "# " + tt.want + "\n",
+			}[backend]
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("%s/%s: script missing %q:\n%s", tt.name, backend, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestCapabilitiesOf(t *testing.T) {
+	c := &Config{Name: "app"}
+	for _, tt := range []struct {
+		s    Service
+		want Capabilities
+	}{
+		{&systemd{Config: c}, Capabilities{
+			UserService: true, RestartPolicy: true, ResourceLimits: true, TasksMax: true,
+			StatusDetails: true, InstallScript: true, ReadLogs: true, LogsFiltered: true,
+			RestartHistory: true, LoadInstalledConfig: true, IsEnabled: true, Diff: true, CgroupPath: true,
+		}},
+		{&rcs{Config: c}, Capabilities{
+			RestartPolicy: true, ResourceLimits: true,
+			StatusDetails: true, InstallScript: true, ReadLogs: true,
+			RestartHistory: true, LoadInstalledConfig: true, IsEnabled: true,
+		}},
+		{&runit{Config: c}, Capabilities{InstallScript: true, ReadLogs: true, IsEnabled: true}},
+		{&stubService{name: "app"}, Capabilities{}},
+	} {
+		if got := CapabilitiesOf(tt.s); got != tt.want {
+			t.Errorf("CapabilitiesOf(%s) = %+v, want %+v", tt.s.Platform(), got, tt.want)
+		}
+	}
+}
+
+func Test_scriptLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origInit := rcsInitDir
+	defer func() { rcsInitDir = origInit }()
+	rcsInitDir = dir
+
+	labels := map[string]string{"owner": "team-a", "version": "1.2"}
+	args := []string{"-c", `say "hi" there`, ""}
+	s := &rcs{Config: &Config{Name: "app", Executable: "/usr/bin/app", Arguments: args, Labels: labels}}
+	if _, err := LoadInstalledConfig(s); err != ErrNotInstalled {
+		t.Fatalf("LoadInstalledConfig() before writing error = %v, want ErrNotInstalled", err)
+	}
+	var buf bytes.Buffer
+	if err := s.writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "(service pkg)\n# label: owner=team-a\n# label: version=1.2\n") {
+		t.Errorf("script missing labels:\n%s", buf.String())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app"), buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadInstalledConfig(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Labels, labels) {
+		t.Errorf("LoadInstalledConfig() labels = %v, want %v", c.Labels, labels)
+	}
+	if c.Executable != "/usr/bin/app" || !reflect.DeepEqual(c.Arguments, args) {
+		t.Errorf("LoadInstalledConfig() command = %q %q, want /usr/bin/app %q", c.Executable, c.Arguments, args)
+	}
+}
+
+func Test_scriptLSBHeader(t *testing.T) {
+	c := &Config{
+		Name:        "app",
+		DisplayName: "App",
+		Description: "The app service",
+		Executable:  "/usr/bin/app",
+		Dependencies: []string{
+			"Requires=network-online.target postgresql.service",
+			"After=network.target syslog.target redis.service",
+			"Before=nginx.service",
+			"$remote_fs",
+			"need net",
+		},
+	}
+	want := `### BEGIN INIT INFO
+# Provides:          app
+# Required-Start:    $network postgresql $syslog redis $remote_fs
+# Required-Stop:     $network postgresql $syslog redis $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: App
+# Description:       The app service
+### END INIT INFO
+`
+	for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+		"sysv": &sysv{Config: c},
+		"rcs":  &rcs{Config: c},
+	} {
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: script missing LSB header %q:\n%s", backend, want, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&sysv{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}).writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "# Required-Start:\n# Required-Stop:\n") {
+		t.Errorf("script without dependencies has unexpected Required headers:\n%s", buf.String())
+	}
+}
+
+func Test_scriptIncludeUsage(t *testing.T) {
+	c := &Config{
+		Name:        "app",
+		Description: "The app service",
+		Executable:  "/usr/bin/app",
+		Option:      KeyValue{optionIncludeUsage: true, optionLogDirectory: "/var/log/app"},
+	}
+	for backend, tt := range map[string]struct {
+		w      interface{ writeScript(io.Writer) error }
+		script string
+	}{
+		"sysv": {&sysv{Config: c}, "/etc/init.d/app"},
+		"rcs":  {&rcs{Config: c}, filepath.Join(rcsInitDir, "app")},
+	} {
+		var buf bytes.Buffer
+		if err := tt.w.writeScript(&buf); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		want := `# Generated by app (service pkg)
+#
+# Service:     app - The app service
+# Script:      ` + tt.script + `
+# Usage:       ` + tt.script + ` {start|stop|restart|status}
+# Logs:        /var/log/app/app.log (output), /var/log/app/app.err (errors)
+#
+# For RedHat and cousins:
+`
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: script missing usage block %q:\n%s", backend, want, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&sysv{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}).writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "(service pkg)\n# For RedHat and cousins:") {
+		t.Errorf("script without IncludeUsage has a usage block:\n%s", buf.String())
+	}
+}
+
+func Test_scriptCPUAffinity(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"", `cmd="/usr/bin/app"`},
+		{"0-3,6", `cmd="taskset -c 0-3,6 /usr/bin/app"`},
+	} {
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionCPUAffinity: tt.value}}
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: c},
+			"rcs":  &rcs{Config: c},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+			if !strings.Contains(buf.String(), tt.want+"\n") {
+				t.Errorf("%s: script missing %q:\n%s", backend, tt.want, buf.String())
+			}
+		}
+	}
+
+	c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionCPUAffinity: "0-"}}
+	if err := (&sysv{Config: c}).writeScript(ioutil.Discard); err == nil {
+		t.Error("writeScript() with an invalid CPUAffinity succeeded")
+	}
+}
+
+func Test_sysvKillPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rc0.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, link := range []string{"K01db", "K05web", "S20db", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, link), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    int
+		wantErr bool
+	}{
+		{"default", nil, 2, false},
+		{"stop-before", KeyValue{optionStopBefore: []string{"db.service"}}, 0, false},
+		{"stop-after", KeyValue{optionStopAfter: []string{"web"}}, 6, false},
+		{"unknown", KeyValue{optionStopAfter: []string{"other"}}, 2, false},
+		{"between", KeyValue{optionStopAfter: []string{"db"}, optionStopBefore: []string{"web"}}, 2, false},
+		{"conflict", KeyValue{optionStopAfter: []string{"web"}, optionStopBefore: []string{"db"}}, 0, true},
+	}
+	for _, tt := range tests {
+		s := &sysv{Config: &Config{Name: "app", Option: tt.options}}
+		got, err := s.killPriority(dir)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: killPriority() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: killPriority() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_rcsStatusPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(init, proc string) {
+		rcsInitDir, rcsProcDir = init, proc
+	}(rcsInitDir, rcsProcDir)
+	rcsInitDir = filepath.Join(dir, "init.d")
+	rcsProcDir = filepath.Join(dir, "proc")
+	runDir := filepath.Join(dir, "run")
+	for _, d := range []string{rcsInitDir, runDir, filepath.Join(rcsProcDir, "42")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &rcs{Config: &Config{Name: "app", Option: KeyValue{
+		optionPIDFile: filepath.Join(runDir, "{{.Name}}.pid"),
+	}}}
+	if _, err := s.Status(); err != ErrNotInstalled {
+		t.Fatalf("Status() before install error = %v, want %v", err, ErrNotInstalled)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rcsInitDir, "app"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pidFile := filepath.Join(runDir, "app.pid")
+	tests := []struct {
+		name    string
+		pid     string
+		want    Status
+		wantPID int
+	}{
+		{"no-pid-file", "", StatusStopped, 0},
+		{"running", "42\n", StatusRunning, 42},
+		{"stale", "43\n", StatusStopped, 0},
+		{"garbage", "Running\n", StatusStopped, 0},
+	}
+	for _, tt := range tests {
+		os.Remove(pidFile)
+		if tt.pid != "" {
+			if err := ioutil.WriteFile(pidFile, []byte(tt.pid), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := StatusEx(s)
+		if err != nil {
+			t.Errorf("%s: StatusEx() error = %v", tt.name, err)
+			continue
+		}
+		if got.Status != tt.want || got.PID != tt.wantPID {
+			t.Errorf("%s: StatusEx() = %v, %d, want %v, %d", tt.name, got.Status, got.PID, tt.want, tt.wantPID)
+		}
+	}
+
+	script := "#!/bin/sh\necho 'Stopped: app is down'\nexit 3\n"
+	if err := ioutil.WriteFile(filepath.Join(rcsInitDir, "app"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.Option = KeyValue{optionRCSScript: script}
+	if got, err := s.Status(); err != nil || got != StatusStopped {
+		t.Errorf("Status() with custom script = %v, %v, want %v", got, err, StatusStopped)
+	}
+}
+
+func Test_scriptPIDFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    string
+	}{
+		{"default", KeyValue{}, `pid_file="/var/run/$name.pid"`},
+		{"custom", KeyValue{optionPIDFile: "/run/user/1000/{{.Name}}.pid"}, `pid_file="/run/user/1000/app.pid"`},
+		{"instance", KeyValue{optionPIDFile: "/tmp/{{.Name}}.pid", optionInstance: "a"}, `pid_file="/tmp/app-a.pid"`},
+	}
+	for _, tt := range tests {
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: tt.options}
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: c},
+			"rcs":  &rcs{Config: c},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatalf("%s/%s: %v", tt.name, backend, err)
+			}
+			if !strings.Contains(buf.String(), tt.want+"\n") {
+				t.Errorf("%s/%s: script missing %q:\n%s", tt.name, backend, tt.want, buf.String())
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{Name: "app", Option: KeyValue{optionPIDFile: filepath.Join(dir, "{{.Name}}.pid")}}
+	if err := c.checkPIDFileDir(); err != nil {
+		t.Errorf("checkPIDFileDir() = %v", err)
+	}
+	c.Option[optionPIDFile] = filepath.Join(dir, "missing", "app.pid")
+	if err := c.checkPIDFileDir(); err == nil {
+		t.Error("checkPIDFileDir() for a missing directory succeeded")
+	}
+	c.Option[optionPIDFile] = "/run/{{.Nmae}}.pid"
+	if err := c.checkPIDFileDir(); err == nil {
+		t.Error("checkPIDFileDir() for an invalid template succeeded")
+	}
+}
+
+func Test_scriptStartLock(t *testing.T) {
+	for _, lock := range []bool{false, true} {
+		c := &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionStartLock: lock}}
+		for backend, w := range map[string]interface{ writeScript(io.Writer) error }{
+			"sysv": &sysv{Config: c},
+			"rcs":  &rcs{Config: c},
+		} {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+			script := buf.String()
+			for _, want := range []string{
+				"    start)\n        exec 9> \"$pid_file.lock\"\n        if ! flock -n 9; then\n",
+				"echo \"start already in progress\"",
+				"$cmd 9>&- >> \"$stdout_log\"",
+			} {
+				if got := strings.Contains(script, want); got != lock {
+					t.Errorf("%s StartLock=%v: script contains %q = %v:\n%s", backend, lock, want, got, script)
+				}
+			}
+		}
+	}
+}
+
+func Test_rcsRestartWaitsForStop(t *testing.T) {
+	defer func(d time.Duration) { rcsStopPollInterval = d }(rcsStopPollInterval)
+	rcsStopPollInterval = time.Millisecond
+
+	tests := []struct {
+		name        string
+		running     int
+		wantErr     bool
+		wantStarted bool
+	}{
+		{"stops", 3, false, true},
+		{"never-stops", -1, true, false},
+	}
+	for _, tt := range tests {
+		running := tt.running
+		started := false
+		_, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+			switch arguments[0] {
+			case "status":
+				if running == 0 {
+					return 1, "Stopped\n", errors.New("exit status 1")
+				}
+				running--
+				return 0, "Running\n", nil
+			case "start":
+				started = true
+			}
+			return 0, "", nil
+		})
+		s := &rcs{Config: &Config{Name: "app", Option: KeyValue{
+			optionRCSScript:   rcsScript,
+			optionStopTimeout: 50 * time.Millisecond,
+		}}}
+		err := s.Restart()
+		restore()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Restart() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if started != tt.wantStarted {
+			t.Errorf("%s: started = %v, want %v", tt.name, started, tt.wantStarted)
+		}
+	}
+}
+
+func Test_scriptStopTimeout(t *testing.T) {
+	orig := commandRunner
+	defer func() { commandRunner = orig }()
+	var deadlines []time.Duration
+	commandRunner = func(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, time.Until(deadline))
+		switch command {
+		case "hang":
+			<-ctx.Done()
+			return 0, "", "", fmt.Errorf("%q: %w", command, ctx.Err())
+		case "fail":
+			return 1, "", "", errors.New("exit status 1")
+		}
+		return 0, "", "", nil
+	}
+
+	c := &Config{Option: KeyValue{optionStopTimeout: 50 * time.Millisecond}}
+	if err := c.runStop("hang"); !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("runStop() of a hung command = %v, want ErrStopTimeout", err)
+	}
+	if err := c.runStop("fail"); err == nil || errors.Is(err, ErrStopTimeout) {
+		t.Errorf("runStop() of a failing command = %v, want a failure other than ErrStopTimeout", err)
+	}
+	deadlines = nil
+	if err := (&Config{}).runStop("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if deadlines[0] <= time.Second {
+		t.Errorf("runStop() without StopTimeout had deadline in %v, want CommandTimeout", deadlines[0])
+	}
+
+	// Hitting CommandTimeout is not a StopTimeout.
+	origTimeout := commandTimeout
+	defer func() { commandTimeout = origTimeout }()
+	commandTimeout = 50 * time.Millisecond
+	if err := (&Config{}).runStop("hang"); err == nil || errors.Is(err, ErrStopTimeout) {
+		t.Errorf("runStop() without StopTimeout past CommandTimeout = %v, want a failure other than ErrStopTimeout", err)
+	}
+	c.Option[optionStopTimeout] = 5 * time.Second
+	if err := c.runStop("hang"); err == nil || errors.Is(err, ErrStopTimeout) {
+		t.Errorf("runStop() past CommandTimeout before StopTimeout = %v, want a failure other than ErrStopTimeout", err)
+	}
+
+	deadlines = nil
+	if err := (&sysv{Config: &Config{Name: "app", Option: KeyValue{optionStopTimeout: time.Second}}}).Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deadlines) != 1 || deadlines[0] > time.Second {
+		t.Errorf("sysv Stop() deadlines = %v, want one within StopTimeout", deadlines)
+	}
+}
+
+func Test_createLogDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	logDir := filepath.Join(dir, "app", "logs")
+	c := &Config{Name: "app", UserName: current.Username, Option: KeyValue{optionLogDirectory: logDir}}
+	if err := c.createLogDirectory(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(logDir); err != nil || !fi.IsDir() {
+		t.Fatalf("log directory not created: %v", err)
+	}
+	// An existing directory is left alone, even for an unknown user.
+	c.UserName = "no-such-user-for-service-test"
+	if err := c.createLogDirectory(); err != nil {
+		t.Errorf("createLogDirectory() on existing directory: %v", err)
+	}
+
+	c.Option[optionLogDirectory] = filepath.Join(dir, "other")
+	if err := c.createLogDirectory(); err == nil {
+		t.Error("createLogDirectory() with unknown user succeeded")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.Option[optionLogDirectory] = filepath.Join(dir, "file", "logs")
+	if err := c.createLogDirectory(); err == nil {
+		t.Error("createLogDirectory() below a file succeeded")
+	}
+}
+
+func Test_checkWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := checkWritable(filepath.Join(dir, "app.service")); err != nil {
+		t.Errorf("checkWritable() on a writable directory = %v", err)
+	}
+
+	orig := statfs
+	defer func() { statfs = orig }()
+	var checked []string
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		checked = append(checked, path)
+		if err := orig(path, st); err != nil {
+			return err
+		}
+		if path == dir {
+			st.Flags |= stRDONLY
+		}
+		return nil
+	}
+	for _, path := range []string{
+		filepath.Join(dir, "app.service"),
+		filepath.Join(dir, "sv", "app", "run"),
+	} {
+		checked = nil
+		err := checkWritable(path)
+		if !errors.Is(err, ErrReadOnlyFilesystem) {
+			t.Errorf("checkWritable(%s) = %v, want ErrReadOnlyFilesystem", path, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), path) {
+			t.Errorf("checkWritable(%s) = %q, want the path", path, err)
+		}
+		if checked[len(checked)-1] != dir {
+			t.Errorf("checkWritable(%s) checked %v, want it to stop at %s", path, checked, dir)
+		}
+	}
+
+	origInit := rcsInitDir
+	defer func() { rcsInitDir = origInit }()
+	rcsInitDir = dir
+	if err := (&rcs{Config: &Config{Name: "app"}}).Install(); !errors.Is(err, ErrReadOnlyFilesystem) {
+		t.Errorf("Install() = %v, want ErrReadOnlyFilesystem", err)
+	}
+}
+
+func Test_rcsUninstallPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(init, link string) {
+		rcsInitDir, rcsLinkDir = init, link
+	}(rcsInitDir, rcsLinkDir)
+	rcsInitDir = filepath.Join(dir, "init.d")
+	rcsLinkDir = filepath.Join(dir, "rc.d")
+	for _, d := range []string{rcsInitDir, rcsLinkDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The script is gone, leaving its start link dangling.
+	link := filepath.Join(rcsLinkDir, startLinkPrefix+"app")
+	if err := os.Symlink(filepath.Join(rcsInitDir, "app"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &rcs{Config: &Config{Name: "app"}}
+	if err := s.Uninstall(); err != nil {
+		t.Fatalf("Uninstall() of a partial install = %v", err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() left the start link: %v", err)
+	}
+	if err := s.Uninstall(); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() when not installed = %v, want a not-exist error", err)
+	}
+}
+
+func Test_rcsStartAtBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(init, link string) {
+		rcsInitDir, rcsLinkDir = init, link
+	}(rcsInitDir, rcsLinkDir)
+	rcsInitDir = filepath.Join(dir, "init.d")
+	rcsLinkDir = filepath.Join(dir, "rc.d")
+	for _, d := range []string{rcsInitDir, rcsLinkDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setExecutablesExist()()
+	link := filepath.Join(rcsLinkDir, startLinkPrefix+"app")
+	if _, err := IsEnabled(&rcs{Config: &Config{Name: "app"}}); err != ErrNotInstalled {
+		t.Errorf("IsEnabled() before Install = %v, want ErrNotInstalled", err)
+	}
+
+	for _, startAtBoot := range []bool{false, true} {
+		startAtBoot := startAtBoot
+		s := &rcs{Config: &Config{Name: "app", Executable: "/usr/bin/app", StartAtBoot: &startAtBoot, Option: KeyValue{
+			optionLogDirectory: dir,
+			optionOverwrite:    true,
+		}}}
+		if err := s.Install(); err != nil {
+			t.Fatalf("Install() with StartAtBoot %v = %v", startAtBoot, err)
+		}
+		if _, err := os.Stat(filepath.Join(rcsInitDir, "app")); err != nil {
+			t.Errorf("Install() with StartAtBoot %v did not write the script: %v", startAtBoot, err)
+		}
+		if _, err := os.Lstat(link); (err == nil) != startAtBoot {
+			t.Errorf("Install() with StartAtBoot %v: start link exists = %v", startAtBoot, err == nil)
+		}
+		if enabled, err := IsEnabled(s); err != nil || enabled != startAtBoot {
+			t.Errorf("IsEnabled() with StartAtBoot %v = %v, %v", startAtBoot, enabled, err)
+		}
+	}
+}
+
+func Test_rcsVerifyPID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func(proc string) { rcsProcDir = proc }(rcsProcDir)
+	rcsProcDir = filepath.Join(dir, "proc")
+	app := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(app, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for pid, exe := range map[string]string{
+		"42": app,
+		"43": "/usr/bin/other",
+		"44": app + " (deleted)",
+	} {
+		if err := os.MkdirAll(filepath.Join(rcsProcDir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(exe, filepath.Join(rcsProcDir, pid, "exe")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pidFile := filepath.Join(dir, "app.pid")
+	s := &rcs{Config: &Config{Name: "app", Executable: app, Option: KeyValue{
+		optionPIDFile:   pidFile,
+		optionVerifyPID: true,
+	}}}
+	for _, tt := range []struct {
+		pid     string
+		wantErr bool
+	}{
+		{"42", false},
+		{"43", true},
+		{"44", false},
+		{"45", false},
+	} {
+		if err := ioutil.WriteFile(pidFile, []byte(tt.pid+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := s.checkPIDOwner(rcsProcDir, "")
+		if tt.wantErr != errors.Is(err, ErrPIDMismatch) {
+			t.Errorf("pid %s: checkPIDOwner() error = %v, want mismatch %v", tt.pid, err, tt.wantErr)
+		}
+	}
+
+	if err := ioutil.WriteFile(pidFile, []byte("43\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "", nil
+	})
+	defer restore()
+	if err := s.Stop(); !errors.Is(err, ErrPIDMismatch) {
+		t.Errorf("Stop() of a recycled pid error = %v, want %v", err, ErrPIDMismatch)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("Stop() of a recycled pid ran %v", *calls)
+	}
+	if pid, ok := s.runningPID(); ok {
+		t.Errorf("runningPID() = %d, want the recycled pid ignored", pid)
+	}
+
+	var buf bytes.Buffer
+	if err := s.writeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`[ "$(readlink -f /proc/$(get_pid)/exe)" = "$(readlink -f "` + app + `")" ]`,
+		"if ! owns_pid; then",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("script missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+// setExecutablesExist makes checkExecutable accept any path, for tests
+// installing services with made up executables.
+func setExecutablesExist() func() {
+	orig := statExecutable
+	statExecutable = func(string) (os.FileInfo, error) {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		return os.Stat(self)
+	}
+	return func() { statExecutable = orig }
+}
+
+func Test_checkExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, mode := range map[string]os.FileMode{"app": 0755, "data": 0644} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "root", "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "root", "usr", "bin", "app"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		c       *Config
+		wantErr string
+	}{
+		{"running binary", &Config{}, ""},
+		{"executable", &Config{Executable: filepath.Join(dir, "app")}, ""},
+		{"in chroot", &Config{Executable: "/usr/bin/app", ChRoot: filepath.Join(dir, "root")}, ""},
+		{"missing", &Config{Executable: filepath.Join(dir, "missing")}, "does not exist"},
+		{"not executable", &Config{Executable: filepath.Join(dir, "data")}, "is not executable"},
+		{"directory", &Config{Executable: dir}, "is not a regular file"},
+	}
+	for _, tt := range tests {
+		err := tt.c.checkExecutable()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: checkExecutable() = %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkExecutable() = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_checkWorkingDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		options KeyValue
+		wantErr string
+	}{
+		{"unset", "", nil, ""},
+		{"exists", dir, nil, ""},
+		{"missing", filepath.Join(dir, "missing"), nil, "does not exist"},
+		{"file", file, nil, "not a directory"},
+		{"fallbacks", filepath.Join(dir, "missing"), KeyValue{optionWorkingDirectoryFallbacks: []string{dir}}, ""},
+		{"create", filepath.Join(dir, "created", "app"), KeyValue{optionCreateWorkingDirectory: true}, ""},
+	}
+	for _, tt := range tests {
+		c := &Config{Name: "app", WorkingDirectory: tt.dir, Option: tt.options}
+		err := c.checkWorkingDirectory()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: checkWorkingDirectory() = %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkWorkingDirectory() = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "created", "app")); err != nil || !fi.IsDir() {
+		t.Errorf("working directory not created: %v", err)
+	}
+}
+
+func Test_scriptReadLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.log"), []byte("1\n2\n3\n4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.err"), []byte("e1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{Name: "app", Option: KeyValue{optionLogDirectory: dir}}
+	for _, tt := range []struct {
+		lines int
+		want  []string
+	}{
+		{1, []string{"4", "e1"}},
+		{3, []string{"2", "3", "4", "e1"}},
+		{10, []string{"1", "2", "3", "4", "e1"}},
+	} {
+		got, err := ReadLogs(&rcs{Config: c}, tt.lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadLogs(%d) = %q, want %q", tt.lines, got, tt.want)
+		}
+	}
+
+	got, err := ReadLogs(&upstart{Config: c}, 5)
+	if err != nil || !reflect.DeepEqual(got, []string{"e1"}) {
+		t.Errorf("upstart ReadLogs() = %q, %v, want only the .err file", got, err)
+	}
+
+	// The OpenRC script names the log files after the executable.
+	if err := ioutil.WriteFile(filepath.Join(dir, "appd.log"), []byte("d1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.Executable = "/usr/bin/appd"
+	got, err = ReadLogs(&openrc{Config: c}, 5)
+	if err != nil || !reflect.DeepEqual(got, []string{"d1"}) {
+		t.Errorf("openrc ReadLogs() = %q, %v, want the appd.log file", got, err)
+	}
+}
+
+func Test_scriptReadLogsSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := `starting
+2024/01/02 15:04:04 old
+  old detail
+2024/01/02 15:04:05 at since
+2024-01-02T15:04:06.5Z utc
+  new detail
+2024-01-02 15:04:07 local
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.log"), []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.err"), []byte("2024/01/02 15:04:03 stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	origLocal := time.Local
+	defer func() { time.Local = origLocal }()
+	time.Local = time.UTC
+
+	c := &Config{Name: "app", Option: KeyValue{optionLogDirectory: dir}}
+	got, err := ReadLogsSince(&sysv{Config: c}, time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"starting",
+		"2024/01/02 15:04:05 at since",
+		"2024-01-02T15:04:06.5Z utc",
+		"  new detail",
+		"2024-01-02 15:04:07 local",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadLogsSince() = %q, want %q", got, want)
+	}
+
+	// The OpenRC script names the log files after the executable.
+	for _, ext := range []string{".log", ".err"} {
+		if err := os.Rename(filepath.Join(dir, "app"+ext), filepath.Join(dir, "appd"+ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Executable = "/usr/bin/appd"
+	got, err = ReadLogsSince(&openrc{Config: c}, time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("openrc ReadLogsSince() = %q, %v, want %q", got, err, want)
+	}
+}
+
+func Test_cronWatchdog(t *testing.T) {
+	crontab := "0 0 * * * /usr/bin/backup\n"
+	_, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		if command != "crontab" || len(arguments) != 1 {
+			t.Fatalf("unexpected command %s %v", command, arguments)
+		}
+		if arguments[0] == "-l" {
+			return 0, crontab, nil
+		}
+		b, err := ioutil.ReadFile(arguments[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		crontab = string(b)
+		return 0, "", nil
+	})
+	defer restore()
+
+	entry := "*/1 * * * * /etc/init.d/app start > /dev/null 2>&1"
+	for i := 0; i < 2; i++ {
+		if err := installCronWatchdog("/etc/init.d/app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := "0 0 * * * /usr/bin/backup\n" + entry + "\n"; crontab != want {
+		t.Errorf("crontab after install = %q, want %q", crontab, want)
+	}
+	if err := removeCronWatchdog("/etc/init.d/app"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "0 0 * * * /usr/bin/backup\n"; crontab != want {
+		t.Errorf("crontab after uninstall = %q, want %q", crontab, want)
+	}
+
+	// crontab -l fails for users without a crontab.
+	crontab = ""
+	commandRunner = func(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+		if arguments[0] == "-l" {
+			return 1, "", "no crontab for root\n", errors.New("exit status 1")
+		}
+		b, err := ioutil.ReadFile(arguments[0])
+		crontab = string(b)
+		return 0, "", "", err
+	}
+	if err := installCronWatchdog("/etc/init.d/app"); err != nil {
+		t.Fatal(err)
+	}
+	if want := entry + "\n"; crontab != want {
+		t.Errorf("crontab after install = %q, want %q", crontab, want)
+	}
+}
+
+func Test_newServiceValidatesName(t *testing.T) {
+	tests := []struct {
+		backend string
+		new     func(i Interface, platform string, c *Config) (Service, error)
+		name    string
+		options KeyValue
+		wantErr string
+	}{
+		{"systemd", newSystemdService, "app", KeyValue{optionInstance: "web"}, ""},
+		{"systemd", newSystemdService, "my app", nil, `may not contain ' '`},
+		{"systemd", newSystemdService, "app@x", nil, `may not contain '@'`},
+		{"systemd", newSystemdService, "app", KeyValue{optionInstance: "a b"}, `may not contain ' '`},
+		{"sysv", newSystemVService, "app", nil, ""},
+		{"sysv", newSystemVService, "my\tapp", nil, `contains '\t'`},
+		{"sysv", newSystemVService, "app", KeyValue{optionInstance: "a b"}, `contains ' '`},
+		{"rcs", newRCSService, strings.Repeat("a", 253), nil, "longer than 255 bytes"},
+		{"upstart", newUpstartService, strings.Repeat("a", 251), nil, "longer than 255 bytes"},
+		{"openrc", newOpenRCService, "../app", nil, `contains '/'`},
+		{"runit", newRunitService, "my app", nil, `contains ' '`},
+		{"s6", newS6Service, "app", nil, ""},
+	}
+	for _, tt := range tests {
+		_, err := tt.new(nil, "linux-"+tt.backend, &Config{Name: tt.name, Option: tt.options})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: new(%q) = %v", tt.backend, tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: new(%q) = %v, want an error containing %q", tt.backend, tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_keepAlive(t *testing.T) {
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "initctl (upstart 1.12.1)", nil
+	})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		options KeyValue
+		systemd string
+		respawn bool
+		sysv    string
+	}{
+		{"default", nil, "Restart=always", true, ""},
+		{"keep-alive", KeyValue{optionKeepAlive: true}, "Restart=always", true, "always"},
+		{"no-keep-alive", KeyValue{optionKeepAlive: false}, "Restart=no", false, ""},
+		{"restart-wins", KeyValue{optionKeepAlive: true, optionRestart: "on-failure"}, "Restart=on-failure", true, "on-failure"},
+		{"crash-only", KeyValue{optionKeepAlive: map[string]bool{"SuccessfulExit": false}}, "Restart=on-failure", true, "on-failure"},
+	}
+	for _, tt := range tests {
+		unit, err := renderUnit(&Config{Name: "app", Option: tt.options})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(unit, "\n"+tt.systemd+"\n") {
+			t.Errorf("%s: unit missing %q:\n%s", tt.name, tt.systemd, unit)
+		}
+
+		var buf bytes.Buffer
+		err = (&upstart{Config: &Config{Name: "app", Executable: "/usr/bin/app", Option: tt.options}}).writeScript(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), "\nrespawn\n"); got != tt.respawn {
+			t.Errorf("%s: upstart respawn = %v, want %v", tt.name, got, tt.respawn)
+		}
+
+		policy, _, err := (&Config{Option: tt.options}).restartBackoff()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy != tt.sysv {
+			t.Errorf("%s: script restart policy = %q, want %q", tt.name, policy, tt.sysv)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := (&sysv{Config: &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionKeepAlive: true}}}).writeScript(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "supervise() {") || strings.Contains(buf.String(), "[ $status -eq 0 ] && break") {
+		t.Errorf("sysv script with KeepAlive does not restart after a clean exit:\n%s", buf)
+	}
+}
+
+func Test_interactiveOverride(t *testing.T) {
+	detected := ChosenSystem().Interactive()
+
+	services := make(map[bool]Service)
+	for _, forced := range []bool{true, false} {
+		s, err := NewForSystem("linux-systemd", nil, &Config{Name: "app", Option: KeyValue{optionInteractiveOverride: forced}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		services[forced] = s
+	}
+	// Each service keeps its own override, and detection is left alone.
+	for forced, s := range services {
+		if got := s.(*systemd).interactive(!forced); got != forced {
+			t.Errorf("interactive() with %s %v = %v", optionInteractiveOverride, forced, got)
+		}
+	}
+	if got := ChosenSystem().Interactive(); got != detected {
+		t.Errorf("Interactive() after creating services = %v, want detected %v", got, detected)
+	}
+	if l, err := services[true].Logger(nil); err != nil || l != ConsoleLogger {
+		t.Errorf("Logger() with %s true = %v, %v, want ConsoleLogger", optionInteractiveOverride, l, err)
+	}
+
+	// A nil *bool detects.
+	c := &Config{Name: "app", Option: KeyValue{optionInteractiveOverride: (*bool)(nil)}}
+	if c.interactive(false) || !c.interactive(true) {
+		t.Errorf("interactive() with a nil %s does not report detection", optionInteractiveOverride)
+	}
+}
+
+func Test_scriptWorkingDirectoryFallbacks(t *testing.T) {
+	c := &Config{
+		Name:             "app",
+		WorkingDirectory: "/srv/app",
+		Option:           KeyValue{optionWorkingDirectoryFallbacks: []string{"/opt/app", "/tmp"}},
+	}
+	cd := `for dir in "/srv/app" "/opt/app" "/tmp"; do [ -d "$dir" ] && break; done; cd "$dir"`
+	for backend, w := range scriptWriters(c) {
+		if backend == "openrc" {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		want := cd + "\n"
+		if backend == "runit" || backend == "s6" {
+			want = cd + " || exit 1\n"
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s script missing %q:\n%s", backend, want, buf.String())
+		}
+	}
+
+	// Without fallbacks the script changes to WorkingDirectory as before.
+	for backend, w := range scriptWriters(&Config{Name: "app", WorkingDirectory: "/srv/app"}) {
+		if backend == "openrc" {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "cd '/srv/app'") || strings.Contains(buf.String(), "for dir in") {
+			t.Errorf("%s script without fallbacks:\n%s", backend, buf.String())
+		}
+	}
+}
+
+func Test_scriptInstance(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{optionInstance: "web"}}
+	for backend, w := range scriptWriters(c) {
+		if backend == "sysv" || backend == "openrc" {
+			// These derive the name from the path of the installed script.
+			continue
+		}
+		var buf bytes.Buffer
+		if err := w.writeScript(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "\nname=app-web\n") {
+			t.Errorf("%s script does not use the instance name:\n%s", backend, buf.String())
+		}
+	}
+
+	cp, err := (&sysv{Config: c}).configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp != "/etc/init.d/app-web" {
+		t.Errorf("sysv configPath() = %q, want /etc/init.d/app-web", cp)
+	}
+}
+
+func Test_templateFuncs(t *testing.T) {
+	script := `#!/bin/sh
+exec {{.Path}} {{join " " .Arguments}}{{if index .Option "Verbose"}} --verbose{{end}} --level={{default "info" (index .Option "LogLevel")}} --name={{shout .Name}}
+`
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    string
+	}{
+		{"defaults", KeyValue{}, "exec /usr/bin/app -a -b --level=info --name=APP\n"},
+		{"set", KeyValue{"Verbose": true, "LogLevel": "debug"}, "exec /usr/bin/app -a -b --verbose --level=debug --name=APP\n"},
+		{"override", KeyValue{"LogLevel": "", optionTemplateFuncs: map[string]interface{}{
+			"join": func(sep string, a []string) string { return "joined" },
+		}}, "exec /usr/bin/app joined --level=info --name=APP\n"},
+	}
+	for _, tt := range tests {
+		tt.options[optionRunitScript] = script
+		funcs := template.FuncMap{"shout": strings.ToUpper}
+		if user, ok := tt.options[optionTemplateFuncs].(map[string]interface{}); ok {
+			for name, f := range user {
+				funcs[name] = f
+			}
+		}
+		tt.options[optionTemplateFuncs] = funcs
+		s := &runit{Config: &Config{Name: "app", Executable: "/usr/bin/app", Arguments: []string{"-a", "-b"}, Option: tt.options}}
+		got, err := s.InstallScript()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%s: script = %q, want suffix %q", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := tf["shout"]; ok {
+		t.Error("TemplateFuncs changed the built-in functions")
+	}
+}
+
+func Test_generatedHeader(t *testing.T) {
+	for _, version := range []string{"", "1.2.3"} {
+		want := "# Generated by app (service pkg)\n"
+		if version != "" {
+			want = "# Generated by app v1.2.3 (service pkg)\n"
+		}
+		c := &Config{Name: "app", Version: version}
+		writers := scriptWriters(c)
+		writers["upstart"] = &upstart{Config: c}
+		for backend, w := range writers {
+			var buf bytes.Buffer
+			if err := w.writeScript(&buf); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitAfterN(buf.String(), "\n", 3)
+			if lines[0] != want && lines[1] != want {
+				t.Errorf("%s script does not start with %q:\n%s", backend, want, buf.String())
+			}
+		}
+		unit, err := renderUnit(&Config{Name: "app", Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(unit, want) {
+			t.Errorf("unit does not start with %q:\n%s", want, unit)
+		}
+	}
+}
+
+func Test_userServiceNotSupported(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{optionUserService: true}}
+	for _, s := range []interface{ configPath() (string, error) }{
+		&sysv{Config: c}, &rcs{Config: c}, &openrc{Config: c}, &upstart{Config: c},
+	} {
+		if _, err := s.configPath(); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("%T.configPath() error = %v, want ErrNotSupported", s, err)
+		}
+	}
+}
+
+func Test_scriptListInstalled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rc.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origSysv, origRCS := sysvRCDir, rcsLinkDir
+	defer func() { sysvRCDir, rcsLinkDir = origSysv, origRCS }()
+	sysvRCDir, rcsLinkDir = dir, filepath.Join(dir, "rc.d")
+
+	for name, list := range map[string]func() ([]string, error){"sysv": sysvListInstalled, "rcs": rcsListInstalled} {
+		if got, err := list(); err != nil || got == nil || len(got) != 0 {
+			t.Errorf("%s list without links = %#v, %v, want an empty list", name, got, err)
+		}
+	}
+
+	for _, link := range []string{"rc2.d/S50web", "rc2.d/S20other", "rc2.d/K02web", "rc.d/S50worker", "rc.d/S50"} {
+		path := filepath.Join(dir, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/etc/init.d/x", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, tt := range map[string]struct {
+		list func() ([]string, error)
+		want []string
+	}{
+		"sysv": {sysvListInstalled, []string{"web"}},
+		"rcs":  {rcsListInstalled, []string{"worker"}},
+	} {
+		got, err := tt.list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s list = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func Test_isOpenRC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origBinary, origSoftlevel, origInittab, origSystemd := openrcBinary, openrcSoftlevel, openrcInittab, openrcSystemdDir
+	origPath := os.Getenv("PATH")
+	defer func() {
+		openrcBinary, openrcSoftlevel, openrcInittab, openrcSystemdDir = origBinary, origSoftlevel, origInittab, origSystemd
+		os.Setenv("PATH", origPath)
+	}()
+	os.Setenv("PATH", dir)
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  bool
+	}{
+		{"none", nil, false},
+		{"binary", map[string]string{"openrc": ""}, true},
+		{"softlevel", map[string]string{"softlevel": "default"}, true},
+		{"inittab", map[string]string{"inittab": "::sysinit:/sbin/openrc sysinit\n"}, true},
+		{"busybox inittab", map[string]string{"inittab": "::sysinit:/etc/init.d/rcS\n"}, false},
+		{"systemd running", map[string]string{"openrc": "", "softlevel": "default", "systemd": ""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := filepath.Join(dir, tt.name)
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			openrcBinary = filepath.Join(root, "openrc")
+			openrcSoftlevel = filepath.Join(root, "softlevel")
+			openrcInittab = filepath.Join(root, "inittab")
+			openrcSystemdDir = filepath.Join(root, "systemd")
+			if got := isOpenRC(); got != tt.want {
+				t.Errorf("isOpenRC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 const (
 	dockerCgroup = `13:name=systemd:/docker/bc9f0894926991e3064b731c26d86af6df7390c0e6453e6027f9545aba5809ee
 12:pids:/docker/bc9f0894926991e3064b731c26d86af6df7390c0e6453e6027f9545aba5809ee
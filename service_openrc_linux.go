@@ -2,23 +2,47 @@ package service
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
 	"regexp"
-	"syscall"
 	"text/template"
 	"time"
 )
 
+var (
+	// openrcBinary is installed with OpenRC, even where it is not PID 1.
+	openrcBinary = "/sbin/openrc"
+	// openrcSoftlevel exists once OpenRC has booted the system.
+	openrcSoftlevel = "/run/openrc/softlevel"
+	// openrcInittab starts OpenRC from busybox init, as on Alpine.
+	openrcInittab = "/etc/inittab"
+	// openrcSystemdDir exists when systemd is running, in which case an
+	// installed OpenRC is not the init system.
+	openrcSystemdDir = "/run/systemd/system"
+	// openrcRunlevelDir holds a directory per runlevel, with a link for
+	// each service rc-update added to it.
+	openrcRunlevelDir = "/etc/runlevels"
+)
+
 func isOpenRC() bool {
+	if _, err := os.Stat(openrcSystemdDir); err == nil {
+		return false
+	}
+	if _, err := os.Stat(openrcSoftlevel); err == nil {
+		return true
+	}
 	if _, err := exec.LookPath("openrc-init"); err == nil {
 		return true
 	}
-	if _, err := os.Stat("/etc/inittab"); err == nil {
-		filerc, err := os.Open("/etc/inittab")
+	if _, err := os.Stat(openrcBinary); err == nil {
+		return true
+	}
+	if _, err := os.Stat(openrcInittab); err == nil {
+		filerc, err := os.Open(openrcInittab)
 		if err != nil {
 			return false
 		}
@@ -59,12 +83,15 @@ func (s *openrc) template() *template.Template {
 	customScript := s.Option.string(optionOpenRCScript, "")
 
 	if customScript != "" {
-		return template.Must(template.New("").Funcs(tf).Parse(customScript))
+		return template.Must(template.New("").Funcs(s.funcs()).Parse(customScript))
 	}
-	return template.Must(template.New("").Funcs(tf).Parse(openRCScript))
+	return template.Must(template.New("").Funcs(s.funcs()).Parse(openRCScript))
 }
 
 func newOpenRCService(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(c.instanceName()); err != nil {
+		return nil, err
+	}
 	s := &openrc{
 		i:        i,
 		platform: platform,
@@ -73,96 +100,164 @@ func newOpenRCService(i Interface, platform string, c *Config) (Service, error)
 	return s, nil
 }
 
-var errNoUserServiceOpenRC = errors.New("user services are not supported on OpenRC")
+var errNoUserServiceOpenRC = notSupported("user services on OpenRC")
 
 func (s *openrc) configPath() (cp string, err error) {
 	if s.Option.bool(optionUserService, optionUserServiceDefault) {
 		err = errNoUserServiceOpenRC
 		return
 	}
-	cp = "/etc/init.d/" + s.Config.Name
+	cp = "/etc/init.d/" + s.instanceName()
 	return
 }
 
+// InstallScript returns the file Install would write, without writing it.
+func (s *openrc) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
+}
+
 func (s *openrc) Install() error {
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
-	f, err := os.Create(confPath)
-	if err != nil {
+	if err = s.createLogDirectory(); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	err = os.Chmod(confPath, 0755)
-	if err != nil {
+	if err = checkWritable(confPath); err != nil {
 		return err
 	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.writeFile(confPath, 0755, s.writeScript); err != nil {
+			return err
+		}
+		if err := s.smokeTest(confPath); err != nil {
+			return err
+		}
+		if !s.startAtBoot() {
+			return nil
+		}
+		// run rc-update
+		return rb.step(func(ctx context.Context) error {
+			return runContext(ctx, "rc-update", "add", s.instanceName())
+		}, func() {
+			s.runAction("delete")
+		})
+	})
+}
 
+// writeScript renders the openrc-run script for the service to w.
+func (s *openrc) writeScript(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
 
 	var to = &struct {
 		*Config
+		Name         string
 		Path         string
 		LogDirectory string
+		ScriptPath   string
+		ScriptLocale string
+		Description  string
+		UMask        string
 	}{
 		s.Config,
+		s.instanceName(),
 		path,
 		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.Option.string(optionScriptPath, ""),
+		s.Option.string(optionScriptLocale, ""),
+		s.description(),
+		umask,
 	}
 
-	err = s.template().Execute(f, to)
-	if err != nil {
-		return err
-	}
-	// run rc-update
-	return s.runAction("add")
+	return s.template().Execute(w, to)
 }
 
 func (s *openrc) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *openrc) uninstall() error {
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(confPath); err != nil {
-		return err
+	// Drop the runlevel entry even if the script is already gone.
+	return joinErrors(removePaths(confPath), s.runAction("delete"))
+}
+
+// logName returns the name of the log files the script writes: the base
+// name of the executable, with symbolic links resolved as readlink -f
+// does in the script.
+func (s *openrc) logName() (string, error) {
+	path, err := s.execPath()
+	if err != nil {
+		return "", err
 	}
-	return s.runAction("delete")
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return filepath.Base(path), nil
+}
+
+// ReadLogs returns the tail of the log files the script writes.
+func (s *openrc) ReadLogs(lines int) ([]string, error) {
+	name, err := s.logName()
+	if err != nil {
+		return nil, err
+	}
+	return s.readNamedLogFiles(name, lines, ".log", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *openrc) ReadLogsSince(since time.Time) ([]string, error) {
+	name, err := s.logName()
+	if err != nil {
+		return nil, err
+	}
+	return s.readNamedLogFilesSince(name, since, ".log", ".err")
 }
 
 func (s *openrc) Logger(errs chan<- error) (Logger, error) {
-	if system.Interactive() {
+	if s.interactive(system.Interactive()) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 
 func (s *openrc) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
-func (s *openrc) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+func (s *openrc) Run() error {
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *openrc) Status() (Status, error) {
@@ -172,7 +267,7 @@ func (s *openrc) Status() (Status, error) {
 	// errno 2 = ENOENT 2 No such file or directory
 	// errno 3 = ESRCH 3 No such process
 	// for more info, see https://man7.org/linux/man-pages/man3/errno.3.html
-	_, out, err := runWithOutput("rc-service", s.Name, "status")
+	_, out, err := runWithOutput("rc-service", s.instanceName(), "status")
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			// The program has exited with an exit code != 0
@@ -194,12 +289,25 @@ func (s *openrc) Status() (Status, error) {
 	return StatusRunning, nil
 }
 
+// IsEnabled reports whether the service was added to any runlevel.
+func (s *openrc) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	links, err := filepath.Glob(filepath.Join(openrcRunlevelDir, "*", s.instanceName()))
+	if err != nil {
+		return false, err
+	}
+	return linkEnabled(confPath, links...)
+}
+
 func (s *openrc) Start() error {
-	return run("rc-service", s.Name, "start")
+	return run("rc-service", s.instanceName(), "start")
 }
 
 func (s *openrc) Stop() error {
-	return run("rc-service", s.Name, "stop")
+	return s.runStop("rc-service", s.instanceName(), "stop")
 }
 
 func (s *openrc) Restart() error {
@@ -212,7 +320,7 @@ func (s *openrc) Restart() error {
 }
 
 func (s *openrc) runAction(action string) error {
-	return s.run(action, s.Name)
+	return s.run(action, s.instanceName())
 }
 
 func (s *openrc) run(action string, args ...string) error {
@@ -220,6 +328,13 @@ func (s *openrc) run(action string, args ...string) error {
 }
 
 const openRCScript = `#!/sbin/openrc-run
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+{{- if .ScriptPath}}
+export PATH={{.ScriptPath|cmd}}
+{{- end}}
+{{- if .ScriptLocale}}
+export LANG={{.ScriptLocale|cmd}}
+{{- end}}
 supervisor=supervise-daemon
 name="{{.DisplayName}}"
 description="{{.Description}}"
@@ -228,7 +343,7 @@ command={{.Path|cmdEscape}}
 command_args="{{range .Arguments}}{{.}} {{end}}"
 {{- end }}
 name=$(basename $(readlink -f $command))
-supervise_daemon_args="--stdout {{.LogDirectory}}/${name}.log --stderr {{.LogDirectory}}/${name}.err"
+supervise_daemon_args="--stdout {{.LogDirectory}}/${name}.log --stderr {{.LogDirectory}}/${name}.err{{if .UMask}} --umask {{.UMask}}{{end}}"
 
 {{range $k, $v := .EnvVars -}}
 export {{$k}}={{$v}}
@@ -6,18 +6,29 @@ package service
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
 	"time"
 )
 
+var (
+	// rcsInitDir holds the init scripts.
+	rcsInitDir = "/etc/init.d"
+	// rcsLinkDir holds the start links run by rcS.
+	rcsLinkDir = "/etc/rc.d"
+	// rcsProcDir is checked for the process of a pid file.
+	rcsProcDir = "/proc"
+)
+
 type rcs struct {
 	i        Interface
 	platform string
@@ -53,6 +64,9 @@ func isRCS() bool {
 }
 
 func newRCSService(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(startLinkPrefix + c.instanceName()); err != nil {
+		return nil, err
+	}
 	s := &rcs{
 		i:        i,
 		platform: platform,
@@ -73,15 +87,21 @@ func (s *rcs) Platform() string {
 	return s.platform
 }
 
+// optionCapabilities reports the options the rcS script honors: the
+// supervise loop restarts the service and ulimit limits it.
+func (s *rcs) optionCapabilities() Capabilities {
+	return Capabilities{RestartPolicy: true, ResourceLimits: true}
+}
+
 // todo
-var errNoUserServiceRCS = errors.New("User services are not supported on rcS.")
+var errNoUserServiceRCS = notSupported("user services on rcS")
 
 func (s *rcs) configPath() (cp string, err error) {
 	if s.Option.bool(optionUserService, optionUserServiceDefault) {
 		err = errNoUserServiceRCS
 		return
 	}
-	cp = "/etc/init.d/" + s.Config.Name
+	cp = filepath.Join(rcsInitDir, s.instanceName())
 	return
 }
 
@@ -89,9 +109,14 @@ func (s *rcs) template() *template.Template {
 	customScript := s.Option.string(optionRCSScript, "")
 
 	if customScript != "" {
-		return template.Must(template.New("").Funcs(tf).Parse(customScript))
+		return s.parseScript(customScript)
 	}
-	return template.Must(template.New("").Funcs(tf).Parse(rcsScript))
+	return s.parseScript(rcsScript)
+}
+
+// InstallScript returns the file Install would write, without writing it.
+func (s *rcs) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
 }
 
 func (s *rcs) Install() error {
@@ -99,140 +124,366 @@ func (s *rcs) Install() error {
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
-	f, err := os.Create(confPath)
-	if err != nil {
+	if err = s.checkPIDFileDir(); err != nil {
+		return err
+	}
+	if err = s.createLogDirectory(); err != nil {
+		return err
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
 		return err
 	}
-	defer f.Close()
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.writeFile(confPath, 0755, s.writeScript); err != nil {
+			return err
+		}
+		if err := s.smokeTest(confPath); err != nil {
+			return err
+		}
+
+		if s.startAtBoot() {
+			link := filepath.Join(rcsLinkDir, startLinkPrefix+s.instanceName())
+			err := rb.step(func(context.Context) error {
+				return symlink(confPath, link, s.Option.bool(optionOverwrite, optionOverwriteDefault))
+			}, func() {
+				os.Remove(link)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !s.Option.bool(optionCronWatchdog, optionCronWatchdogDefault) {
+			return nil
+		}
+		return rb.step(func(context.Context) error {
+			return installCronWatchdog(confPath)
+		}, func() {
+			removeCronWatchdog(confPath)
+		})
+	})
+}
 
+// writeScript renders the init script for the service to w.
+func (s *rcs) writeScript(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
-
-	var to = &struct {
-		*Config
-		Path         string
-		LogDirectory string
-	}{
-		s.Config,
-		path,
-		s.Option.string(optionLogDirectory, defaultLogDirectory),
+	restartPolicy, restartMaxSec, err := s.restartBackoff()
+	if err != nil {
+		return err
 	}
-
-	err = s.template().Execute(f, to)
+	softNOFILE, hardNOFILE, err := s.ulimitNOFILE()
 	if err != nil {
 		return err
 	}
-
-	if err = os.Chmod(confPath, 0755); err != nil {
+	pidFile, err := s.pidFile("")
+	if err != nil {
 		return err
 	}
-
-	if err = os.Symlink(confPath, "/etc/rc.d/S50"+s.Name); err != nil {
+	cpuAffinity, err := s.cpuAffinity()
+	if err != nil {
+		return err
+	}
+	killTimeout, forceKill, err := s.killTimeout()
+	if err != nil {
+		return err
+	}
+	conditions, err := s.startConditions()
+	if err != nil {
+		return err
+	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
 		return err
 	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+	if err = s.checkLabels(); err != nil {
+		return err
+	}
+	usage := s.Option.bool(optionIncludeUsage, optionIncludeUsageDefault)
+	var confPath string
+	if usage {
+		if confPath, err = s.configPath(); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	var to = &struct {
+		*Config
+		Name               string
+		Path               string
+		LogDirectory       string
+		ScriptPath         string
+		ScriptLocale       string
+		WorkingDirectories []string
+		RestartPolicy      string
+		RestartMaxSec      int
+		LimitNOFILESoft    string
+		LimitNOFILEHard    string
+		PIDFile            string
+		StartLock          bool
+		CPUAffinity        string
+		ArgumentsRaw       []string
+		LSBDependencies    []string
+		Usage              bool
+		ConfigPath         string
+		Description        string
+		VerifyPID          bool
+		KillTimeout        int
+		ForceKill          bool
+		Conditions         []startCondition
+		UMask              string
+	}{
+		s.Config,
+		s.instanceName(),
+		path,
+		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.Option.string(optionScriptPath, ""),
+		s.Option.string(optionScriptLocale, ""),
+		s.workingDirectories(),
+		restartPolicy,
+		restartMaxSec,
+		softNOFILE,
+		hardNOFILE,
+		pidFile,
+		s.Option.bool(optionStartLock, optionStartLockDefault),
+		cpuAffinity,
+		s.Option.strings(optionArgumentsRaw, nil),
+		s.lsbDependencies(),
+		usage,
+		confPath,
+		s.description(),
+		s.Option.bool(optionVerifyPID, optionVerifyPIDDefault),
+		scriptSeconds(killTimeout),
+		forceKill,
+		conditions,
+		umask,
+	}
+
+	return s.template().Execute(w, to)
 }
 
 func (s *rcs) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *rcs) uninstall() error {
 	cp, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
-		return err
-	}
-	if err := os.Remove("/etc/rc.d/S50" + s.Name); err != nil {
-		return err
+	err = removePaths(cp, filepath.Join(rcsLinkDir, startLinkPrefix+s.instanceName()))
+	if s.Option.bool(optionCronWatchdog, optionCronWatchdogDefault) {
+		err = joinErrors(err, removeCronWatchdog(cp))
 	}
-	return nil
+	return err
+}
+
+// ReadLogs returns the tail of the log files the script writes.
+func (s *rcs) ReadLogs(lines int) ([]string, error) {
+	return s.readLogFiles(lines, ".log", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *rcs) ReadLogsSince(since time.Time) ([]string, error) {
+	return s.readLogFilesSince(since, ".log", ".err")
 }
 
 func (s *rcs) Logger(errs chan<- error) (Logger, error) {
-	if system.Interactive() {
+	if s.interactive(system.Interactive()) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *rcs) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
-func (s *rcs) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
+func (s *rcs) Run() error {
+	return runLoop(s, s.i, s.Config)
+}
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
+func (s *rcs) Status() (Status, error) {
+	details, err := s.StatusEx()
+	return details.Status, err
+}
+
+// StatusEx returns the status of the service. The default script is
+// checked through its pid file, which also yields the PID. Custom scripts
+// may not write that pid file and are asked for their status instead.
+func (s *rcs) StatusEx() (StatusDetails, error) {
+	details := StatusDetails{Name: s.instanceName(), Status: StatusUnknown}
+	if s.Option.string(optionRCSScript, "") != "" {
+		details.Status, details.State = s.scriptStatus()
+		if details.Status == StatusUnknown {
+			return details, ErrNotInstalled
+		}
+		return details, nil
+	}
 
-	return s.i.Stop(s)
+	cp, err := s.configPath()
+	if err != nil {
+		return details, err
+	}
+	if _, err = os.Stat(cp); os.IsNotExist(err) {
+		return details, ErrNotInstalled
+	}
+	pid, ok := s.runningPID()
+	if !ok {
+		details.Status = StatusStopped
+		return details, nil
+	}
+	details.Status = StatusRunning
+	details.PID = pid
+	return details, nil
 }
 
-func (s *rcs) Status() (Status, error) {
-	_, out, err := runWithOutput("/etc/init.d/"+s.Name, "status")
+// runningPID returns the PID in the pid file of the default script, at
+// PIDFile if set, if that process is alive.
+func (s *rcs) runningPID() (int, bool) {
+	p, err := s.pidFile("/var/run/{{.Name}}.pid")
+	if err != nil {
+		return 0, false
+	}
+	b, err := ioutil.ReadFile(p)
 	if err != nil {
-		return StatusUnknown, err
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	if _, err = os.Stat(filepath.Join(rcsProcDir, strconv.Itoa(pid))); err != nil {
+		return 0, false
+	}
+	if s.Option.bool(optionVerifyPID, optionVerifyPIDDefault) && s.checkPIDOwner(rcsProcDir, p) != nil {
+		return 0, false
 	}
+	return pid, true
+}
 
+// scriptStatus asks the init script for the status. The script may exit
+// non-zero while stopped, so its output is checked first.
+func (s *rcs) scriptStatus() (Status, string) {
+	_, out, _ := runWithOutput(filepath.Join(rcsInitDir, s.instanceName()), "status")
+	state := strings.TrimSpace(out)
 	switch {
 	case strings.HasPrefix(out, "Running"):
-		return StatusRunning, nil
+		return StatusRunning, state
 	case strings.HasPrefix(out, "Stopped"):
-		return StatusStopped, nil
+		return StatusStopped, state
 	default:
-		return StatusUnknown, ErrNotInstalled
+		return StatusUnknown, state
 	}
 }
 
+// IsEnabled reports whether the start link of the service exists.
+func (s *rcs) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	return linkEnabled(confPath, filepath.Join(rcsLinkDir, startLinkPrefix+s.instanceName()))
+}
+
 func (s *rcs) Start() error {
-	return run("/etc/init.d/"+s.Name, "start")
+	return run(filepath.Join(rcsInitDir, s.instanceName()), "start")
+}
+
+// RestartHistory returns the restarts of the supervise loop of the
+// script.
+func (s *rcs) RestartHistory() (int, time.Time, error) {
+	return s.restartHistory("/var/run/{{.Name}}.pid")
 }
 
 func (s *rcs) Stop() error {
-	return run("/etc/init.d/"+s.Name, "stop")
+	if s.Option.bool(optionVerifyPID, optionVerifyPIDDefault) && s.Option.string(optionRCSScript, "") == "" {
+		if err := s.checkPIDOwner(rcsProcDir, "/var/run/{{.Name}}.pid"); err != nil {
+			return err
+		}
+	}
+	return s.runStop(filepath.Join(rcsInitDir, s.instanceName()), "stop")
 }
 
+// rcsStopPollInterval is the time between the status checks of Restart.
+var rcsStopPollInterval = 100 * time.Millisecond
+
+// Restart stops the service, waits up to StopTimeout for it to stop, and
+// starts it again.
 func (s *rcs) Restart() error {
 	err := s.Stop()
 	if err != nil {
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
+	timeout := s.Option.duration(optionStopTimeout, optionStopTimeoutDefault)
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := s.Status()
+		if err != nil {
+			return err
+		}
+		if status != StatusRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not stop within %v", s.instanceName(), timeout)
+		}
+		time.Sleep(rcsStopPollInterval)
+	}
 	return s.Start()
 }
 
 const rcsScript = `#!/bin/sh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg){{template "usage" .}}
+{{- range $k, $v := .Labels}}
+# label: {{$k}}={{$v}}
+{{- end}}
 # For RedHat and cousins:
 # chkconfig: - 99 01
 # description: {{.Description}}
 # processname: {{.Path}}
 
 ### BEGIN INIT INFO
-# Provides:          {{.Path}}
-# Required-Start:
-# Required-Stop:
+# Provides:          {{.Name}}
+# Required-Start:{{if .LSBDependencies}}    {{join " " .LSBDependencies}}{{end}}
+# Required-Stop:{{if .LSBDependencies}}     {{join " " .LSBDependencies}}{{end}}
 # Default-Start:     2 3 4 5
 # Default-Stop:      0 1 6
 # Short-Description: {{.DisplayName}}
 # Description:       {{.Description}}
 ### END INIT INFO
+{{- if .ScriptPath}}
 
-cmd="{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}"
+export PATH={{.ScriptPath|cmd}}
+{{- end}}
+{{- if .ScriptLocale}}
+export LANG={{.ScriptLocale|cmd}}
+{{- end}}
+
+cmd="{{if .CPUAffinity}}taskset -c {{.CPUAffinity}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{range .ArgumentsRaw}} {{.|rawcmd}}{{end}}"
 
 name={{.Name}}
-pid_file="/var/run/$name.pid"
+pid_file={{if .PIDFile}}{{.PIDFile|cmd}}{{else}}"/var/run/$name.pid"{{end}}
 stdout_log="{{.LogDirectory}}/$name.log"
 stderr_log="{{.LogDirectory}}/$name.err"
 
@@ -245,15 +496,38 @@ get_pid() {
 is_running() {
     [ -f "$pid_file" ] && cat /proc/$(get_pid)/stat > /dev/null 2>&1
 }
+{{- if .VerifyPID}}
+
+{{template "ownspid" .}}
+{{- end}}
+{{- if .RestartPolicy}}
+
+{{template "supervise" .}}
+{{- end}}
 
 case "$1" in
     start)
+        {{- range .Conditions}}
+        if {{.ShellUnmet}}; then
+            echo "Not starting $name:" {{.ShellValue}} "is not met"
+            exit 0
+        fi
+        {{- end}}
+        {{- if .StartLock}}
+        {{template "startlock" .}}
+        {{- end}}
         if is_running; then
             echo "Already started"
         else
             echo "Starting $name"
-            {{if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
-            $cmd >> "$stdout_log" 2>> "$stderr_log" &
+            {{- if .LimitNOFILEHard}}
+            ulimit -Hn {{.LimitNOFILEHard}} && ulimit -Sn {{.LimitNOFILESoft}} || exit 1
+            {{- end}}
+            {{- if .UMask}}
+            umask {{.UMask}}
+            {{- end}}
+            {{if .WorkingDirectories}}{{template "cd" .}}{{else if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
+            {{if .RestartPolicy}}(supervise){{else}}$cmd{{end}}{{if .StartLock}} 9>&-{{end}} >> "$stdout_log" 2>> "$stderr_log" < /dev/null &
             echo $! > "$pid_file"
             if ! is_running; then
                 echo "Unable to start, see $stdout_log and $stderr_log"
@@ -263,9 +537,15 @@ case "$1" in
     ;;
     stop)
         if is_running; then
+            {{- if .VerifyPID}}
+            if ! owns_pid; then
+                echo "Not stopping $name: pid $(get_pid) runs another program"
+                exit 1
+            fi
+            {{- end}}
             echo -n "Stopping $name.."
             kill $(get_pid)
-            for i in $(seq 1 10)
+            for i in $(seq 1 {{.KillTimeout}})
             do
                 if ! is_running; then
                     break
@@ -274,6 +554,23 @@ case "$1" in
                 sleep 1
             done
             echo
+            {{- if .ForceKill}}
+            if is_running; then
+                echo "Not stopped after {{.KillTimeout}}s, killing $name"
+                pid=$(get_pid)
+                {{- if .RestartPolicy}}
+                # Freeze the supervisor so it cannot start another child meanwhile.
+                kill -STOP "$pid" 2> /dev/null
+                pkill -KILL -P "$pid"
+                {{- end}}
+                kill -9 "$pid" 2> /dev/null
+                sleep 1
+                # Killed but not reaped yet, as under an init that does not reap.
+                if [ "$(sed 's/.*) //; s/ .*//' /proc/$pid/stat 2> /dev/null)" = Z ]; then
+                    rm -f "$pid_file"
+                fi
+            fi
+            {{- end}}
             if is_running; then
                 echo "Not stopped; may still be shutting down or shutdown may have failed"
                 exit 1
@@ -310,3 +607,23 @@ case "$1" in
 esac
 exit 0
 `
+
+// rcsListInstalled lists the services with a start link run by rcS.
+func rcsListInstalled() ([]string, error) {
+	return listStartLinks(rcsLinkDir)
+}
+
+// LoadInstalledConfig recovers the Labels, the executable and the Arguments
+// from the installed init script.
+func (s *rcs) LoadInstalledConfig() (*Config, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return nil, err
+	}
+	c, err := readInstalledConfig(confPath, scriptLabelPrefix, parseScriptLine)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = s.Name
+	return c, nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	// runitSvDir holds the service directories, one per service.
+	runitSvDir = "/etc/sv"
+	// runitServiceDir is scanned by runsvdir; services are enabled by
+	// linking their service directory into it.
+	runitServiceDir = "/var/service"
+)
+
+func isRunit() bool {
+	if _, err := os.Stat("/sbin/runit"); err == nil {
+		return true
+	}
+	if _, err := os.Stat("/etc/runit"); err == nil {
+		return true
+	}
+	return false
+}
+
+type runit struct {
+	i        Interface
+	platform string
+	*Config
+}
+
+func newRunitService(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(c.instanceName()); err != nil {
+		return nil, err
+	}
+	s := &runit{
+		i:        i,
+		platform: platform,
+		Config:   c,
+	}
+
+	return s, nil
+}
+
+func (s *runit) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+func (s *runit) Platform() string {
+	return s.platform
+}
+
+var errNoUserServiceRunit = notSupported("user services on runit")
+
+// serviceDir returns the runit service directory holding the run script.
+func (s *runit) serviceDir() (string, error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceRunit
+	}
+	return filepath.Join(runitSvDir, s.instanceName()), nil
+}
+
+// configPath returns the path of the run script.
+func (s *runit) configPath() (string, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "run"), nil
+}
+
+// linkPath returns the path of the link enabling the service.
+func (s *runit) linkPath() string {
+	return filepath.Join(runitServiceDir, s.instanceName())
+}
+
+func (s *runit) template() *template.Template {
+	customScript := s.Option.string(optionRunitScript, "")
+
+	if customScript != "" {
+		return s.parseScript(customScript)
+	}
+	return s.parseScript(runitScript)
+}
+
+// InstallScript returns the file Install would write, without writing it.
+func (s *runit) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
+}
+
+func (s *runit) Install() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
+	confPath := filepath.Join(dir, "run")
+	_, err = os.Stat(confPath)
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	if err = s.createLogDirectory(); err != nil {
+		return err
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.mkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := rb.writeFile(confPath, 0755, s.writeScript); err != nil {
+			return err
+		}
+		if err := s.smokeTest(confPath); err != nil {
+			return err
+		}
+		if err := s.writeDownFile(rb, dir); err != nil {
+			return err
+		}
+
+		link := s.linkPath()
+		return rb.step(func(context.Context) error {
+			return symlink(dir, link, s.Option.bool(optionOverwrite, optionOverwriteDefault))
+		}, func() {
+			os.Remove(link)
+		})
+	})
+}
+
+// writeScript renders the runit run script for the service to w.
+func (s *runit) writeScript(w io.Writer) error {
+	path, err := s.execPath()
+	if err != nil {
+		return err
+	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+
+	var to = &struct {
+		*Config
+		Name               string
+		Path               string
+		LogDirectory       string
+		ScriptPath         string
+		ScriptLocale       string
+		WorkingDirectories []string
+		ArgumentsRaw       []string
+		UMask              string
+	}{
+		s.Config,
+		s.instanceName(),
+		path,
+		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.Option.string(optionScriptPath, ""),
+		s.Option.string(optionScriptLocale, ""),
+		s.workingDirectories(),
+		s.Option.strings(optionArgumentsRaw, nil),
+		umask,
+	}
+
+	return s.template().Execute(w, to)
+}
+
+func (s *runit) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *runit) uninstall() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	// Removing the link first makes runsvdir stop supervising the service.
+	return removePaths(s.linkPath(), dir)
+}
+
+// ReadLogs returns the tail of the log files the script writes.
+func (s *runit) ReadLogs(lines int) ([]string, error) {
+	return s.readLogFiles(lines, ".log", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *runit) ReadLogsSince(since time.Time) ([]string, error) {
+	return s.readLogFilesSince(since, ".log", ".err")
+}
+
+func (s *runit) Logger(errs chan<- error) (Logger, error) {
+	if s.interactive(system.Interactive()) {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *runit) SystemLogger(errs chan<- error) (Logger, error) {
+	return newSysLogger(s.Config, errs)
+}
+
+func (s *runit) Run() error {
+	return runLoop(s, s.i, s.Config)
+}
+
+func (s *runit) Status() (Status, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return StatusUnknown, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run")); os.IsNotExist(err) {
+		return StatusUnknown, ErrNotInstalled
+	}
+
+	_, out, err := runWithOutput("sv", "status", s.linkPath())
+	switch {
+	case strings.HasPrefix(out, "run:"):
+		return StatusRunning, nil
+	case strings.HasPrefix(out, "down:"), strings.HasPrefix(out, "finish:"):
+		return StatusStopped, nil
+	case err != nil:
+		return StatusUnknown, err
+	default:
+		return StatusUnknown, fmt.Errorf("unexpected sv status output: %q", out)
+	}
+}
+
+// IsEnabled reports whether the service directory is linked for
+// supervision without a down file, so that the supervisor starts it.
+func (s *runit) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	enabled, err := linkEnabled(confPath, s.linkPath())
+	if !enabled || err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(confPath), "down"))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *runit) Start() error {
+	return run("sv", "start", s.linkPath())
+}
+
+func (s *runit) Stop() error {
+	return s.runStop("sv", "stop", s.linkPath())
+}
+
+func (s *runit) Restart() error {
+	return run("sv", "restart", s.linkPath())
+}
+
+// runitScript is run by runsv, which expects it to exec the service
+// in the foreground and supervises it directly.
+const runitScript = `#!/bin/sh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+{{- if .ScriptPath}}
+export PATH={{.ScriptPath|cmd}}
+{{- end}}
+{{- if .ScriptLocale}}
+export LANG={{.ScriptLocale|cmd}}
+{{- end}}
+
+name={{.Name}}
+stdout_log="{{.LogDirectory}}/$name.log"
+stderr_log="{{.LogDirectory}}/$name.err"
+
+{{range $k, $v := .EnvVars -}}
+export {{$k}}={{$v}}
+{{end -}}
+
+[ -e /etc/sysconfig/$name ] && . /etc/sysconfig/$name
+
+{{if .WorkingDirectories}}{{template "cd" .}} || exit 1{{else if .WorkingDirectory}}cd '{{.WorkingDirectory}}' || exit 1{{end}}
+{{if .UMask}}umask {{.UMask}}
+{{end -}}
+exec {{if .UserName}}chpst -u {{.UserName}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{range .ArgumentsRaw}} {{.|rawcmd}}{{end}} >> "$stdout_log" 2>> "$stderr_log"
+`
@@ -0,0 +1,66 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_runitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig := runitSvDir
+	runitSvDir = dir
+	defer func() { runitSvDir = orig }()
+
+	s := &runit{Config: &Config{Name: "app"}}
+	if _, err := s.Status(); err != ErrNotInstalled {
+		t.Fatalf("Status() before install error = %v, want ErrNotInstalled", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app", "run"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		out     string
+		err     error
+		want    Status
+		wantErr bool
+	}{
+		{"running", "run: /var/service/app: (pid 123) 45s\n", nil, StatusRunning, false},
+		{"down", "down: /var/service/app: 3s, normally up\n", errors.New("exit status 3"), StatusStopped, false},
+		{"fail", "fail: /var/service/app: runsv not running\n", errors.New("exit status 1"), StatusUnknown, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+				return 0, tt.out, tt.err
+			})
+			defer restore()
+
+			got, err := s.Status()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Status() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Status() = %v, want %v", got, tt.want)
+			}
+			if (*calls)[0].command != "sv" {
+				t.Errorf("Status() ran %q, want sv", (*calls)[0].command)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	// s6SvDir holds the service definition directories, one per service.
+	s6SvDir = "/etc/s6/sv"
+	// s6ScanDir is the scan directory watched by s6-svscan.
+	s6ScanDir = "/run/service"
+)
+
+func isS6() bool {
+	if fi, err := os.Stat(s6ScanDir); err == nil && fi.IsDir() {
+		return true
+	}
+	comm, err := ioutil.ReadFile("/proc/1/comm")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(comm)) == "s6-svscan"
+}
+
+type s6 struct {
+	i        Interface
+	platform string
+	*Config
+}
+
+func newS6Service(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(c.instanceName()); err != nil {
+		return nil, err
+	}
+	s := &s6{
+		i:        i,
+		platform: platform,
+		Config:   c,
+	}
+
+	return s, nil
+}
+
+func (s *s6) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+func (s *s6) Platform() string {
+	return s.platform
+}
+
+var errNoUserServiceS6 = notSupported("user services on s6")
+
+// serviceDir returns the s6 service definition directory.
+func (s *s6) serviceDir() (string, error) {
+	if s.Option.bool(optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceS6
+	}
+	return filepath.Join(s6SvDir, s.instanceName()), nil
+}
+
+// configPath returns the path of the run script.
+func (s *s6) configPath() (string, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "run"), nil
+}
+
+// linkPath returns the path of the service in the scan directory.
+func (s *s6) linkPath() string {
+	return filepath.Join(s6ScanDir, s.instanceName())
+}
+
+func (s *s6) template() *template.Template {
+	customScript := s.Option.string(optionS6Script, "")
+
+	if customScript != "" {
+		return s.parseScript(customScript)
+	}
+	return s.parseScript(s6RunScript)
+}
+
+// InstallScript returns the file Install would write, without writing it.
+func (s *s6) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
+}
+
+func (s *s6) Install() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
+	confPath := filepath.Join(dir, "run")
+	_, err = os.Stat(confPath)
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	if err = s.createLogDirectory(); err != nil {
+		return err
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.mkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := rb.writeFile(confPath, 0755, s.writeScript); err != nil {
+			return err
+		}
+		err := rb.writeFile(filepath.Join(dir, "finish"), 0755, func(w io.Writer) error {
+			_, err := io.WriteString(w, s6FinishScript)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = rb.writeFile(filepath.Join(dir, "type"), 0644, func(w io.Writer) error {
+			_, err := io.WriteString(w, "longrun\n")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = s.smokeTest(confPath); err != nil {
+			return err
+		}
+		if err = s.writeDownFile(rb, dir); err != nil {
+			return err
+		}
+		link := s.linkPath()
+		err = rb.step(func(context.Context) error {
+			return symlink(dir, link, s.Option.bool(optionOverwrite, optionOverwriteDefault))
+		}, func() {
+			os.Remove(link)
+		})
+		if err != nil {
+			return err
+		}
+		// Make s6-svscan pick up the new service immediately.
+		return rb.step(func(ctx context.Context) error {
+			return runContext(ctx, "s6-svscanctl", "-a", s6ScanDir)
+		}, nil)
+	})
+}
+
+// writeScript renders the s6 run script for the service to w.
+func (s *s6) writeScript(w io.Writer) error {
+	path, err := s.execPath()
+	if err != nil {
+		return err
+	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+
+	var to = &struct {
+		*Config
+		Name               string
+		Path               string
+		LogDirectory       string
+		ScriptPath         string
+		ScriptLocale       string
+		WorkingDirectories []string
+		ArgumentsRaw       []string
+		UMask              string
+	}{
+		s.Config,
+		s.instanceName(),
+		path,
+		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.Option.string(optionScriptPath, ""),
+		s.Option.string(optionScriptLocale, ""),
+		s.workingDirectories(),
+		s.Option.strings(optionArgumentsRaw, nil),
+		umask,
+	}
+
+	return s.template().Execute(w, to)
+}
+
+func (s *s6) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *s6) uninstall() error {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return err
+	}
+	err = removePaths(s.linkPath(), dir)
+	if os.IsNotExist(err) {
+		return err
+	}
+	// Make s6-svscan drop the supervisor of the removed service.
+	return joinErrors(err, run("s6-svscanctl", "-an", s6ScanDir))
+}
+
+// ReadLogs returns the tail of the log files the script writes.
+func (s *s6) ReadLogs(lines int) ([]string, error) {
+	return s.readLogFiles(lines, ".log", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *s6) ReadLogsSince(since time.Time) ([]string, error) {
+	return s.readLogFilesSince(since, ".log", ".err")
+}
+
+func (s *s6) Logger(errs chan<- error) (Logger, error) {
+	if s.interactive(system.Interactive()) {
+		return ConsoleLogger, nil
+	}
+	return s.SystemLogger(errs)
+}
+func (s *s6) SystemLogger(errs chan<- error) (Logger, error) {
+	return newSysLogger(s.Config, errs)
+}
+
+func (s *s6) Run() error {
+	return runLoop(s, s.i, s.Config)
+}
+
+func (s *s6) Status() (Status, error) {
+	dir, err := s.serviceDir()
+	if err != nil {
+		return StatusUnknown, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run")); os.IsNotExist(err) {
+		return StatusUnknown, ErrNotInstalled
+	}
+
+	_, out, err := runWithOutput("s6-svstat", s.linkPath())
+	if err != nil {
+		return StatusUnknown, err
+	}
+
+	switch {
+	case strings.HasPrefix(out, "up"):
+		return StatusRunning, nil
+	case strings.HasPrefix(out, "down"):
+		return StatusStopped, nil
+	default:
+		return StatusUnknown, fmt.Errorf("unexpected s6-svstat output: %q", out)
+	}
+}
+
+// IsEnabled reports whether the service directory is linked for
+// supervision without a down file, so that the supervisor starts it.
+func (s *s6) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	enabled, err := linkEnabled(confPath, s.linkPath())
+	if !enabled || err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(confPath), "down"))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *s6) Start() error {
+	return run("s6-svc", "-u", s.linkPath())
+}
+
+func (s *s6) Stop() error {
+	return s.runStop("s6-svc", "-d", s.linkPath())
+}
+
+func (s *s6) Restart() error {
+	// Sending SIGTERM to a service that is wanted up makes
+	// s6-supervise restart it.
+	return run("s6-svc", "-r", s.linkPath())
+}
+
+// s6RunScript is run by s6-supervise, which expects it to exec the
+// service in the foreground.
+const s6RunScript = `#!/bin/sh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+{{- if .ScriptPath}}
+export PATH={{.ScriptPath|cmd}}
+{{- end}}
+{{- if .ScriptLocale}}
+export LANG={{.ScriptLocale|cmd}}
+{{- end}}
+
+name={{.Name}}
+stdout_log="{{.LogDirectory}}/$name.log"
+stderr_log="{{.LogDirectory}}/$name.err"
+
+{{range $k, $v := .EnvVars -}}
+export {{$k}}={{$v}}
+{{end -}}
+
+[ -e /etc/sysconfig/$name ] && . /etc/sysconfig/$name
+
+{{if .WorkingDirectories}}{{template "cd" .}} || exit 1{{else if .WorkingDirectory}}cd '{{.WorkingDirectory}}' || exit 1{{end}}
+{{if .UMask}}umask {{.UMask}}
+{{end -}}
+exec {{if .UserName}}s6-setuidgid {{.UserName}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{range .ArgumentsRaw}} {{.|rawcmd}}{{end}} >> "$stdout_log" 2>> "$stderr_log"
+`
+
+// s6FinishScript runs after the service exits with the exit code and
+// signal number as arguments. Returning lets s6-supervise restart it.
+const s6FinishScript = `#!/bin/sh
+exit 0
+`
@@ -0,0 +1,167 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_s6InstallUninstall(t *testing.T) {
+	svDir, err := ioutil.TempDir("", "s6sv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(svDir)
+	scanDir, err := ioutil.TempDir("", "s6scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scanDir)
+	origSv, origScan := s6SvDir, s6ScanDir
+	s6SvDir, s6ScanDir = svDir, scanDir
+	defer func() { s6SvDir, s6ScanDir = origSv, origScan }()
+
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "up (pid 42) 3 seconds\n", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	s := &s6{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"run", "finish", "type"} {
+		if _, err := os.Stat(filepath.Join(svDir, "app", f)); err != nil {
+			t.Errorf("Install() did not create %s: %v", f, err)
+		}
+	}
+	if typ, _ := ioutil.ReadFile(filepath.Join(svDir, "app", "type")); string(typ) != "longrun\n" {
+		t.Errorf("type = %q, want longrun", typ)
+	}
+	if st, err := s.Status(); err != nil || st != StatusRunning {
+		t.Errorf("Status() = %v, %v, want running", st, err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(scanDir, "app")); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() left scan directory link: %v", err)
+	}
+
+	link := filepath.Join(scanDir, "app")
+	want := []fakeCommand{
+		{"s6-svscanctl", []string{"-a", scanDir}},
+		{"s6-svstat", []string{link}},
+		{"s6-svc", []string{"-u", link}},
+		{"s6-svc", []string{"-d", link}},
+		{"s6-svscanctl", []string{"-an", scanDir}},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("commands = %v, want %v", *calls, want)
+	}
+}
+
+func Test_s6StartAtBoot(t *testing.T) {
+	svDir, err := ioutil.TempDir("", "s6sv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(svDir)
+	scanDir, err := ioutil.TempDir("", "s6scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scanDir)
+	origSv, origScan := s6SvDir, s6ScanDir
+	s6SvDir, s6ScanDir = svDir, scanDir
+	defer func() { s6SvDir, s6ScanDir = origSv, origScan }()
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	down := filepath.Join(svDir, "app", "down")
+	for _, startAtBoot := range []bool{false, true} {
+		startAtBoot := startAtBoot
+		s := &s6{Config: &Config{Name: "app", Executable: "/usr/bin/app", StartAtBoot: &startAtBoot, Option: KeyValue{
+			optionOverwrite: true,
+		}}}
+		if err := s.Install(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(down); (err == nil) == startAtBoot {
+			t.Errorf("Install() with StartAtBoot %v: down file exists = %v", startAtBoot, err == nil)
+		}
+		if enabled, err := IsEnabled(s); err != nil || enabled != startAtBoot {
+			t.Errorf("IsEnabled() with StartAtBoot %v = %v, %v", startAtBoot, enabled, err)
+		}
+	}
+}
+
+func Test_s6InstallRollback(t *testing.T) {
+	svDir, err := ioutil.TempDir("", "s6sv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(svDir)
+	scanDir, err := ioutil.TempDir("", "s6scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scanDir)
+	origSv, origScan := s6SvDir, s6ScanDir
+	s6SvDir, s6ScanDir = svDir, scanDir
+	defer func() { s6SvDir, s6ScanDir = origSv, origScan }()
+	_, restore := setFakeRunner(func(_ string, arguments ...string) (int, string, error) {
+		if arguments[0] == "-a" {
+			return 1, "", errors.New("s6-svscanctl: fatal: unable to control")
+		}
+		// The operator presses Ctrl-C while Uninstall runs.
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		time.Sleep(50 * time.Millisecond)
+		return 0, "", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	s := &s6{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}
+	if err := s.Install(); err == nil {
+		t.Fatal("Install() succeeded although s6-svscanctl failed")
+	}
+	if _, err := os.Lstat(filepath.Join(svDir, "app")); !os.IsNotExist(err) {
+		t.Errorf("failed Install() left the service directory: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(scanDir, "app")); !os.IsNotExist(err) {
+		t.Errorf("failed Install() left the scan directory link: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(svDir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(svDir, "app"), filepath.Join(scanDir, "app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Uninstall(); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("Uninstall() = %v, want ErrInterrupted", err)
+	}
+	if _, err := os.Lstat(filepath.Join(scanDir, "app")); !os.IsNotExist(err) {
+		t.Errorf("interrupted Uninstall() left the scan directory link: %v", err)
+	}
+}
@@ -9,9 +9,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
-	"os/signal"
 	"regexp"
-	"syscall"
 	"text/template"
 	"time"
 )
@@ -32,6 +30,9 @@ func (solarisSystem) Interactive() bool {
 	return interactive
 }
 func (solarisSystem) New(i Interface, c *Config) (Service, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 	s := &solarisService{
 		i:      i,
 		Config: c,
@@ -113,7 +114,7 @@ func (s *solarisService) Install() error {
 		return err
 	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Manifest already exists: %s", confPath)
 	}
 
@@ -215,33 +216,21 @@ func (s *solarisService) Restart() error {
 }
 
 func (s *solarisService) Run() error {
-	var err error
-
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *solarisService) Logger(errs chan<- error) (Logger, error) {
-	if interactive {
+	if s.interactive(interactive) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *solarisService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
 var manifest = `<?xml version="1.0"?>
+<!-- Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg) -->
 <!DOCTYPE service_bundle SYSTEM "/usr/share/lib/xml/dtd/service_bundle.dtd.1">
 
 <service_bundle type='manifest' name='golang-{{.Name}}'>
@@ -6,17 +6,22 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 func isSystemd() bool {
@@ -44,6 +49,21 @@ func isSystemd() bool {
 	return false
 }
 
+// systemdUnitDir is the directory system units are installed into.
+var systemdUnitDir = "/etc/systemd/system"
+
+// systemdUnitSearchDirs lists the other directories systemd loads system
+// units from, where packages and administrators may have placed a unit.
+var systemdUnitSearchDirs = []string{
+	"/run/systemd/system",
+	"/usr/local/lib/systemd/system",
+	"/usr/lib/systemd/system",
+	"/lib/systemd/system",
+}
+
+// systemdCgroupRoot is where the cgroup v2 hierarchy is mounted.
+var systemdCgroupRoot = "/sys/fs/cgroup"
+
 type systemd struct {
 	i        Interface
 	platform string
@@ -56,10 +76,33 @@ func newSystemdService(i Interface, platform string, c *Config) (Service, error)
 		platform: platform,
 		Config:   c,
 	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
 
 	return s, nil
 }
 
+// validate checks that the name and instance of the service form a valid
+// unit name.
+func (s *systemd) validate() error {
+	if err := s.Config.Validate(); err != nil {
+		return err
+	}
+	valid := func(r rune) bool {
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(`:_.\-`, r))
+	}
+	for _, name := range []string{s.Name, s.instance()} {
+		if bad := invalidNameChars(name, valid); bad != "" {
+			return fmt.Errorf("invalid service name %q: systemd unit names may not contain %s", name, bad)
+		}
+	}
+	if !isUnitName(s.unitName()) {
+		return fmt.Errorf("invalid service name %q: %s is not a valid systemd unit name", s.Name, s.unitName())
+	}
+	return nil
+}
+
 func (s *systemd) String() string {
 	if len(s.DisplayName) > 0 {
 		return s.DisplayName
@@ -71,25 +114,74 @@ func (s *systemd) Platform() string {
 	return s.platform
 }
 
+// optionCapabilities reports the options systemd honors.
+func (s *systemd) optionCapabilities() Capabilities {
+	return Capabilities{UserService: true, RestartPolicy: true, ResourceLimits: true, TasksMax: true}
+}
+
 func (s *systemd) configPath() (cp string, err error) {
 	if !s.isUserService() {
-		cp = "/etc/systemd/system/" + s.unitName()
+		cp = filepath.Join(systemdUnitDir, s.unitFileName())
 		return
 	}
-	homeDir, err := os.UserHomeDir()
+	userDir, err := systemdUserDir()
 	if err != nil {
 		return
 	}
-	systemdUserDir := filepath.Join(homeDir, ".config/systemd/user")
-	err = os.MkdirAll(systemdUserDir, os.ModePerm)
+	err = os.MkdirAll(userDir, os.ModePerm)
 	if err != nil {
 		return
 	}
-	cp = filepath.Join(systemdUserDir, s.unitName())
+	cp = filepath.Join(userDir, s.unitFileName())
 	return
 }
 
+// systemdUserDir returns the directory of the user units of the current
+// user: $XDG_CONFIG_HOME/systemd/user, by default under ~/.config.
+func systemdUserDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".config", "systemd", "user"), nil
+}
+
+// errNoUserBus is returned when installing a user service while the
+// systemd instance of the user cannot be reached.
+var errNoUserBus = errors.New("no session bus to reach the systemd user instance: log in to a user session or enable lingering with loginctl enable-linger")
+
+// hasUserBus reports whether systemctl --user can reach the systemd
+// instance of the current user. Tests replace it.
+var hasUserBus = func() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		return true
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+	}
+	_, err := os.Stat(filepath.Join(runtimeDir, "bus"))
+	return err == nil
+}
+
+// unitName returns the unit to control: name.service, or
+// name@instance.service when the Instance option is set.
 func (s *systemd) unitName() string {
+	if instance := s.instance(); instance != "" {
+		return s.Config.Name + "@" + instance + ".service"
+	}
+	return s.Config.Name + ".service"
+}
+
+// unitFileName returns the name of the unit file. All instances share
+// the template unit name@.service.
+func (s *systemd) unitFileName() string {
+	if s.instance() != "" {
+		return s.Config.Name + "@.service"
+	}
 	return s.Config.Name + ".service"
 }
 
@@ -113,6 +205,10 @@ func (s *systemd) getSystemdVersion() int64 {
 	return v
 }
 
+func (s *systemd) systemVersion() string {
+	return strconv.FormatInt(s.getSystemdVersion(), 10)
+}
+
 func (s *systemd) hasOutputFileSupport() bool {
 	defaultValue := true
 	version := s.getSystemdVersion()
@@ -131,111 +227,510 @@ func (s *systemd) template() *template.Template {
 	customScript := s.Option.string(optionSystemdScript, "")
 
 	if customScript != "" {
-		return template.Must(template.New("").Funcs(tf).Parse(customScript))
+		return template.Must(template.New("").Funcs(s.funcs()).Parse(customScript))
 	}
-	return template.Must(template.New("").Funcs(tf).Parse(systemdScript))
+	return template.Must(template.New("").Funcs(s.funcs()).Parse(systemdScript))
 }
 
 func (s *systemd) isUserService() bool {
 	return s.Option.bool(optionUserService, optionUserServiceDefault)
 }
 
+// InstallScript returns the file Install would write, without writing it.
+func (s *systemd) InstallScript() (string, error) {
+	if s.Option.bool(optionDropInOnly, optionDropInOnlyDefault) {
+		return renderScript(s.writeDropIn)
+	}
+	return renderScript(s.writeUnit)
+}
+
+// dropInPath returns the path of the drop-in written with DropInOnly.
+func (s *systemd) dropInPath() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cp+".d", "override.conf"), nil
+}
+
+// installDropIn writes the drop-in of the service, replacing an earlier
+// one, and reloads systemd. The unit itself is left alone.
+func (s *systemd) installDropIn() error {
+	p, err := s.dropInPath()
+	if err != nil {
+		return err
+	}
+	if err = checkWritable(p); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.mkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := rb.writeFile(p, 0644, s.writeDropIn); err != nil {
+			return err
+		}
+		if err := s.smokeTest(""); err != nil {
+			return err
+		}
+		return rb.step(func(ctx context.Context) error {
+			return s.daemonReload(ctx)
+		}, nil)
+	})
+}
+
+// writeDropIn renders the drop-in for the service to w. It only holds
+// the directives whose options are set. ExecStart is cleared before it is
+// set, as systemd otherwise adds a second command to the unit.
+func (s *systemd) writeDropIn(w io.Writer) error {
+	tasksMax, err := s.tasksMax()
+	if err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+	limitNOFILE, err := s.limitNOFILEValue()
+	if err != nil {
+		return err
+	}
+	extra, err := s.extraLines(optionSystemdExtra)
+	if err != nil {
+		return err
+	}
+	timeoutStopSec, err := s.timeoutStopSec()
+	if err != nil {
+		return err
+	}
+	execStart, err := s.execStart()
+	if err != nil {
+		return err
+	}
+	conditions, err := s.startConditions()
+	if err != nil {
+		return err
+	}
+
+	var to = &struct {
+		*Config
+		Conditions     []startCondition
+		ExecStart      string
+		LimitNOFILE    string
+		TasksMax       string
+		UMask          string
+		RuntimeMaxSec  string
+		TimeoutStopSec string
+		Restart        string
+		Extra          []string
+	}{
+		s.Config,
+		conditions,
+		execStart,
+		limitNOFILE,
+		tasksMax,
+		umask,
+		systemdSeconds(s.Option.duration(optionRuntimeMaxSec, 0)),
+		timeoutStopSec,
+		s.restartPolicy(""),
+		extra,
+	}
+
+	return template.Must(template.New("").Funcs(s.funcs()).Parse(systemdDropInScript)).Execute(w, to)
+}
+
+// execStart returns the ExecStart option, which replaces the command line
+// of the unit.
+func (s *systemd) execStart() (string, error) {
+	execStart := s.Option.string(optionExecStart, "")
+	if strings.ContainsAny(execStart, "\r\n") {
+		return "", fmt.Errorf("invalid %s %q: must be a single line", optionExecStart, execStart)
+	}
+	return execStart, nil
+}
+
+// journalFieldRegexp matches the name of a journal field.
+var journalFieldRegexp = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// LogsFiltered writes the journal entries of the service matching every
+// filter to out. Each filter becomes a FIELD=value match of journalctl.
+func (s *systemd) LogsFiltered(ctx context.Context, filters map[string]string, out io.Writer) error {
+	args := []string{"--no-pager", "--unit=" + s.unitName()}
+	if s.isUserService() {
+		args = []string{"--no-pager", "--user-unit=" + s.unitName()}
+	}
+	fields := make([]string, 0, len(filters))
+	for field := range filters {
+		if !journalFieldRegexp.MatchString(field) {
+			return fmt.Errorf("invalid journal field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		args = append(args, field+"="+filters[field])
+	}
+
+	_, stdout, stderr, err := runCommand(ctx, "journalctl", true, args...)
+	if err != nil {
+		return fmt.Errorf("journalctl failed: %v: %s", err, strings.TrimSpace(stderr))
+	}
+	_, err = io.WriteString(out, stdout)
+	return err
+}
+
 func (s *systemd) Install() error {
+	if s.Option.bool(optionTransient, optionTransientDefault) {
+		// Transient units only exist while running, Start creates them.
+		return nil
+	}
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
+	if s.isUserService() && !hasUserBus() {
+		return errNoUserBus
+	}
+	if s.Option.bool(optionDropInOnly, optionDropInOnlyDefault) {
+		return s.installDropIn()
+	}
+	overwrite := s.Option.bool(optionOverwrite, optionOverwriteDefault)
 	_, err = os.Stat(confPath)
-	if err == nil {
+	exists := err == nil
+	// Instances share the template unit, so finding it only means
+	// another instance was installed first.
+	if exists && !overwrite && s.instance() == "" {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
-
-	f, err := os.OpenFile(confPath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
+	if !exists && !overwrite && s.Option.bool(optionFailIfExists, optionFailIfExistsDefault) {
+		if err = s.checkExisting(); err != nil {
+			return err
+		}
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
 		return err
 	}
-	defer f.Close()
 
+	return guardInstall(func(rb *installRollback) error {
+		written := ""
+		if !exists || overwrite {
+			if err := rb.writeFile(confPath, 0644, s.writeUnit); err != nil {
+				return err
+			}
+			written = confPath
+		}
+		if err := s.smokeTest(written); err != nil {
+			return err
+		}
+		if s.startAtBoot() {
+			err := rb.step(func(ctx context.Context) error {
+				return s.runContext(ctx, "enable", s.unitName())
+			}, func() {
+				s.runAction("disable")
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return rb.step(func(ctx context.Context) error {
+			return s.daemonReload(ctx)
+		}, nil)
+	})
+}
+
+// checkExisting reports a system unit of the same name in any directory
+// systemd loads units from, so Install does not shadow it.
+func (s *systemd) checkExisting() error {
+	if s.isUserService() {
+		return nil
+	}
+	for _, dir := range systemdUnitSearchDirs {
+		p := filepath.Join(dir, s.unitFileName())
+		if _, err := os.Lstat(p); err == nil {
+			return fmt.Errorf("%w: %s", ErrServiceExists, p)
+		}
+	}
+	return nil
+}
+
+// writeUnit renders the unit file for the service to w.
+func (s *systemd) writeUnit(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
+	cpuAffinity, err := s.cpuAffinity()
+	if err != nil {
+		return err
+	}
+	if err = s.checkLabels(); err != nil {
+		return err
+	}
+	tasksMax, err := s.tasksMax()
+	if err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+	limitNOFILE, err := s.limitNOFILEValue()
+	if err != nil {
+		return err
+	}
+	pidFile, err := s.pidFile("")
+	if err != nil {
+		return err
+	}
+	runtimeMaxSec := s.Option.duration(optionRuntimeMaxSec, 0)
+	if _, found := s.Option[optionRuntimeMaxSec]; found && runtimeMaxSec <= 0 {
+		return fmt.Errorf("invalid %s %v: must be a positive duration", optionRuntimeMaxSec, s.Option[optionRuntimeMaxSec])
+	}
+	joinsNamespaceOf := s.Option.strings(optionJoinsNamespaceOf, nil)
+	for _, unit := range joinsNamespaceOf {
+		if !isUnitName(unit) {
+			return fmt.Errorf("invalid %s entry %q: not a systemd unit name", optionJoinsNamespaceOf, unit)
+		}
+	}
+	workingDirectory, err := s.workingDirectory()
+	if err != nil {
+		return err
+	}
+	// Stopping happens in the reverse of start order, so stopping before
+	// a unit means starting after it.
+	after, err := stopOrderUnits(s.Option, optionStopBefore)
+	if err != nil {
+		return err
+	}
+	before, err := stopOrderUnits(s.Option, optionStopAfter)
+	if err != nil {
+		return err
+	}
+	extra, err := s.extraLines(optionSystemdExtra)
+	if err != nil {
+		return err
+	}
+	execStart, err := s.execStart()
+	if err != nil {
+		return err
+	}
+	timeoutStopSec, err := s.timeoutStopSec()
+	if err != nil {
+		return err
+	}
+	conditions, err := s.startConditions()
+	if err != nil {
+		return err
+	}
 
 	var to = &struct {
 		*Config
 		Path                 string
+		ExecStart            string
+		WorkingDirectory     string
+		JoinsNamespaceOf     []string
+		After                []string
+		Before               []string
 		HasOutputFileSupport bool
 		ReloadSignal         string
 		PIDFile              string
-		LimitNOFILE          int
+		LimitNOFILE          string
+		TasksMax             string
+		UMask                string
+		CPUAffinity          string
+		RuntimeMaxSec        string
+		TimeoutStopSec       string
 		Restart              string
 		SuccessExitStatus    string
 		LogOutput            bool
 		LogDirectory         string
+		Description          string
+		UserService          bool
+		Conditions           []startCondition
+		Extra                []string
 	}{
 		s.Config,
 		path,
+		execStart,
+		workingDirectory,
+		joinsNamespaceOf,
+		after,
+		before,
 		s.hasOutputFileSupport(),
 		s.Option.string(optionReloadSignal, ""),
-		s.Option.string(optionPIDFile, ""),
-		s.Option.int(optionLimitNOFILE, optionLimitNOFILEDefault),
-		s.Option.string(optionRestart, "always"),
+		pidFile,
+		limitNOFILE,
+		tasksMax,
+		umask,
+		cpuAffinity,
+		systemdSeconds(runtimeMaxSec),
+		timeoutStopSec,
+		s.restartPolicy("always"),
 		s.Option.string(optionSuccessExitStatus, ""),
 		s.Option.bool(optionLogOutput, optionLogOutputDefault),
 		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.description(),
+		s.isUserService(),
+		conditions,
+		extra,
 	}
 
-	err = s.template().Execute(f, to)
-	if err != nil {
+	if s.Option.string(optionSystemdScript, "") == "" {
+		return s.template().Execute(w, to)
+	}
+	// A custom unit gets the header too, as it marks the units Install
+	// wrote for StatusAll and ListInstalled.
+	var buf bytes.Buffer
+	if err = s.template().Execute(&buf, to); err != nil {
 		return err
 	}
+	if !isGeneratedHeader(strings.SplitN(buf.String(), "\n", 2)[0]) {
+		if _, err = io.WriteString(w, s.generatedHeader()); err != nil {
+			return err
+		}
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
 
-	err = s.runAction("enable")
-	if err != nil {
-		return err
+// timeoutStopSec returns the TimeoutStopSec= value for the ForceKill and
+// KillTimeout options, or "" to keep the default of systemd. Either way
+// systemd sends SIGKILL to a service still running after the timeout.
+func (s *systemd) timeoutStopSec() (string, error) {
+	d, force, err := s.killTimeout()
+	if err != nil || !force {
+		return "", err
 	}
+	return systemdSeconds(d), nil
+}
 
-	return s.run("daemon-reload")
+// systemdSeconds formats d as a number of seconds, possibly fractional,
+// as accepted by systemd time span settings. It returns an empty string
+// for durations that are not positive.
+func systemdSeconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
 }
 
+// unitNameRegexp matches a full systemd unit name, such as "foo@bar.service".
+var unitNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9:_.\\@-]+\.(service|socket|device|mount|automount|swap|target|path|timer|slice|scope)$`)
+
+// stopOrderUnits returns the services listed in the named stop order
+// option as unit names. Names without a unit type are services.
+func stopOrderUnits(kv KeyValue, name string) ([]string, error) {
+	var units []string
+	for _, unit := range kv.strings(name, nil) {
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		if !isUnitName(unit) {
+			return nil, fmt.Errorf("invalid %s entry %q: not a systemd unit name", name, unit)
+		}
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+// isUnitName reports whether name is a valid systemd unit name.
+func isUnitName(name string) bool {
+	return len(name) <= 255 && unitNameRegexp.MatchString(name)
+}
+
+// limitNOFILEValue returns the LimitNOFILE value of the unit, either a
+// single limit or "soft:hard", or an empty string if it is not set.
+func (s *systemd) limitNOFILEValue() (string, error) {
+	soft, hard, err := s.limitNOFILE()
+	if err != nil || soft == hard {
+		return soft, err
+	}
+	return soft + ":" + hard, nil
+}
+
+// Uninstall disables the service and removes its unit file. For an
+// instance the template shared by all instances is kept while another
+// instance is enabled; instances that are running keep running until
+// stopped.
 func (s *systemd) Uninstall() error {
-	err := s.runAction("disable")
-	if err != nil {
-		return err
+	return guardUninstall(s.uninstall)
+}
+
+func (s *systemd) uninstall() error {
+	if s.Option.bool(optionTransient, optionTransientDefault) {
+		return nil
+	}
+	// Every step is attempted, so that a unit already partly removed is
+	// cleaned up and systemd forgets it.
+	if s.Option.bool(optionDropInOnly, optionDropInOnlyDefault) {
+		p, err := s.dropInPath()
+		if err != nil {
+			return err
+		}
+		err = removePaths(p)
+		// Keep the directory if it holds other drop-ins.
+		os.Remove(filepath.Dir(p))
+		return joinErrors(err, s.daemonReload(context.Background()))
 	}
 	cp, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
-		return err
+	disableErr := s.runAction("disable")
+	if inUse, err := s.templateInUse(cp); err != nil || inUse {
+		return joinErrors(disableErr, err)
+	}
+	return joinErrors(disableErr, removePaths(cp), s.daemonReload(context.Background()))
+}
+
+// templateInUse reports whether an instance other than this one is
+// enabled from the template unit at cp, so that uninstalling this
+// instance must keep the template.
+func (s *systemd) templateInUse(cp string) (bool, error) {
+	if s.instance() == "" {
+		return false, nil
 	}
-	return s.run("daemon-reload")
+	links, err := filepath.Glob(filepath.Join(filepath.Dir(cp), "*.wants", s.Name+"@*.service"))
+	if err != nil {
+		return false, err
+	}
+	for _, link := range links {
+		if filepath.Base(link) != s.unitName() {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (s *systemd) Logger(errs chan<- error) (Logger, error) {
-	if system.Interactive() {
+	if s.interactive(system.Interactive()) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *systemd) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
-func (s *systemd) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+func (s *systemd) Run() error {
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *systemd) Status() (Status, error) {
@@ -245,11 +740,11 @@ func (s *systemd) Status() (Status, error) {
 	}
 
 	switch {
-	case strings.HasPrefix(out, "active"):
+	case strings.HasPrefix(out, "active"), strings.HasPrefix(out, "reloading"):
 		return StatusRunning, nil
 	case strings.HasPrefix(out, "inactive"):
 		// inactive can also mean its not installed, check unit files
-		exitCode, out, err := s.runWithOutput("systemctl", "list-unit-files", "-t", "service", s.unitName())
+		exitCode, out, err := s.runWithOutput("systemctl", "list-unit-files", "-t", "service", s.unitFileName())
 		if exitCode == 0 && err != nil {
 			return StatusUnknown, err
 		}
@@ -260,7 +755,9 @@ func (s *systemd) Status() (Status, error) {
 		// no unit file
 		return StatusUnknown, ErrNotInstalled
 	case strings.HasPrefix(out, "activating"):
-		return StatusRunning, nil
+		return StatusStarting, nil
+	case strings.HasPrefix(out, "deactivating"):
+		return StatusStopping, nil
 	case strings.HasPrefix(out, "failed"):
 		return StatusUnknown, errors.New("service in failed state")
 	default:
@@ -268,11 +765,435 @@ func (s *systemd) Status() (Status, error) {
 	}
 }
 
+// systemdGeneratedUnits returns the service units Install wrote in
+// systemdUnitDir: the units whose file it wrote, the enabled instances of
+// the templates it wrote, and the units it wrote a DropInOnly drop-in for,
+// wherever their unit file lives.
+func systemdGeneratedUnits() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(systemdUnitDir, "*.service"))
+	if err != nil {
+		return nil, err
+	}
+	dropIns, err := filepath.Glob(filepath.Join(systemdUnitDir, "*.service.d", "override.conf"))
+	if err != nil {
+		return nil, err
+	}
+	var units []string
+	seen := make(map[string]bool)
+	add := func(unit string) {
+		if !seen[unit] && !strings.HasSuffix(unit, "@.service") {
+			seen[unit] = true
+			units = append(units, unit)
+		}
+	}
+	for _, p := range paths {
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() || !generatedByPackage(p) {
+			// Skip aliases, units linked from elsewhere and units
+			// written by hand.
+			continue
+		}
+		unit := filepath.Base(p)
+		if !strings.HasSuffix(unit, "@.service") {
+			add(unit)
+			continue
+		}
+		// Templates have no status of their own, their instances do.
+		pattern := strings.TrimSuffix(unit, "@.service") + "@*.service"
+		instances, err := filepath.Glob(filepath.Join(systemdUnitDir, "*.wants", pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			add(filepath.Base(instance))
+		}
+	}
+	for _, p := range dropIns {
+		if generatedByPackage(p) {
+			add(strings.TrimSuffix(filepath.Base(filepath.Dir(p)), ".d"))
+		}
+	}
+	sort.Strings(units)
+	return units, nil
+}
+
+// systemdStatusAll reports the status of every unit file Install wrote in
+// systemdUnitDir using a single "systemctl show" call.
+func systemdStatusAll() (map[string]StatusDetails, error) {
+	units, err := systemdGeneratedUnits()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]StatusDetails, len(units))
+	if len(units) == 0 {
+		return statuses, nil
+	}
+
+	args := append([]string{"show", "--property=Id,ActiveState,SubState,MainPID"}, units...)
+	_, out, err := runWithOutput("systemctl", args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range strings.Split(out, "\n\n") {
+		props := parseSystemdProperties(block)
+		id := props["Id"]
+		if id == "" {
+			continue
+		}
+		name := strings.TrimSuffix(id, ".service")
+		pid, _ := strconv.Atoi(props["MainPID"])
+		statuses[name] = StatusDetails{
+			Name:   name,
+			Status: systemdActiveStatus(props["ActiveState"]),
+			PID:    pid,
+			State:  props["ActiveState"] + "/" + props["SubState"],
+		}
+	}
+	return statuses, nil
+}
+
+// parseSystemdProperties parses the "Key=Value" lines printed by
+// "systemctl show" for a single unit.
+func parseSystemdProperties(out string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		props[kv[0]] = kv[1]
+	}
+	return props
+}
+
+// CgroupPath returns the cgroup of the unit, asked from systemd, which
+// knows it while the unit runs. The slice depends on the unit: instances
+// live in the slice of their template, user units in one that varies
+// with the systemd version, and Slice= in SystemdExtra moves any unit.
+func (s *systemd) CgroupPath() (string, error) {
+	_, out, err := s.runWithOutput("systemctl", "show", "--property=ControlGroup", "--value", s.unitName())
+	if err != nil {
+		return "", err
+	}
+	cgroup := strings.TrimSpace(out)
+	if cgroup == "" {
+		return "", fmt.Errorf("%s has no cgroup, it is not running", s.unitName())
+	}
+	return filepath.Join(systemdCgroupRoot, cgroup), nil
+}
+
+// ReadLogs returns the last journal entries of the unit, or the tail of
+// the log files with the LogOutput option.
+func (s *systemd) ReadLogs(lines int) ([]string, error) {
+	if s.Option.bool(optionLogOutput, optionLogOutputDefault) {
+		return s.readLogFiles(lines, ".out", ".err")
+	}
+	unit := "--unit=" + s.unitName()
+	if s.isUserService() {
+		unit = "--user-unit=" + s.unitName()
+	}
+	_, out, err := runWithOutput("journalctl", unit, "-n", strconv.Itoa(lines), "--no-pager", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+	out = strings.TrimRight(out, "\n")
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// ReadLogsSince returns the journal entries of the unit from since on,
+// or the timestamped lines of its log files with LogOutput.
+func (s *systemd) ReadLogsSince(since time.Time) ([]string, error) {
+	if s.Option.bool(optionLogOutput, optionLogOutputDefault) {
+		return s.readLogFilesSince(since, ".out", ".err")
+	}
+	unit := "--unit=" + s.unitName()
+	if s.isUserService() {
+		unit = "--user-unit=" + s.unitName()
+	}
+	_, out, err := runWithOutput("journalctl", unit, "--since=@"+strconv.FormatInt(since.Unix(), 10), "--no-pager", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+	out = strings.TrimRight(out, "\n")
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// Diff compares the directives of the installed unit file with the unit
+// desired would install.
+func (s *systemd) Diff(desired *Config) ([]string, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return nil, err
+	}
+	installed, err := ioutil.ReadFile(confPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotInstalled
+	}
+	if err != nil {
+		return nil, err
+	}
+	want, err := renderScript((&systemd{i: s.i, platform: s.platform, Config: desired}).writeUnit)
+	if err != nil {
+		return nil, err
+	}
+	return diffDirectives(parseUnitDirectives(string(installed)), parseUnitDirectives(want)), nil
+}
+
+// parseUnitDirectives returns the values of the directives in a unit
+// file by name. Values of a repeated directive are joined with ", ".
+func parseUnitDirectives(unit string) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range strings.Split(unit, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if prev, found := directives[key]; found {
+			value = prev + ", " + value
+		}
+		directives[key] = value
+	}
+	return directives
+}
+
+// diffDirectives returns "key: old -> new" for every directive whose
+// value differs, sorted by key.
+func diffDirectives(installed, desired map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range installed {
+		keys[k] = true
+	}
+	for k := range desired {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	show := func(m map[string]string, k string) string {
+		if v, found := m[k]; found {
+			return v
+		}
+		return "(unset)"
+	}
+	var lines []string
+	for _, k := range sorted {
+		if was, want := show(installed, k), show(desired, k); was != want {
+			lines = append(lines, k+": "+was+" -> "+want)
+		}
+	}
+	return lines
+}
+
+// systemdActiveStatus maps a systemd ActiveState to a Status.
+func systemdActiveStatus(state string) Status {
+	switch state {
+	case "active", "reloading":
+		return StatusRunning
+	case "inactive", "failed":
+		return StatusStopped
+	case "activating":
+		return StatusStarting
+	case "deactivating":
+		return StatusStopping
+	default:
+		return StatusUnknown
+	}
+}
+
+// StatusEx returns the detailed status of the unit, including the
+// activating and deactivating transitional states.
+func (s *systemd) StatusEx() (StatusDetails, error) {
+	_, out, err := s.runWithOutput("systemctl", "show", "--property=Id,LoadState,ActiveState,SubState,MainPID", s.unitName())
+	if err != nil {
+		return StatusDetails{Name: s.Name}, err
+	}
+	props := parseSystemdProperties(out)
+	if props["LoadState"] == "not-found" {
+		return StatusDetails{Name: s.Name}, ErrNotInstalled
+	}
+	pid, _ := strconv.Atoi(props["MainPID"])
+	return StatusDetails{
+		Name:   s.Name,
+		Status: systemdActiveStatus(props["ActiveState"]),
+		PID:    pid,
+		State:  props["ActiveState"] + "/" + props["SubState"],
+	}, nil
+}
+
+// RestartHistory returns the automatic restarts systemd counts for the
+// unit, NRestarts, and the time it last became active.
+func (s *systemd) RestartHistory() (int, time.Time, error) {
+	_, out, err := s.runWithOutput("systemctl", "show", "--property=LoadState,NRestarts,ActiveEnterTimestamp", s.unitName())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	props := parseSystemdProperties(out)
+	if props["LoadState"] == "not-found" {
+		return 0, time.Time{}, ErrNotInstalled
+	}
+	// systemd before 235 does not count restarts.
+	if props["NRestarts"] == "" {
+		return 0, time.Time{}, notSupported("RestartHistory on " + s.Platform() + " before 235")
+	}
+	count, err := strconv.Atoi(props["NRestarts"])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid NRestarts %q", props["NRestarts"])
+	}
+	if count == 0 {
+		return 0, time.Time{}, nil
+	}
+	last, err := time.ParseInLocation("Mon 2006-01-02 15:04:05 MST", props["ActiveEnterTimestamp"], time.Local)
+	if err != nil {
+		return count, time.Time{}, nil
+	}
+	return count, last, nil
+}
+
+// IsEnabled reports whether systemctl is-enabled finds the unit enabled.
+// Units that are static, linked or masked are not started at boot.
+func (s *systemd) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	if _, err = os.Stat(confPath); os.IsNotExist(err) {
+		return false, ErrNotInstalled
+	}
+	// is-enabled exits 1 for a unit that is not enabled, still printing
+	// its state.
+	_, out, err := s.runWithOutput("systemctl", "is-enabled", s.unitName())
+	switch state := strings.TrimSpace(out); state {
+	case "enabled", "enabled-runtime", "alias", "generated":
+		return true, nil
+	case "":
+		if err == nil {
+			err = errors.New("systemctl is-enabled printed no state")
+		}
+		return false, err
+	default:
+		return false, nil
+	}
+}
+
 func (s *systemd) Start() error {
+	if s.Option.bool(optionTransient, optionTransientDefault) {
+		args, err := s.transientArgs()
+		if err != nil {
+			return err
+		}
+		return run("systemd-run", args...)
+	}
 	return s.runAction("start")
 }
 
+// transientArgs returns the systemd-run arguments starting the service as
+// a transient unit, translating the configuration into unit properties.
+func (s *systemd) transientArgs() ([]string, error) {
+	for _, name := range []string{optionExecStart, optionConditionPathExists, optionConditionFileNotEmpty} {
+		if _, found := s.Option[name]; found {
+			return nil, fmt.Errorf("%s is not supported with %s", name, optionTransient)
+		}
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return nil, err
+	}
+	cpuAffinity, err := s.cpuAffinity()
+	if err != nil {
+		return nil, err
+	}
+	tasksMax, err := s.tasksMax()
+	if err != nil {
+		return nil, err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return nil, err
+	}
+	limitNOFILE, err := s.limitNOFILEValue()
+	if err != nil {
+		return nil, err
+	}
+	workingDirectory, err := s.workingDirectory()
+	if err != nil {
+		return nil, err
+	}
+	timeoutStopSec, err := s.timeoutStopSec()
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if s.isUserService() {
+		args = append(args, "--user")
+	}
+	args = append(args, "--unit="+s.unitName())
+	args = append(args, "--description="+s.description())
+	property := func(p string) {
+		args = append(args, "--property="+p)
+	}
+	if s.UserName != "" {
+		property("User=" + s.UserName)
+	}
+	if workingDirectory != "" {
+		property("WorkingDirectory=" + workingDirectory)
+	}
+	if s.ChRoot != "" {
+		property("RootDirectory=" + s.ChRoot)
+	}
+	property("Restart=" + s.restartPolicy("no"))
+	if limitNOFILE != "" {
+		property("LimitNOFILE=" + limitNOFILE)
+	}
+	if tasksMax != "" {
+		property("TasksMax=" + tasksMax)
+	}
+	if umask != "" {
+		property("UMask=" + umask)
+	}
+	if cpuAffinity != "" {
+		property("CPUAffinity=" + cpuAffinity)
+	}
+	if d := systemdSeconds(s.Option.duration(optionRuntimeMaxSec, 0)); d != "" {
+		property("RuntimeMaxSec=" + d)
+	}
+	if timeoutStopSec != "" {
+		property("TimeoutStopSec=" + timeoutStopSec)
+	}
+	keys := make([]string, 0, len(s.EnvVars))
+	for k := range s.EnvVars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--setenv="+k+"="+s.EnvVars[k])
+	}
+
+	args = append(args, path)
+	return append(args, s.Arguments...), nil
+}
+
+// Stop stops the unit, waiting for it to stop unless the StopNoBlock
+// option is set.
 func (s *systemd) Stop() error {
+	if s.Option.bool(optionStopNoBlock, optionStopNoBlockDefault) {
+		return s.run("stop", "--no-block", s.unitName())
+	}
 	return s.runAction("stop")
 }
 
@@ -288,26 +1209,50 @@ func (s *systemd) runWithOutput(command string, arguments ...string) (int, strin
 }
 
 func (s *systemd) run(action string, args ...string) error {
+	return s.runContext(context.Background(), action, args...)
+}
+
+// runContext runs systemctl like run, stopping it early when ctx is done.
+func (s *systemd) runContext(ctx context.Context, action string, args ...string) error {
 	if s.isUserService() {
-		return run("systemctl", append([]string{action, "--user"}, args...)...)
+		return runContext(ctx, "systemctl", append([]string{action, "--user"}, args...)...)
 	}
-	return run("systemctl", append([]string{action}, args...)...)
+	return runContext(ctx, "systemctl", append([]string{action}, args...)...)
+}
+
+// daemonReload makes systemd reload its unit files, so that it sees the
+// units Install and Uninstall changed.
+func (s *systemd) daemonReload(ctx context.Context) error {
+	if err := s.runContext(ctx, "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed, systemd may not see the changed unit: %w", err)
+	}
+	return nil
 }
 
 func (s *systemd) runAction(action string) error {
 	return s.run(action, s.unitName())
 }
 
-const systemdScript = `[Unit]
+const systemdScript = `# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+[Unit]
 Description={{.Description}}
+{{range $k, $v := .Labels -}}
+X-Label={{$k}}={{$v}}
+{{end -}}
 ConditionFileIsExecutable={{.Path|cmdEscape}}
+{{range .Conditions -}}
+{{.Directive}}={{.SystemdValue}}
+{{end -}}
 {{range $i, $dep := .Dependencies}} 
 {{$dep}} {{end}}
+{{if .JoinsNamespaceOf}}JoinsNamespaceOf={{range $i, $unit := .JoinsNamespaceOf}}{{if $i}} {{end}}{{$unit}}{{end}}{{end}}
+{{if .After}}After={{range $i, $unit := .After}}{{if $i}} {{end}}{{$unit}}{{end}}{{end}}
+{{if .Before}}Before={{range $i, $unit := .Before}}{{if $i}} {{end}}{{$unit}}{{end}}{{end}}
 
 [Service]
 StartLimitInterval=5
 StartLimitBurst=10
-ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
+ExecStart={{if .ExecStart}}{{.ExecStart}}{{else}}{{.Path|cmdEscape}}{{range .Arguments}} {{.|cmdSystemd}}{{end}}{{end}}
 {{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
 {{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmdEscape}}{{end}}
 {{if .UserName}}User={{.UserName}}{{end}}
@@ -317,8 +1262,13 @@ ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
 StandardOutput=file:{{.LogDirectory}}/{{.Name}}.out
 StandardError=file:{{.LogDirectory}}/{{.Name}}.err
 {{- end}}
-{{if gt .LimitNOFILE -1 }}LimitNOFILE={{.LimitNOFILE}}{{end}}
+{{if .LimitNOFILE}}LimitNOFILE={{.LimitNOFILE}}{{end}}
+{{if .TasksMax}}TasksMax={{.TasksMax}}{{end}}
+{{if .UMask}}UMask={{.UMask}}{{end}}
+{{if .CPUAffinity}}CPUAffinity={{.CPUAffinity}}{{end}}
 {{if .Restart}}Restart={{.Restart}}{{end}}
+{{if .RuntimeMaxSec}}RuntimeMaxSec={{.RuntimeMaxSec}}{{end}}
+{{if .TimeoutStopSec}}TimeoutStopSec={{.TimeoutStopSec}}{{end}}
 {{if .SuccessExitStatus}}SuccessExitStatus={{.SuccessExitStatus}}{{end}}
 RestartSec=120
 EnvironmentFile=-/etc/sysconfig/{{.Name}}
@@ -326,7 +1276,166 @@ KillMode=process
 {{range $k, $v := .EnvVars -}}
 Environment={{$k}}={{$v}}
 {{end -}}
-
+{{range .Extra}}{{.}}
+{{end}}
 [Install]
-WantedBy=multi-user.target
+WantedBy={{if .UserService}}default.target{{else}}multi-user.target{{end}}
+`
+
+const systemdDropInScript = `# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+{{if .Conditions -}}
+[Unit]
+{{range .Conditions -}}
+{{.Directive}}={{.SystemdValue}}
+{{end -}}
+{{end -}}
+[Service]
+{{if .ExecStart}}ExecStart=
+ExecStart={{.ExecStart}}
+{{end -}}
+{{if .Restart}}Restart={{.Restart}}
+{{end -}}
+{{if .LimitNOFILE}}LimitNOFILE={{.LimitNOFILE}}
+{{end -}}
+{{if .TasksMax}}TasksMax={{.TasksMax}}
+{{end -}}
+{{if .UMask}}UMask={{.UMask}}
+{{end -}}
+{{if .RuntimeMaxSec}}RuntimeMaxSec={{.RuntimeMaxSec}}
+{{end -}}
+{{if .TimeoutStopSec}}TimeoutStopSec={{.TimeoutStopSec}}
+{{end -}}
+{{range $k, $v := .EnvVars -}}
+Environment={{$k}}={{$v}}
+{{end -}}
+{{range .Extra -}}
+{{.}}
+{{end -}}
 `
+
+// systemdListInstalled lists the service unit files known to systemd
+// that Install wrote, as found by systemdGeneratedUnits, leaving out
+// templates. systemd does not list the instances of a template, so the
+// enabled ones are added.
+func systemdListInstalled() ([]string, error) {
+	units, err := systemdGeneratedUnits()
+	if err != nil {
+		return nil, err
+	}
+	generated := make(map[string]bool, len(units))
+	for _, unit := range units {
+		generated[unit] = true
+	}
+	_, out, err := runWithOutput("systemctl", "list-unit-files", "--type=service", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !generated[fields[0]] {
+			continue
+		}
+		delete(generated, fields[0])
+		names = append(names, strings.TrimSuffix(fields[0], ".service"))
+	}
+	for _, unit := range units {
+		if generated[unit] && strings.Contains(unit, "@") {
+			names = append(names, strings.TrimSuffix(unit, ".service"))
+		}
+	}
+	return names, nil
+}
+
+// systemdLabelPrefix starts the unit directives holding the Labels.
+// systemd ignores directives starting with X-.
+const systemdLabelPrefix = "X-Label="
+
+// LoadInstalledConfig recovers the Labels, the executable, the Arguments and
+// the UserName from the installed unit file.
+func (s *systemd) LoadInstalledConfig() (*Config, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return nil, err
+	}
+	c, err := readInstalledConfig(confPath, systemdLabelPrefix, parseUnitLine)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = s.Name
+	return c, nil
+}
+
+// parseUnitLine recovers the executable and Arguments from the
+// ExecStart= line and the UserName from the User= line of a unit.
+func parseUnitLine(c *Config, line string) {
+	switch {
+	case strings.HasPrefix(line, "User="):
+		c.UserName = strings.TrimPrefix(line, "User=")
+	case strings.HasPrefix(line, "ExecStart="):
+		words := splitExecStart(strings.TrimPrefix(line, "ExecStart="))
+		if len(words) == 0 {
+			return
+		}
+		c.Executable = words[0]
+		c.Arguments = words[1:]
+	}
+}
+
+// splitExecStart splits an ExecStart= command line into words following
+// the rules documented in systemd.service(5) and systemd.syntax(7): words
+// are separated by whitespace, may be double quoted, support C-style
+// backslash escapes and "$$" stands for a literal "$".
+func splitExecStart(line string) []string {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+		quoted bool
+	)
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				word.WriteByte('\n')
+			case 't':
+				word.WriteByte('\t')
+			case 'x':
+				if i+2 < len(line) {
+					if v, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+						word.WriteByte(byte(v))
+						i += 2
+						break
+					}
+				}
+				word.WriteByte('x')
+			default:
+				word.WriteByte(line[i])
+			}
+			inWord = true
+		case ch == '$' && i+1 < len(line) && line[i+1] == '$':
+			i++
+			word.WriteByte('$')
+			inWord = true
+		case ch == '"':
+			quoted = !quoted
+			inWord = true
+		case (ch == ' ' || ch == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
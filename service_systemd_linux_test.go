@@ -0,0 +1,1539 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCommand records a single invocation of the fake command runner.
+type fakeCommand struct {
+	command   string
+	arguments []string
+}
+
+// setFakeRunner replaces commandRunner with a function that records each
+// invocation and answers with output. It returns the recorded calls and a
+// function restoring the original runner.
+func setFakeRunner(output func(command string, arguments ...string) (int, string, error)) (*[]fakeCommand, func()) {
+	calls := &[]fakeCommand{}
+	orig := commandRunner
+	commandRunner = func(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+		*calls = append(*calls, fakeCommand{command, arguments})
+		exitStatus, stdout, err := output(command, arguments...)
+		return exitStatus, stdout, "", err
+	}
+	return calls, func() { commandRunner = orig }
+}
+
+// setUnitDir points systemdUnitDir at a temporary directory containing the
+// given unit files.
+func setUnitDir(t *testing.T, units ...string) func() {
+	dir, err := ioutil.TempDir("", "units")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range units {
+		if err := ioutil.WriteFile(filepath.Join(dir, u), []byte("[Unit]\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orig := systemdUnitDir
+	systemdUnitDir = dir
+	return func() {
+		systemdUnitDir = orig
+		os.RemoveAll(dir)
+	}
+}
+
+// renderUnit renders the systemd unit for c without consulting the host.
+func renderUnit(c *Config) (string, error) {
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245 (245.4-4ubuntu3)", nil
+	})
+	defer restore()
+
+	if c.Executable == "" {
+		c.Executable = "/usr/bin/app"
+	}
+	s := &systemd{Config: c}
+	var buf bytes.Buffer
+	err := s.writeUnit(&buf)
+	return buf.String(), err
+}
+
+func Test_systemdTasksMax(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{"unset", nil, "", false},
+		{"int", 512, "TasksMax=512\n", false},
+		{"string", "64", "TasksMax=64\n", false},
+		{"infinity", "infinity", "TasksMax=infinity\n", false},
+		{"zero", 0, "", true},
+		{"garbage", "lots", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := KeyValue{}
+			if tt.value != nil {
+				opts[optionTasksMax] = tt.value
+			}
+			unit, err := renderUnit(&Config{Name: "app", Option: opts})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "" && strings.Contains(unit, "TasksMax=") {
+				t.Errorf("unit unexpectedly contains TasksMax:\n%s", unit)
+			}
+			if tt.want != "" && !strings.Contains(unit, tt.want) {
+				t.Errorf("unit missing %q:\n%s", tt.want, unit)
+			}
+		})
+	}
+}
+
+func Test_systemdCPUAffinity(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"unset", "", "", false},
+		{"single", "2", "CPUAffinity=2\n", false},
+		{"list", "0-3,6,8-9", "CPUAffinity=0-3,6,8-9\n", false},
+		{"reversed", "3-0", "", true},
+		{"spaces", "0 1", "", true},
+		{"trailing-comma", "0,", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit, err := renderUnit(&Config{Name: "app", Option: KeyValue{optionCPUAffinity: tt.value}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "" && strings.Contains(unit, "CPUAffinity=") {
+				t.Errorf("unit unexpectedly contains CPUAffinity:\n%s", unit)
+			}
+			if tt.want != "" && !strings.Contains(unit, tt.want) {
+				t.Errorf("unit missing %q:\n%s", tt.want, unit)
+			}
+		})
+	}
+}
+
+func Test_systemdExtra(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{
+		optionSystemdExtra: []string{"ProtectSystem=strict", "Nice=5"},
+	}}
+	unit, err := renderUnit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ProtectSystem=strict\nNice=5\n\n[Install]\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q at the end of [Service]:\n%s", want, unit)
+	}
+	var buf bytes.Buffer
+	if err := (&systemd{Config: c}).writeDropIn(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Service]\nProtectSystem=strict\nNice=5\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("drop-in = %q, want it to end with %q", buf.String(), want)
+	}
+
+	for _, extra := range []string{"[Install]", "  [Unit]", "Nice=5\n[Install]"} {
+		c.Option[optionSystemdExtra] = []string{extra}
+		if _, err := renderUnit(c); err == nil {
+			t.Errorf("writeUnit() with %s %q succeeded, want an error", optionSystemdExtra, extra)
+		}
+	}
+}
+
+func Test_systemdConditions(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{
+		optionConditionPathExists:   []string{"/etc/app/app.conf", "!/etc/app/disabled"},
+		optionConditionFileNotEmpty: "/etc/app/100%.key",
+	}}
+	unit, err := renderUnit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\nConditionPathExists=/etc/app/app.conf\nConditionPathExists=!/etc/app/disabled\nConditionFileNotEmpty=/etc/app/100%%.key\n"
+	if !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	for _, bad := range []interface{}{"etc/app.conf", "!", []int{1}, "/etc/a\nb"} {
+		c.Option = KeyValue{optionConditionPathExists: bad}
+		if _, err := renderUnit(c); err == nil {
+			t.Errorf("writeUnit() with %s %q succeeded", optionConditionPathExists, bad)
+		}
+	}
+}
+
+func Test_systemdForceKill(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{optionKillTimeout: 30 * time.Second}}
+	unit, err := renderUnit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(unit, "TimeoutStopSec=") {
+		t.Errorf("unit without %s sets TimeoutStopSec:\n%s", optionForceKill, unit)
+	}
+
+	c.Option[optionForceKill] = true
+	if unit, err = renderUnit(c); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nTimeoutStopSec=30\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+}
+
+func Test_systemdUMask(t *testing.T) {
+	c := &Config{Name: "app", Option: KeyValue{optionUMask: "027"}}
+	unit, err := renderUnit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nUMask=0027\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	c.Option = KeyValue{}
+	if unit, err = renderUnit(c); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(unit, "UMask=") {
+		t.Errorf("unit without %s sets UMask:\n%s", optionUMask, unit)
+	}
+
+	c.Option[optionUMask] = "99"
+	if _, err = renderUnit(c); err == nil {
+		t.Errorf("unit with %s 99 rendered", optionUMask)
+	}
+}
+
+func Test_systemdExecStart(t *testing.T) {
+	c := &Config{Name: "app", UserName: "app", Arguments: []string{"-v"}, Option: KeyValue{
+		optionExecStart: "/bin/sh -c 'exec /usr/bin/app --id=%%i >> /var/log/app.log 2>&1'",
+	}}
+	unit, err := renderUnit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\nExecStart=/bin/sh -c 'exec /usr/bin/app --id=%%i >> /var/log/app.log 2>&1'\n",
+		"\nUser=app\n",
+		"\nRestart=always\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	c.Option = KeyValue{}
+	if unit, err = renderUnit(c); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nExecStart=/usr/bin/app \"-v\"\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit without %s missing %q:\n%s", optionExecStart, want, unit)
+	}
+
+	c.Option = KeyValue{optionExecStart: "/usr/bin/app\nExecStartPost=/bin/true"}
+	if _, err := renderUnit(c); err == nil {
+		t.Errorf("writeUnit() with a multi-line %s succeeded, want an error", optionExecStart)
+	}
+	c.Option = KeyValue{optionExecStart: "/usr/bin/app", optionTransient: true}
+	if _, err := (&systemd{Config: c}).transientArgs(); err == nil {
+		t.Errorf("transientArgs() with %s succeeded, want an error", optionExecStart)
+	}
+}
+
+func Test_systemdLimitNOFILE(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{"unset", nil, "", false},
+		{"default", -1, "", false},
+		{"int", 65536, "LimitNOFILE=65536\n", false},
+		{"string", "4096", "LimitNOFILE=4096\n", false},
+		{"infinity", "infinity", "LimitNOFILE=infinity\n", false},
+		{"split", "1024:65536", "LimitNOFILE=1024:65536\n", false},
+		{"split-infinity", "1024:infinity", "LimitNOFILE=1024:infinity\n", false},
+		{"soft-above-hard", "65536:1024", "", true},
+		{"missing-hard", "1024:", "", true},
+		{"negative", -2, "", true},
+		{"garbage", "lots", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := KeyValue{}
+			if tt.value != nil {
+				opts[optionLimitNOFILE] = tt.value
+			}
+			unit, err := renderUnit(&Config{Name: "app", Option: opts})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "" && strings.Contains(unit, "LimitNOFILE=") {
+				t.Errorf("unit unexpectedly contains LimitNOFILE:\n%s", unit)
+			}
+			if tt.want != "" && !strings.Contains(unit, tt.want) {
+				t.Errorf("unit missing %q:\n%s", tt.want, unit)
+			}
+		})
+	}
+}
+
+func Test_systemdRuntimeMaxSec(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{"duration", 24 * time.Hour, "RuntimeMaxSec=86400\n", false},
+		{"string", "90m", "RuntimeMaxSec=5400\n", false},
+		{"fractional", 1500 * time.Millisecond, "RuntimeMaxSec=1.5\n", false},
+		{"zero", time.Duration(0), "", true},
+		{"negative", "-1h", "", true},
+		{"garbage", "soon", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unit, err := renderUnit(&Config{Name: "app", Option: KeyValue{optionRuntimeMaxSec: tt.value}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !strings.Contains(unit, tt.want) {
+				t.Errorf("unit missing %q:\n%s", tt.want, unit)
+			}
+			if tt.want != "" && !strings.Contains(unit, "Restart=always\n") {
+				t.Errorf("unit missing Restart=always:\n%s", unit)
+			}
+		})
+	}
+}
+
+func Test_systemdJoinsNamespaceOf(t *testing.T) {
+	unit, err := renderUnit(&Config{Name: "sidecar", Option: KeyValue{
+		optionJoinsNamespaceOf: []string{"main.service", "proxy@web.service"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "JoinsNamespaceOf=main.service proxy@web.service\n"
+	if !strings.Contains(unit, want) || strings.Index(unit, want) > strings.Index(unit, "[Service]") {
+		t.Errorf("unit missing %q in [Unit]:\n%s", want, unit)
+	}
+
+	unit, err = renderUnit(&Config{Name: "sidecar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(unit, "JoinsNamespaceOf") {
+		t.Errorf("unit unexpectedly contains JoinsNamespaceOf:\n%s", unit)
+	}
+
+	for _, bad := range []string{"main", "main service.service", "../main.service", ""} {
+		_, err = renderUnit(&Config{Name: "sidecar", Option: KeyValue{
+			optionJoinsNamespaceOf: []string{bad},
+		}})
+		if err == nil {
+			t.Errorf("writeUnit() accepted invalid unit name %q", bad)
+		}
+	}
+}
+
+func Test_systemdStopOrder(t *testing.T) {
+	unit, err := renderUnit(&Config{Name: "api", Option: KeyValue{
+		optionStopBefore: []string{"db", "cache.service"},
+		optionStopAfter:  []string{"proxy"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\nAfter=db.service cache.service\n", "\nBefore=proxy.service\n"} {
+		if !strings.Contains(unit, want) || strings.Index(unit, want) > strings.Index(unit, "[Service]") {
+			t.Errorf("unit missing %q in [Unit]:\n%s", want, unit)
+		}
+	}
+
+	_, err = renderUnit(&Config{Name: "api", Option: KeyValue{optionStopAfter: []string{"bad name"}}})
+	if err == nil {
+		t.Error("writeUnit() accepted an invalid StopAfter entry")
+	}
+}
+
+func Test_systemdWorkingDirectoryFallbacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+
+	unit, err := renderUnit(&Config{
+		Name:             "app",
+		WorkingDirectory: missing,
+		Option:           KeyValue{optionWorkingDirectoryFallbacks: []string{filepath.Join(dir, "other"), dir}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nWorkingDirectory=" + dir + "\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	_, err = renderUnit(&Config{
+		Name:             "app",
+		WorkingDirectory: missing,
+		Option:           KeyValue{optionWorkingDirectoryFallbacks: []string{filepath.Join(dir, "other")}},
+	})
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("writeUnit() with no existing working directory error = %v", err)
+	}
+
+	// Without fallbacks WorkingDirectory is written unchecked.
+	unit, err = renderUnit(&Config{Name: "app", WorkingDirectory: missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(unit, "\nWorkingDirectory="+missing+"\n") {
+		t.Errorf("unit without fallbacks:\n%s", unit)
+	}
+}
+
+func Test_cmdSystemd(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"plain", `"plain"`},
+		{"two words", `"two words"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"$HOME/${USER}", `"$$HOME/$${USER}"`},
+		{"line\nbreak\ttab", `"line\nbreak\ttab"`},
+		{"%i", `"%i"`},
+	}
+	for _, tt := range tests {
+		if got := cmdSystemd(tt.arg); got != tt.want {
+			t.Errorf("cmdSystemd(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+
+	args := []string{"-config", "/etc/app dir/app.conf", `quote"d`, `back\slash`, "$NOT_EXPANDED", ""}
+	unit, err := renderUnit(&Config{Name: "app", Arguments: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(unit, "\n") {
+		if strings.HasPrefix(line, "ExecStart=") {
+			got := splitExecStart(strings.TrimPrefix(line, "ExecStart="))
+			want := append([]string{"/usr/bin/app"}, args...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("systemd would parse %s as %q, want %q", line, got, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("unit has no ExecStart:\n%s", unit)
+}
+
+func Test_systemdStatus(t *testing.T) {
+	tests := []struct {
+		out     string
+		want    Status
+		wantErr error
+	}{
+		{"active\n", StatusRunning, nil},
+		{"reloading\n", StatusRunning, nil},
+		{"activating\n", StatusStarting, nil},
+		{"deactivating\n", StatusStopping, nil},
+		{"unknown\n", StatusUnknown, ErrNotInstalled},
+	}
+	for _, tt := range tests {
+		_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+			return 3, tt.out, nil
+		})
+		got, err := (&systemd{Config: &Config{Name: "app"}}).Status()
+		restore()
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("Status() with is-active %q = %v, %v, want %v, %v", tt.out, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func Test_systemdStatusEx(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    StatusDetails
+		wantErr error
+	}{
+		{"activating", "Id=app.service\nLoadState=loaded\nActiveState=activating\nSubState=start\nMainPID=99\n",
+			StatusDetails{Name: "app", Status: StatusStarting, PID: 99, State: "activating/start"}, nil},
+		{"deactivating", "Id=app.service\nLoadState=loaded\nActiveState=deactivating\nSubState=stop-sigterm\nMainPID=99\n",
+			StatusDetails{Name: "app", Status: StatusStopping, PID: 99, State: "deactivating/stop-sigterm"}, nil},
+		{"active", "Id=app.service\nLoadState=loaded\nActiveState=active\nSubState=running\nMainPID=99\n",
+			StatusDetails{Name: "app", Status: StatusRunning, PID: 99, State: "active/running"}, nil},
+		{"not-found", "Id=app.service\nLoadState=not-found\nActiveState=inactive\nSubState=dead\nMainPID=0\n",
+			StatusDetails{Name: "app"}, ErrNotInstalled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+				return 0, tt.out, nil
+			})
+			defer restore()
+
+			got, err := StatusEx(&systemd{Config: &Config{Name: "app"}})
+			if err != tt.wantErr {
+				t.Fatalf("StatusEx() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("StatusEx() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_systemdDryRun(t *testing.T) {
+	defer setUnitDir(t)()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+
+	s := &systemd{Config: &Config{
+		Name:        "app",
+		Description: "App service",
+		Executable:  "/usr/bin/app",
+		Option:      KeyValue{optionDryRun: true},
+	}}
+	script, err := InstallScript(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(script, "# Generated by app (service pkg)\n[Unit]\nDescription=App service\n") {
+		t.Errorf("InstallScript() = %q, want the unit file", script)
+	}
+
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "app.service")); !os.IsNotExist(err) {
+		t.Errorf("dry run Install() wrote the unit file: %v", err)
+	}
+	for _, c := range *calls {
+		if c.command == "systemctl" && len(c.arguments) > 0 && c.arguments[0] != "--version" {
+			t.Errorf("dry run Install() ran systemctl %v", c.arguments)
+		}
+	}
+
+	if _, err := InstallScript(&stubService{name: "app"}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("InstallScript() on a service without support error = %v, want ErrNotSupported", err)
+	}
+}
+
+func Test_systemdFailIfExists(t *testing.T) {
+	defer setUnitDir(t)()
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+
+	vendorDir, err := ioutil.TempDir("", "vendor-units")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vendorDir)
+	foreign := "[Service]\nExecStart=/opt/other/app\n"
+	if err := ioutil.WriteFile(filepath.Join(vendorDir, "app.service"), []byte(foreign), 0644); err != nil {
+		t.Fatal(err)
+	}
+	origSearch := systemdUnitSearchDirs
+	systemdUnitSearchDirs = []string{vendorDir}
+	defer func() { systemdUnitSearchDirs = origSearch }()
+	defer setExecutablesExist()()
+
+	newService := func(opts KeyValue) *systemd {
+		return &systemd{Config: &Config{
+			Name:       "app",
+			Executable: "/usr/bin/app",
+			Option:     opts,
+		}}
+	}
+	unitPath := filepath.Join(systemdUnitDir, "app.service")
+
+	err = newService(KeyValue{optionFailIfExists: true}).Install()
+	if !errors.Is(err, ErrServiceExists) {
+		t.Fatalf("Install() with a packaged unit error = %v, want ErrServiceExists", err)
+	}
+	if !strings.Contains(err.Error(), vendorDir) {
+		t.Errorf("Install() error = %q, want the conflicting path", err)
+	}
+	if _, err := os.Stat(unitPath); !os.IsNotExist(err) {
+		t.Errorf("failed Install() wrote the unit file: %v", err)
+	}
+
+	// A foreign unit at the install location is refused unless Overwrite
+	// is set, whatever FailIfExists says.
+	if err := ioutil.WriteFile(unitPath, []byte(foreign), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newService(nil).Install(); err == nil {
+		t.Fatal("Install() over a foreign unit = nil, want an error")
+	}
+	if err := newService(KeyValue{optionFailIfExists: true, optionOverwrite: true}).Install(); err != nil {
+		t.Fatalf("Install() with Overwrite = %v", err)
+	}
+	b, err := ioutil.ReadFile(unitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "ExecStart=/usr/bin/app") || strings.Contains(string(b), "/opt/other/app") {
+		t.Errorf("unit after Overwrite = %q, want it replaced", b)
+	}
+}
+
+func Test_systemdSmokeTest(t *testing.T) {
+	defer setUnitDir(t)()
+	defer setExecutablesExist()()
+	unitPath := filepath.Join(systemdUnitDir, "app.service")
+
+	tests := []struct {
+		name     string
+		exit     int
+		wantErr  bool
+		wantUnit bool
+	}{
+		{"pass", 0, false, true},
+		{"fail", 1, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(unitPath)
+			calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+				if command == "/usr/bin/app" && tt.exit != 0 {
+					return tt.exit, "", errors.New("exit status 1")
+				}
+				return 0, "systemd 245", nil
+			})
+			defer restore()
+
+			s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{
+				optionSmokeTest: []string{"/usr/bin/app", "--version"},
+			}}}
+			err := s.Install()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Install() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(unitPath); (err == nil) != tt.wantUnit {
+				t.Errorf("unit file exists = %v, want %v", err == nil, tt.wantUnit)
+			}
+			var enabled bool
+			for _, c := range *calls {
+				if c.command == "systemctl" && len(c.arguments) > 0 && c.arguments[0] == "enable" {
+					enabled = true
+				}
+			}
+			if enabled != tt.wantUnit {
+				t.Errorf("enabled = %v, want %v; calls %v", enabled, tt.wantUnit, *calls)
+			}
+		})
+	}
+}
+
+func Test_systemdStartAtBoot(t *testing.T) {
+	defer setUnitDir(t)()
+	defer setExecutablesExist()()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+
+	startAtBoot := false
+	s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app", StartAtBoot: &startAtBoot}}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "app.service")); err != nil {
+		t.Errorf("Install() did not write the unit: %v", err)
+	}
+	for _, c := range *calls {
+		if c.command == "systemctl" && len(c.arguments) > 0 && c.arguments[0] == "enable" {
+			t.Errorf("Install() with StartAtBoot false ran %v", c)
+		}
+	}
+}
+
+func Test_systemdIsEnabled(t *testing.T) {
+	defer setUnitDir(t)()
+	s := &systemd{Config: &Config{Name: "app"}}
+	if _, err := IsEnabled(s); err != ErrNotInstalled {
+		t.Errorf("IsEnabled() without a unit = %v, want ErrNotInstalled", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(systemdUnitDir, "app.service"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		exit    int
+		out     string
+		want    bool
+		wantErr bool
+	}{
+		{0, "enabled\n", true, false},
+		{0, "enabled-runtime\n", true, false},
+		{0, "static\n", false, false},
+		{1, "disabled\n", false, false},
+		{1, "masked\n", false, false},
+		{1, "", false, true},
+	} {
+		_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+			if tt.exit != 0 {
+				return tt.exit, tt.out, errors.New("exit status 1")
+			}
+			return 0, tt.out, nil
+		})
+		got, err := IsEnabled(s)
+		restore()
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("IsEnabled() for %q = %v, %v, want %v", tt.out, got, err, tt.want)
+		}
+	}
+}
+
+func Test_systemdDropInOnly(t *testing.T) {
+	defer setUnitDir(t, "app.service")()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "", nil
+	})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		options KeyValue
+		envVars map[string]string
+		want    string
+	}{
+		{"empty", KeyValue{}, nil, "# Generated by app (service pkg)\n[Service]\n"},
+		{"set",
+			KeyValue{optionRestart: "on-failure", optionLimitNOFILE: "1024:4096"},
+			map[string]string{"B": "2", "A": "1"},
+			"# Generated by app (service pkg)\n[Service]\nRestart=on-failure\nLimitNOFILE=1024:4096\nEnvironment=A=1\nEnvironment=B=2\n",
+		},
+		{"keep-alive", KeyValue{optionKeepAlive: false, optionTasksMax: 64}, nil, "# Generated by app (service pkg)\n[Service]\nRestart=no\nTasksMax=64\n"},
+		{"exec-start",
+			KeyValue{optionExecStart: "/usr/bin/app --serve", optionConditionPathExists: "/etc/app.conf"},
+			nil,
+			"# Generated by app (service pkg)\n[Unit]\nConditionPathExists=/etc/app.conf\n[Service]\nExecStart=\nExecStart=/usr/bin/app --serve\n",
+		},
+	}
+	for _, tt := range tests {
+		tt.options[optionDropInOnly] = true
+		s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app", EnvVars: tt.envVars, Option: tt.options}}
+		got, err := s.InstallScript()
+		if err != nil {
+			t.Fatalf("%s: InstallScript() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: drop-in = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	s := &systemd{Config: &Config{Name: "app", Option: KeyValue{optionDropInOnly: true, optionRestart: "always"}}}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	dropIn := filepath.Join(systemdUnitDir, "app.service.d", "override.conf")
+	if b, err := ioutil.ReadFile(dropIn); err != nil || string(b) != "# Generated by app (service pkg)\n[Service]\nRestart=always\n" {
+		t.Errorf("override.conf = %q, %v", b, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(systemdUnitDir, "app.service")); err != nil || string(b) != "[Unit]\n" {
+		t.Errorf("Install() changed the unit: %q, %v", b, err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(dropIn)); !os.IsNotExist(err) {
+		t.Errorf("drop-in directory not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "app.service")); err != nil {
+		t.Errorf("Uninstall() removed the unit: %v", err)
+	}
+	for _, c := range *calls {
+		if c.command == "systemctl" && len(c.arguments) > 0 && (c.arguments[0] == "enable" || c.arguments[0] == "disable") {
+			t.Errorf("unexpected systemctl %v", c.arguments)
+		}
+	}
+
+	// A failed reload removes the drop-in it had written.
+	_, restore = setFakeRunner(func(string, ...string) (int, string, error) {
+		return 1, "", errors.New("exit status 1")
+	})
+	defer restore()
+	if err := s.Install(); err == nil {
+		t.Fatal("Install() with a failing daemon-reload succeeded")
+	}
+	if _, err := os.Stat(filepath.Dir(dropIn)); !os.IsNotExist(err) {
+		t.Errorf("failed Install() left the drop-in directory: %v", err)
+	}
+}
+
+func Test_systemdUninstallPartial(t *testing.T) {
+	defer setUnitDir(t, "app.service")()
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		if len(arguments) > 0 && arguments[0] == "disable" {
+			return 1, "", errors.New("exit status 1")
+		}
+		return 0, "", nil
+	})
+	defer restore()
+
+	s := &systemd{Config: &Config{Name: "app"}}
+	if err := s.Uninstall(); err == nil {
+		t.Error("Uninstall() with a failing disable = nil, want its error")
+	}
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "app.service")); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() left the unit after disable failed: %v", err)
+	}
+	if last := (*calls)[len(*calls)-1]; last.arguments[0] != "daemon-reload" {
+		t.Errorf("Uninstall() ended with %v, want daemon-reload", last)
+	}
+
+	// A drop-in already gone still reloads systemd.
+	*calls = nil
+	s.Option = KeyValue{optionDropInOnly: true}
+	if err := s.Uninstall(); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() of a missing drop-in = %v, want a not-exist error", err)
+	}
+	if len(*calls) != 1 || (*calls)[0].arguments[0] != "daemon-reload" {
+		t.Errorf("Uninstall() of a missing drop-in ran %v, want daemon-reload", *calls)
+	}
+}
+
+func Test_systemdInstance(t *testing.T) {
+	defer setUnitDir(t)()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	newInstance := func(instance string) *systemd {
+		return &systemd{Config: &Config{
+			Name:       "app",
+			Executable: "/usr/bin/app",
+			Arguments:  []string{"-config", "/etc/app/%i.conf"},
+			Option:     KeyValue{optionInstance: instance},
+		}}
+	}
+	template := filepath.Join(systemdUnitDir, "app@.service")
+
+	web := newInstance("web")
+	if err := web.Install(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `/etc/app/%i.conf`) {
+		t.Errorf("template unit does not pass %%i through:\n%s", b)
+	}
+	// The second instance reuses the template written by the first.
+	if err := newInstance("api").Install(); err != nil {
+		t.Fatalf("Install() of a second instance = %v", err)
+	}
+	if err := web.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Enabling is faked, so link the instances as systemctl enable does.
+	wants := filepath.Join(systemdUnitDir, "multi-user.target.wants")
+	if err := os.Mkdir(wants, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, unit := range []string{"app@web.service", "app@api.service"} {
+		if err := os.Symlink(template, filepath.Join(wants, unit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := web.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(template); err != nil {
+		t.Errorf("Uninstall() removed the template of an enabled instance: %v", err)
+	}
+	// Disabling is faked too.
+	os.RemoveAll(wants)
+	if err := newInstance("api").Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(template); !os.IsNotExist(err) {
+		t.Errorf("Uninstall() of the last instance left the template: %v", err)
+	}
+
+	var got [][]string
+	for _, c := range *calls {
+		if c.command == "systemctl" && c.arguments[0] != "--version" {
+			got = append(got, c.arguments)
+		}
+	}
+	want := [][]string{
+		{"enable", "app@web.service"},
+		{"daemon-reload"},
+		{"enable", "app@api.service"},
+		{"daemon-reload"},
+		{"start", "app@web.service"},
+		{"disable", "app@web.service"},
+		{"disable", "app@api.service"},
+		{"daemon-reload"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("systemctl calls = %v, want %v", got, want)
+	}
+}
+
+func Test_systemdLogsFiltered(t *testing.T) {
+	// Echo the command line instead of reading the journal.
+	_, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		if arguments[len(arguments)-1] == "PRIORITY=0" {
+			return 1, "", errors.New("exit status 1")
+		}
+		return 0, strings.Join(append([]string{command}, arguments...), " ") + "\n", nil
+	})
+	defer restore()
+
+	s := &systemd{Config: &Config{Name: "app"}}
+	var out bytes.Buffer
+	err := LogsFiltered(context.Background(), s, map[string]string{"PRIORITY": "3", "_PID": "42"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "journalctl --no-pager --unit=app.service PRIORITY=3 _PID=42\n"
+	if out.String() != want {
+		t.Errorf("LogsFiltered() ran %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	s.Option = KeyValue{optionUserService: true}
+	if err := s.LogsFiltered(context.Background(), nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "journalctl --no-pager --user-unit=app.service\n"; out.String() != want {
+		t.Errorf("LogsFiltered() for a user service ran %q, want %q", out.String(), want)
+	}
+
+	if err := s.LogsFiltered(context.Background(), map[string]string{"PRIORITY": "0"}, &out); err == nil {
+		t.Error("LogsFiltered() ignored a failing journalctl")
+	}
+	if err := s.LogsFiltered(context.Background(), map[string]string{"priority": "3"}, &out); err == nil {
+		t.Error("LogsFiltered() accepted a lower case field name")
+	}
+	if err := LogsFiltered(context.Background(), &stubService{name: "app"}, nil, &out); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("LogsFiltered() on a service without support error = %v, want ErrNotSupported", err)
+	}
+}
+
+func Test_systemdTransient(t *testing.T) {
+	defer setUnitDir(t)()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "", nil
+	})
+	defer restore()
+
+	s := &systemd{Config: &Config{
+		Name:             "job",
+		Description:      "One-off job",
+		Executable:       "/usr/bin/job",
+		Arguments:        []string{"-batch", "a b"},
+		UserName:         "worker",
+		WorkingDirectory: "/srv/job",
+		EnvVars:          map[string]string{"B": "2", "A": "1"},
+		Option: KeyValue{
+			optionTransient:     true,
+			optionRuntimeMaxSec: "1h",
+		},
+	}}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(systemdUnitDir, "*")); len(paths) != 0 {
+		t.Errorf("Install() of a transient service wrote %v", paths)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fakeCommand{
+		{"systemd-run", []string{
+			"--unit=job.service",
+			"--description=One-off job",
+			"--property=User=worker",
+			"--property=WorkingDirectory=/srv/job",
+			"--property=Restart=no",
+			"--property=RuntimeMaxSec=3600",
+			"--setenv=A=1",
+			"--setenv=B=2",
+			"/usr/bin/job", "-batch", "a b",
+		}},
+		{"systemctl", []string{"stop", "job.service"}},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("commands = %v, want %v", *calls, want)
+	}
+}
+
+func Test_systemdCgroupPath(t *testing.T) {
+	cgroups := map[string]string{
+		"app.service":   "/system.slice/app.service",
+		"app@a.service": "/system.slice/system-app.slice/app@a.service",
+	}
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		if arguments[len(arguments)-1] == "--user" {
+			return 0, "/user.slice/user-1000.slice/user@1000.service/app.slice/app.service\n", nil
+		}
+		return 0, cgroups[arguments[len(arguments)-1]] + "\n", nil
+	})
+	defer restore()
+
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    string
+	}{
+		{"system", nil, "/sys/fs/cgroup/system.slice/app.service"},
+		{"instance", KeyValue{optionInstance: "a"}, "/sys/fs/cgroup/system.slice/system-app.slice/app@a.service"},
+		{"user", KeyValue{optionUserService: true}, "/sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service/app.slice/app.service"},
+	}
+	for _, tt := range tests {
+		got, err := CgroupPath(&systemd{Config: &Config{Name: "app", Option: tt.options}})
+		if err != nil {
+			t.Errorf("%s: CgroupPath() error = %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: CgroupPath() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if len(*calls) != len(tests) {
+		t.Errorf("CgroupPath() ran %v, want one systemctl show per unit", *calls)
+	}
+
+	cgroups["app.service"] = ""
+	if _, err := CgroupPath(&systemd{Config: &Config{Name: "app"}}); err == nil {
+		t.Error("CgroupPath() of a unit that is not running succeeded")
+	}
+
+	if _, err := CgroupPath(&sysv{Config: &Config{Name: "app"}, platform: "linux-systemv"}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("CgroupPath() on sysv error = %v, want ErrNotSupported", err)
+	}
+}
+
+func Test_systemdReadLogs(t *testing.T) {
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		return 0, "Jan 02 15:04:05 host app[1]: one\nJan 02 15:04:06 host app[1]: two\n", nil
+	})
+	defer restore()
+
+	got, err := ReadLogs(&systemd{Config: &Config{Name: "app", Option: KeyValue{optionUserService: true}}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Jan 02 15:04:05 host app[1]: one", "Jan 02 15:04:06 host app[1]: two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadLogs() = %q, want %q", got, want)
+	}
+	wantCall := fakeCommand{"journalctl", []string{"--user-unit=app.service", "-n", "2", "--no-pager", "--quiet"}}
+	if len(*calls) != 1 || !reflect.DeepEqual((*calls)[0], wantCall) {
+		t.Errorf("ReadLogs() ran %v, want %v", *calls, wantCall)
+	}
+
+	if _, err := ReadLogs(&systemd{Config: &Config{Name: "app"}}, 0); err == nil {
+		t.Error("ReadLogs() with 0 lines succeeded")
+	}
+}
+
+func Test_systemdReadLogsSince(t *testing.T) {
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		return 0, "Jan 02 15:04:06 host app[1]: two\n", nil
+	})
+	defer restore()
+
+	since := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	got, err := ReadLogsSince(&systemd{Config: &Config{Name: "app"}}, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Jan 02 15:04:06 host app[1]: two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadLogsSince() = %q, want %q", got, want)
+	}
+	wantCall := fakeCommand{"journalctl", []string{"--unit=app.service", "--since=@1704207845", "--no-pager", "--quiet"}}
+	if len(*calls) != 1 || !reflect.DeepEqual((*calls)[0], wantCall) {
+		t.Errorf("ReadLogsSince() ran %v, want %v", *calls, wantCall)
+	}
+}
+
+func Test_systemdStopNoBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    []string
+	}{
+		{"default", nil, []string{"stop", "app.service"}},
+		{"no-block", KeyValue{optionStopNoBlock: true}, []string{"stop", "--no-block", "app.service"}},
+		{"user", KeyValue{optionStopNoBlock: true, optionUserService: true}, []string{"stop", "--user", "--no-block", "app.service"}},
+	}
+	for _, tt := range tests {
+		calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+			return 0, "", nil
+		})
+		err := (&systemd{Config: &Config{Name: "app", Option: tt.options}}).Stop()
+		restore()
+		if err != nil {
+			t.Fatalf("%s: Stop() error = %v", tt.name, err)
+		}
+		want := fakeCommand{"systemctl", tt.want}
+		if len(*calls) != 1 || !reflect.DeepEqual((*calls)[0], want) {
+			t.Errorf("%s: Stop() ran %v, want %v", tt.name, *calls, want)
+		}
+	}
+}
+
+func Test_systemdDiff(t *testing.T) {
+	defer setUnitDir(t)()
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	installed := &Config{
+		Name:        "app",
+		Description: "App service",
+		Executable:  "/usr/bin/app",
+		EnvVars:     map[string]string{"MODE": "prod"},
+	}
+	s := &systemd{Config: installed}
+	if _, err := Diff(s, installed); err != ErrNotInstalled {
+		t.Fatalf("Diff() before Install error = %v, want ErrNotInstalled", err)
+	}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := Diff(s, installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("Diff() against the installed config = %q, want no lines", lines)
+	}
+
+	desired := &Config{
+		Name:        "app",
+		Description: "App service",
+		Executable:  "/usr/bin/app",
+		UserName:    "app",
+		Option: KeyValue{
+			optionRestart:     "on-failure",
+			optionLimitNOFILE: 65536,
+		},
+	}
+	lines, err = Diff(s, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Environment: MODE=prod -> (unset)",
+		"LimitNOFILE: (unset) -> 65536",
+		"Restart: always -> on-failure",
+		"User: (unset) -> app",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Diff() = %q, want %q", lines, want)
+	}
+
+	if _, err := Diff(&stubService{name: "app"}, desired); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Diff() on a service without support error = %v, want ErrNotSupported", err)
+	}
+}
+
+func Test_systemdRestartHistory(t *testing.T) {
+	at := time.Date(2026, 10, 15, 12, 34, 56, 0, time.Local)
+	tests := []struct {
+		name     string
+		out      string
+		want     int
+		wantLast time.Time
+		wantErr  error
+	}{
+		{"restarted", "LoadState=loaded\nNRestarts=3\nActiveEnterTimestamp=" + at.Format("Mon 2006-01-02 15:04:05 MST") + "\n", 3, at, nil},
+		{"never", "LoadState=loaded\nNRestarts=0\nActiveEnterTimestamp=Thu 2026-10-15 12:00:00 UTC\n", 0, time.Time{}, nil},
+		{"not-found", "LoadState=not-found\nNRestarts=0\nActiveEnterTimestamp=\n", 0, time.Time{}, ErrNotInstalled},
+		{"old-systemd", "LoadState=loaded\nActiveEnterTimestamp=\n", 0, time.Time{}, ErrNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+				return 0, tt.out, nil
+			})
+			defer restore()
+
+			n, last, err := RestartHistory(&systemd{Config: &Config{Name: "app"}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RestartHistory() error = %v, want %v", err, tt.wantErr)
+			}
+			if n != tt.want || !last.Equal(tt.wantLast) {
+				t.Errorf("RestartHistory() = %d, %v, want %d, %v", n, last, tt.want, tt.wantLast)
+			}
+			want := []string{"show", "--property=LoadState,NRestarts,ActiveEnterTimestamp", "app.service"}
+			if len(*calls) != 1 || !reflect.DeepEqual((*calls)[0].arguments, want) {
+				t.Errorf("commands = %v, want systemctl %v", *calls, want)
+			}
+		})
+	}
+}
+
+func Test_systemdStatusAll(t *testing.T) {
+	defer setUnitDir(t, "tmpl@.service", "other.service")()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, systemdShowMulti, nil
+	})
+	defer restore()
+	// Only the units Install wrote count: web directly, from a custom
+	// script, the enabled instance of tmpl, and worker through a drop-in
+	// next to a unit installed elsewhere.
+	web, err := renderUnit(&Config{Name: "web", Option: KeyValue{optionSystemdScript: "[Unit]\nDescription=web\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range map[string]string{
+		"web.service":                            web,
+		"worker.service.d/override.conf":         "# Generated by worker v1.0 (service pkg)\n[Service]\n",
+		"tmpl@.service":                          "# Generated by tmpl (service pkg)\n[Unit]\n",
+		"multi-user.target.wants/tmpl@a.service": "",
+	} {
+		path = filepath.Join(systemdUnitDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := systemdStatusAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]StatusDetails{
+		"web":    {Name: "web", Status: StatusRunning, PID: 1234, State: "active/running"},
+		"worker": {Name: "worker", Status: StatusStopped, State: "inactive/dead"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("systemdStatusAll() = %v, want %v", got, want)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("systemctl invoked %d times, want 1", len(*calls))
+	}
+	args := strings.Join((*calls)[0].arguments, " ")
+	if want := "tmpl@a.service web.service worker.service"; !strings.HasSuffix(args, " "+want) {
+		t.Errorf("unexpected systemctl arguments %q", args)
+	}
+}
+
+func Test_systemdDaemonReload(t *testing.T) {
+	defer setUnitDir(t)()
+	defer setExecutablesExist()()
+	reloadErr := error(nil)
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		if arguments[0] == "daemon-reload" {
+			return 1, "", reloadErr
+		}
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+	reloads := func() (n int) {
+		for _, c := range *calls {
+			if c.command == "systemctl" && c.arguments[0] == "daemon-reload" {
+				n++
+			}
+		}
+		return n
+	}
+
+	s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloads(); n != 1 {
+		t.Errorf("Install() ran daemon-reload %d times, want 1", n)
+	}
+	if last := (*calls)[len(*calls)-1]; last.arguments[0] != "daemon-reload" {
+		t.Errorf("Install() ended with %v, want daemon-reload", last)
+	}
+	*calls = nil
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloads(); n != 1 {
+		t.Errorf("Uninstall() ran daemon-reload %d times, want 1", n)
+	}
+
+	reloadErr = errors.New("exit status 1")
+	if err := s.Install(); err == nil || !strings.Contains(err.Error(), "daemon-reload") {
+		t.Errorf("Install() with a failing daemon-reload = %v, want its error", err)
+	}
+}
+
+func Test_systemdReinstall(t *testing.T) {
+	defer setUnitDir(t)()
+	defer setExecutablesExist()()
+	running := false
+	calls, restore := setFakeRunner(func(command string, arguments ...string) (int, string, error) {
+		_, err := os.Stat(filepath.Join(systemdUnitDir, "app.service"))
+		switch arguments[0] {
+		case "is-active":
+			if running {
+				return 0, "active", nil
+			}
+			return 3, "inactive", nil
+		case "list-unit-files":
+			if err == nil {
+				return 0, "app.service enabled", nil
+			}
+			return 1, "", nil
+		}
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+	actions := func() (got []string) {
+		for _, c := range *calls {
+			if c.command == "systemctl" && c.arguments[0] != "--version" {
+				got = append(got, c.arguments[0])
+			}
+		}
+		*calls = nil
+		return got
+	}
+
+	s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app", Arguments: []string{"-v1"}}}
+	if err := Reinstall(s); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := actions(), []string{"is-active", "list-unit-files", "enable", "daemon-reload"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fresh Reinstall() ran %v, want %v", got, want)
+	}
+
+	running = true
+	s.Arguments = []string{"-v2"}
+	if err := Reinstall(s); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := actions(), []string{"is-active", "stop", "disable", "daemon-reload", "enable", "daemon-reload", "start"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upgrade Reinstall() ran %v, want %v", got, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(systemdUnitDir, "app.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "ExecStart=/usr/bin/app \"-v2\"\n") {
+		t.Errorf("upgraded unit is not the new one:\n%s", b)
+	}
+}
+
+func Test_systemdUserService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origConfig := os.Getenv("XDG_CONFIG_HOME")
+	defer os.Setenv("XDG_CONFIG_HOME", origConfig)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	origBus := hasUserBus
+	defer func() { hasUserBus = origBus }()
+	defer setExecutablesExist()()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+
+	s := &systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app", Option: KeyValue{optionUserService: true}}}
+	hasUserBus = func() bool { return false }
+	if err := s.Install(); err != errNoUserBus {
+		t.Fatalf("Install() without a user bus = %v, want errNoUserBus", err)
+	}
+
+	hasUserBus = func() bool { return true }
+	*calls = nil
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := ioutil.ReadFile(filepath.Join(dir, "systemd", "user", "app.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "WantedBy=default.target\n") {
+		t.Errorf("user unit not wanted by default.target:\n%s", unit)
+	}
+	for _, c := range *calls {
+		if c.command == "systemctl" && c.arguments[0] != "--version" && (len(c.arguments) < 2 || c.arguments[1] != "--user") {
+			t.Errorf("Install() ran systemctl %q without --user", c.arguments)
+		}
+	}
+}
+
+func Test_systemdInstallInterrupted(t *testing.T) {
+	defer setUnitDir(t)()
+	defer setExecutablesExist()()
+	unitPath := filepath.Join(systemdUnitDir, "app.service")
+
+	var commands []string
+	orig := commandRunner
+	defer func() { commandRunner = orig }()
+	commandRunner = func(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+		commands = append(commands, strings.Join(arguments, " "))
+		if arguments[0] != "enable" {
+			return 0, "", "", nil
+		}
+		if _, err := os.Stat(unitPath); err != nil {
+			t.Errorf("unit file missing while enabling: %v", err)
+		}
+		// The operator presses Ctrl-C while systemctl enable runs.
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case <-ctx.Done():
+			return 0, "", "", fmt.Errorf("%q: %w", command, ctx.Err())
+		case <-time.After(5 * time.Second):
+			return 0, "", "", errors.New("enable was not interrupted")
+		}
+	}
+
+	err := (&systemd{Config: &Config{Name: "app", Executable: "/usr/bin/app"}}).Install()
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("Install() = %v, want ErrInterrupted", err)
+	}
+	if _, err := os.Stat(unitPath); !os.IsNotExist(err) {
+		t.Errorf("interrupted Install() left the unit file: %v", err)
+	}
+	if want := []string{"--version", "enable app.service"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("Install() ran %q, want %q", commands, want)
+	}
+}
+
+func Test_systemdLabels(t *testing.T) {
+	defer setUnitDir(t)()
+	_, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "systemd 245", nil
+	})
+	defer restore()
+	defer setExecutablesExist()()
+
+	labels := map[string]string{"owner": "team-a", "app.example.com/version": "1.2 = beta"}
+	args := []string{"-c", `say "hi" $HOME\n`, "a\tb", "%i"}
+	s := &systemd{Config: &Config{Name: "app", Executable: "/opt/my app/app", Arguments: args, UserName: "svc", Labels: labels}}
+	if _, err := LoadInstalledConfig(s); err != ErrNotInstalled {
+		t.Fatalf("LoadInstalledConfig() before Install error = %v, want ErrNotInstalled", err)
+	}
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadInstalledConfig(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "app" || !reflect.DeepEqual(c.Labels, labels) {
+		t.Errorf("LoadInstalledConfig() = %+v, want labels %v", c, labels)
+	}
+	if c.Executable != "/opt/my app/app" || !reflect.DeepEqual(c.Arguments, args) || c.UserName != "svc" {
+		t.Errorf("LoadInstalledConfig() = %q %q user %q, want %q %q user svc", c.Executable, c.Arguments, c.UserName, "/opt/my app/app", args)
+	}
+
+	for _, bad := range []map[string]string{{"a b": "x"}, {"owner": "x\ny"}} {
+		if _, err := renderUnit(&Config{Name: "app", Labels: bad}); err == nil {
+			t.Errorf("writeUnit() with labels %q succeeded", bad)
+		}
+	}
+}
+
+func Test_systemdListInstalled(t *testing.T) {
+	defer setUnitDir(t, "other.service")()
+	calls, restore := setFakeRunner(func(string, ...string) (int, string, error) {
+		return 0, "web.service      enabled  enabled\ntmpl@.service    static   -\nworker.service   disabled enabled\nother.service    enabled  enabled\nsshd.service     enabled  enabled\n", nil
+	})
+	defer restore()
+	// sshd is shipped elsewhere with a drop-in, and systemd does not list
+	// the enabled instance of tmpl.
+	for _, unit := range []string{"web.service", "worker.service", "tmpl@.service", "sshd.service.d/override.conf"} {
+		header := "# Generated by " + strings.TrimSuffix(unit, ".service") + " (service pkg)\n[Unit]\n"
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(systemdUnitDir, unit)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(systemdUnitDir, unit), []byte(header), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(systemdUnitDir, "multi-user.target.wants"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../tmpl@.service", filepath.Join(systemdUnitDir, "multi-user.target.wants", "tmpl@a.service")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := systemdListInstalled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web", "worker", "sshd", "tmpl@a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("systemdListInstalled() = %v, want %v", got, want)
+	}
+	if args := strings.Join((*calls)[0].arguments, " "); !strings.HasPrefix(args, "list-unit-files --type=service") {
+		t.Errorf("unexpected systemctl arguments %q", args)
+	}
+
+	os.RemoveAll(systemdUnitDir)
+	if got, err := systemdListInstalled(); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("systemdListInstalled() = %#v, %v, want an empty list", got, err)
+	}
+}
+
+const systemdShowMulti = `Id=web.service
+ActiveState=active
+SubState=running
+MainPID=1234
+
+Id=worker.service
+ActiveState=inactive
+SubState=dead
+MainPID=0
+`
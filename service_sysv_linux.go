@@ -5,16 +5,22 @@
 package service
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
 	"text/template"
 	"time"
 )
 
+// sysvRCDir holds the rcN.d runlevel directories.
+var sysvRCDir = "/etc"
+
 type sysv struct {
 	i        Interface
 	platform string
@@ -22,6 +28,9 @@ type sysv struct {
 }
 
 func newSystemVService(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(startLinkPrefix + c.instanceName()); err != nil {
+		return nil, err
+	}
 	s := &sysv{
 		i:        i,
 		platform: platform,
@@ -42,14 +51,20 @@ func (s *sysv) Platform() string {
 	return s.platform
 }
 
-var errNoUserServiceSystemV = errors.New("User services are not supported on SystemV.")
+// optionCapabilities reports the options the SysV script honors: the
+// supervise loop restarts the service and ulimit limits it.
+func (s *sysv) optionCapabilities() Capabilities {
+	return Capabilities{RestartPolicy: true, ResourceLimits: true}
+}
+
+var errNoUserServiceSystemV = notSupported("user services on SystemV")
 
 func (s *sysv) configPath() (cp string, err error) {
 	if s.Option.bool(optionUserService, optionUserServiceDefault) {
 		err = errNoUserServiceSystemV
 		return
 	}
-	cp = "/etc/init.d/" + s.Config.Name
+	cp = "/etc/init.d/" + s.instanceName()
 	return
 }
 
@@ -57,9 +72,14 @@ func (s *sysv) template() *template.Template {
 	customScript := s.Option.string(optionSysvScript, "")
 
 	if customScript != "" {
-		return template.Must(template.New("").Funcs(tf).Parse(customScript))
+		return s.parseScript(customScript)
 	}
-	return template.Must(template.New("").Funcs(tf).Parse(sysvScript))
+	return s.parseScript(sysvScript)
+}
+
+// InstallScript returns the file Install would write, without writing it.
+func (s *sysv) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
 }
 
 func (s *sysv) Install() error {
@@ -67,92 +87,275 @@ func (s *sysv) Install() error {
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
-	f, err := os.Create(confPath)
-	if err != nil {
+	if err = s.checkPIDFileDir(); err != nil {
+		return err
+	}
+	if err = s.createLogDirectory(); err != nil {
+		return err
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
+		return err
+	}
+	if err = s.checkWorkingDirectory(); err != nil {
 		return err
 	}
-	defer f.Close()
 
+	killLevels := [...]string{"0", "1", "6"}
+	var killPriorities [len(killLevels)]int
+	for n, i := range killLevels {
+		if killPriorities[n], err = s.killPriority(filepath.Join(sysvRCDir, "rc"+i+".d")); err != nil {
+			return err
+		}
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.writeFile(confPath, 0755, s.writeScript); err != nil {
+			return err
+		}
+		if err := s.smokeTest(confPath); err != nil {
+			return err
+		}
+
+		overwrite := s.Option.bool(optionOverwrite, optionOverwriteDefault)
+		link := func(name string) error {
+			return rb.step(func(context.Context) error {
+				return symlink(confPath, name, overwrite)
+			}, func() {
+				os.Remove(name)
+			})
+		}
+		if s.startAtBoot() {
+			for _, i := range [...]string{"2", "3", "4", "5"} {
+				if err := link(filepath.Join(sysvRCDir, "rc"+i+".d", startLinkPrefix+s.instanceName())); err != nil {
+					return err
+				}
+			}
+		}
+		for n, i := range killLevels {
+			if err := link(filepath.Join(sysvRCDir, "rc"+i+".d", fmt.Sprintf("K%02d%s", killPriorities[n], s.instanceName()))); err != nil {
+				return err
+			}
+		}
+
+		if !s.Option.bool(optionCronWatchdog, optionCronWatchdogDefault) {
+			return nil
+		}
+		return rb.step(func(context.Context) error {
+			return installCronWatchdog(confPath)
+		}, func() {
+			removeCronWatchdog(confPath)
+		})
+	})
+}
+
+// killLinkRegexp matches the K link of a service in a runlevel directory.
+var killLinkRegexp = regexp.MustCompile(`^K(\d\d)(.+)$`)
+
+// killPriority returns the priority of the K link in the runlevel
+// directory dir. Services are stopped in increasing priority, so the
+// default of 2 is moved above the services named by StopAfter and below
+// those named by StopBefore.
+func (s *sysv) killPriority(dir string) (int, error) {
+	stopBefore := make(map[string]bool)
+	for _, name := range s.Option.strings(optionStopBefore, nil) {
+		stopBefore[strings.TrimSuffix(name, ".service")] = true
+	}
+	stopAfter := make(map[string]bool)
+	for _, name := range s.Option.strings(optionStopAfter, nil) {
+		stopAfter[strings.TrimSuffix(name, ".service")] = true
+	}
+	if len(stopBefore) == 0 && len(stopAfter) == 0 {
+		return 2, nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	low, high := 0, 99
+	for _, entry := range entries {
+		m := killLinkRegexp.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		priority, _ := strconv.Atoi(m[1])
+		if stopAfter[m[2]] && priority+1 > low {
+			low = priority + 1
+		}
+		if stopBefore[m[2]] && priority-1 < high {
+			high = priority - 1
+		}
+	}
+	if low > high {
+		return 0, fmt.Errorf("no K link priority in %s satisfies %s and %s", dir, optionStopBefore, optionStopAfter)
+	}
+	switch {
+	case 2 < low:
+		return low, nil
+	case 2 > high:
+		return high, nil
+	}
+	return 2, nil
+}
+
+// writeScript renders the init script for the service to w.
+func (s *sysv) writeScript(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
-
-	var to = &struct {
-		*Config
-		Path         string
-		LogDirectory string
-	}{
-		s.Config,
-		path,
-		s.Option.string(optionLogDirectory, defaultLogDirectory),
+	restartPolicy, restartMaxSec, err := s.restartBackoff()
+	if err != nil {
+		return err
 	}
-
-	err = s.template().Execute(f, to)
+	softNOFILE, hardNOFILE, err := s.ulimitNOFILE()
 	if err != nil {
 		return err
 	}
-
-	if err = os.Chmod(confPath, 0755); err != nil {
+	pidFile, err := s.pidFile("")
+	if err != nil {
 		return err
 	}
-	for _, i := range [...]string{"2", "3", "4", "5"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/S50"+s.Name); err != nil {
-			continue
-		}
+	cpuAffinity, err := s.cpuAffinity()
+	if err != nil {
+		return err
 	}
-	for _, i := range [...]string{"0", "1", "6"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/K02"+s.Name); err != nil {
-			continue
+	killTimeout, forceKill, err := s.killTimeout()
+	if err != nil {
+		return err
+	}
+	conditions, err := s.startConditions()
+	if err != nil {
+		return err
+	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
+	if err = s.checkLabels(); err != nil {
+		return err
+	}
+	usage := s.Option.bool(optionIncludeUsage, optionIncludeUsageDefault)
+	var confPath string
+	if usage {
+		if confPath, err = s.configPath(); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	var to = &struct {
+		*Config
+		Name               string
+		Path               string
+		LogDirectory       string
+		ScriptPath         string
+		ScriptLocale       string
+		WorkingDirectories []string
+		RestartPolicy      string
+		RestartMaxSec      int
+		LimitNOFILESoft    string
+		LimitNOFILEHard    string
+		PIDFile            string
+		StartLock          bool
+		CPUAffinity        string
+		ArgumentsRaw       []string
+		LSBDependencies    []string
+		Usage              bool
+		ConfigPath         string
+		Description        string
+		VerifyPID          bool
+		KillTimeout        int
+		ForceKill          bool
+		Conditions         []startCondition
+		UMask              string
+	}{
+		s.Config,
+		s.instanceName(),
+		path,
+		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.Option.string(optionScriptPath, ""),
+		s.Option.string(optionScriptLocale, ""),
+		s.workingDirectories(),
+		restartPolicy,
+		restartMaxSec,
+		softNOFILE,
+		hardNOFILE,
+		pidFile,
+		s.Option.bool(optionStartLock, optionStartLockDefault),
+		cpuAffinity,
+		s.Option.strings(optionArgumentsRaw, nil),
+		s.lsbDependencies(),
+		usage,
+		confPath,
+		s.description(),
+		s.Option.bool(optionVerifyPID, optionVerifyPIDDefault),
+		scriptSeconds(killTimeout),
+		forceKill,
+		conditions,
+		umask,
+	}
+
+	return s.template().Execute(w, to)
 }
 
 func (s *sysv) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *sysv) uninstall() error {
 	cp, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	if err := os.Remove(cp); err != nil {
-		return err
+	err = removePaths(cp)
+	if s.Option.bool(optionCronWatchdog, optionCronWatchdogDefault) {
+		err = joinErrors(err, removeCronWatchdog(cp))
 	}
-	return nil
+	return err
+}
+
+// ReadLogs returns the tail of the log files the script writes.
+func (s *sysv) ReadLogs(lines int) ([]string, error) {
+	return s.readLogFiles(lines, ".log", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *sysv) ReadLogsSince(since time.Time) ([]string, error) {
+	return s.readLogFilesSince(since, ".log", ".err")
 }
 
 func (s *sysv) Logger(errs chan<- error) (Logger, error) {
-	if system.Interactive() {
+	if s.interactive(system.Interactive()) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *sysv) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
-func (s *sysv) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+func (s *sysv) Run() error {
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *sysv) Status() (Status, error) {
-	_, out, err := runWithOutput("service", s.Name, "status")
+	_, out, err := runWithOutput("service", s.instanceName(), "status")
 	if err != nil {
 		return StatusUnknown, err
 	}
@@ -167,12 +370,37 @@ func (s *sysv) Status() (Status, error) {
 	}
 }
 
+// IsEnabled reports whether a start link of the service exists in any
+// of the runlevels Install links it in.
+func (s *sysv) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	var links []string
+	for _, i := range [...]string{"2", "3", "4", "5"} {
+		links = append(links, filepath.Join(sysvRCDir, "rc"+i+".d", startLinkPrefix+s.instanceName()))
+	}
+	return linkEnabled(confPath, links...)
+}
+
 func (s *sysv) Start() error {
-	return run("service", s.Name, "start")
+	return run("service", s.instanceName(), "start")
+}
+
+// RestartHistory returns the restarts of the supervise loop of the
+// script.
+func (s *sysv) RestartHistory() (int, time.Time, error) {
+	return s.restartHistory("/var/run/{{.Name}}.pid")
 }
 
 func (s *sysv) Stop() error {
-	return run("service", s.Name, "stop")
+	if s.Option.bool(optionVerifyPID, optionVerifyPIDDefault) && s.Option.string(optionSysvScript, "") == "" {
+		if err := s.checkPIDOwner("/proc", "/var/run/{{.Name}}.pid"); err != nil {
+			return err
+		}
+	}
+	return s.runStop("service", s.instanceName(), "stop")
 }
 
 func (s *sysv) Restart() error {
@@ -185,25 +413,36 @@ func (s *sysv) Restart() error {
 }
 
 const sysvScript = `#!/bin/sh
+# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg){{template "usage" .}}
+{{- range $k, $v := .Labels}}
+# label: {{$k}}={{$v}}
+{{- end}}
 # For RedHat and cousins:
 # chkconfig: - 99 01
 # description: {{.Description}}
 # processname: {{.Path}}
 
 ### BEGIN INIT INFO
-# Provides:          {{.Path}}
-# Required-Start:
-# Required-Stop:
+# Provides:          {{.Name}}
+# Required-Start:{{if .LSBDependencies}}    {{join " " .LSBDependencies}}{{end}}
+# Required-Stop:{{if .LSBDependencies}}     {{join " " .LSBDependencies}}{{end}}
 # Default-Start:     2 3 4 5
 # Default-Stop:      0 1 6
 # Short-Description: {{.DisplayName}}
 # Description:       {{.Description}}
 ### END INIT INFO
+{{- if .ScriptPath}}
 
-cmd="{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}"
+export PATH={{.ScriptPath|cmd}}
+{{- end}}
+{{- if .ScriptLocale}}
+export LANG={{.ScriptLocale|cmd}}
+{{- end}}
+
+cmd="{{if .CPUAffinity}}taskset -c {{.CPUAffinity}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{range .ArgumentsRaw}} {{.|rawcmd}}{{end}}"
 
 name=$(basename $(readlink -f $0))
-pid_file="/var/run/$name.pid"
+pid_file={{if .PIDFile}}{{.PIDFile|cmd}}{{else}}"/var/run/$name.pid"{{end}}
 stdout_log="{{.LogDirectory}}/$name.log"
 stderr_log="{{.LogDirectory}}/$name.err"
 
@@ -220,15 +459,38 @@ get_pid() {
 is_running() {
     [ -f "$pid_file" ] && cat /proc/$(get_pid)/stat > /dev/null 2>&1
 }
+{{- if .VerifyPID}}
+
+{{template "ownspid" .}}
+{{- end}}
+{{- if .RestartPolicy}}
+
+{{template "supervise" .}}
+{{- end}}
 
 case "$1" in
     start)
+        {{- range .Conditions}}
+        if {{.ShellUnmet}}; then
+            echo "Not starting $name:" {{.ShellValue}} "is not met"
+            exit 0
+        fi
+        {{- end}}
+        {{- if .StartLock}}
+        {{template "startlock" .}}
+        {{- end}}
         if is_running; then
             echo "Already started"
         else
             echo "Starting $name"
-            {{if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
-            $cmd >> "$stdout_log" 2>> "$stderr_log" &
+            {{- if .LimitNOFILEHard}}
+            ulimit -Hn {{.LimitNOFILEHard}} && ulimit -Sn {{.LimitNOFILESoft}} || exit 1
+            {{- end}}
+            {{- if .UMask}}
+            umask {{.UMask}}
+            {{- end}}
+            {{if .WorkingDirectories}}{{template "cd" .}}{{else if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
+            {{if .RestartPolicy}}(supervise){{else}}$cmd{{end}}{{if .StartLock}} 9>&-{{end}} >> "$stdout_log" 2>> "$stderr_log" < /dev/null &
             echo $! > "$pid_file"
             if ! is_running; then
                 echo "Unable to start, see $stdout_log and $stderr_log"
@@ -238,9 +500,15 @@ case "$1" in
     ;;
     stop)
         if is_running; then
+            {{- if .VerifyPID}}
+            if ! owns_pid; then
+                echo "Not stopping $name: pid $(get_pid) runs another program"
+                exit 1
+            fi
+            {{- end}}
             echo -n "Stopping $name.."
             kill $(get_pid)
-            for i in $(seq 1 10)
+            for i in $(seq 1 {{.KillTimeout}})
             do
                 if ! is_running; then
                     break
@@ -249,6 +517,23 @@ case "$1" in
                 sleep 1
             done
             echo
+            {{- if .ForceKill}}
+            if is_running; then
+                echo "Not stopped after {{.KillTimeout}}s, killing $name"
+                pid=$(get_pid)
+                {{- if .RestartPolicy}}
+                # Freeze the supervisor so it cannot start another child meanwhile.
+                kill -STOP "$pid" 2> /dev/null
+                pkill -KILL -P "$pid"
+                {{- end}}
+                kill -9 "$pid" 2> /dev/null
+                sleep 1
+                # Killed but not reaped yet, as under an init that does not reap.
+                if [ "$(sed 's/.*) //; s/ .*//' /proc/$pid/stat 2> /dev/null)" = Z ]; then
+                    rm -f "$pid_file"
+                fi
+            fi
+            {{- end}}
             if is_running; then
                 echo "Not stopped; may still be shutting down or shutdown may have failed"
                 exit 1
@@ -285,3 +570,23 @@ case "$1" in
 esac
 exit 0
 `
+
+// sysvListInstalled lists the services started in the default runlevel.
+func sysvListInstalled() ([]string, error) {
+	return listStartLinks(filepath.Join(sysvRCDir, "rc2.d"))
+}
+
+// LoadInstalledConfig recovers the Labels, the executable and the Arguments
+// from the installed init script.
+func (s *sysv) LoadInstalledConfig() (*Config, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return nil, err
+	}
+	c, err := readInstalledConfig(confPath, scriptLabelPrefix, parseScriptLine)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = s.Name
+	return c, nil
+}
@@ -9,22 +9,92 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log/syslog"
+	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
 )
 
 const defaultLogDirectory = "/var/log"
 
-func newSysLogger(name string, errs chan<- error) (Logger, error) {
-	w, err := syslog.New(syslog.LOG_INFO, name)
+// syslogFacilities maps the names accepted by the SyslogFacility option to
+// their facility.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogPriority returns the priority the system logger of c writes with:
+// LOG_INFO combined with the SyslogFacility option, if set.
+func (c *Config) syslogPriority() (syslog.Priority, error) {
+	name := c.Option.string(optionSyslogFacility, "")
+	if name == "" {
+		return syslog.LOG_INFO, nil
+	}
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %q: unknown syslog facility", optionSyslogFacility, name)
+	}
+	return facility | syslog.LOG_INFO, nil
+}
+
+// newSysLogger returns a Logger writing to the local syslog, or to the
+// collector at the SyslogAddr option when set. When dialing the collector
+// fails, it falls back to the local syslog with a warning. Dialing over
+// udp only fails when the address does not resolve, as nothing is sent.
+func newSysLogger(c *Config, errs chan<- error) (Logger, error) {
+	priority, err := c.syslogPriority()
 	if err != nil {
 		return nil, err
 	}
-	return sysLogger{w, errs}, nil
+	var dialErr error
+	if addr := c.Option.string(optionSyslogAddr, ""); addr != "" {
+		network := c.Option.string(optionSyslogNetwork, optionSyslogNetworkDefault)
+		if network != "udp" && network != "tcp" {
+			return nil, fmt.Errorf("invalid %s %q: must be udp or tcp", optionSyslogNetwork, network)
+		}
+		w, err := syslog.Dial(network, addr, priority, c.Name)
+		if err == nil {
+			return sysLogger{w, errs}, nil
+		}
+		dialErr = fmt.Errorf("cannot reach syslog at %s://%s, logging locally: %v", network, addr, err)
+	}
+	w, err := syslog.New(priority, c.Name)
+	if err != nil {
+		return nil, joinErrors(dialErr, err)
+	}
+	l := sysLogger{w, errs}
+	if dialErr != nil {
+		l.Warning(dialErr)
+	}
+	return l, nil
 }
 
 type sysLogger struct {
@@ -57,78 +127,381 @@ func (s sysLogger) Warningf(format string, a ...interface{}) error {
 func (s sysLogger) Infof(format string, a ...interface{}) error {
 	return s.send(s.Writer.Info(fmt.Sprintf(format, a...)))
 }
+func (s sysLogger) Close() error {
+	// syslog.Writer tolerates repeated calls to Close.
+	return s.Writer.Close()
+}
+func (s sysLogger) WithFields(fields map[string]interface{}) Logger {
+	return fieldLogger{s, formatFields(fields)}
+}
+
+// handledSignals are the signals relayed to a SignalHandler besides the
+// stop signals.
+var handledSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// runLoop implements Run for the unix backends: it starts i, waits for
+// SIGTERM, an interrupt or the RunWait option, then stops i. If i is a
+// SignalHandler, the signals caught meanwhile are relayed to it. Lifecycle
+// events are reported to the RunLogger option when set. The OnExit option
+// is called last, after the signals are released.
+func runLoop(s Service, i Interface, c *Config) error {
+	logf := c.runLogf()
+
+	// Signals are caught before Start, so that one arriving while the
+	// program starts is not lost.
+	wait := c.Option.funcSingle(optionRunWait, nil)
+	handler, _ := i.(SignalHandler)
+	var sigChan = make(chan os.Signal, 3)
+	if handler != nil {
+		signal.Notify(sigChan, handledSignals...)
+	}
+	if wait == nil {
+		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	}
+	defer signal.Stop(sigChan)
+
+	err := i.Start(s)
+	if err != nil {
+		logf("start failed: %v", err)
+		return err
+	}
+	logf("started %s", c.Name)
+	if err := c.recordLifecycle(true, time.Now()); err != nil {
+		logf("%v", err)
+	}
+
+	if wait != nil {
+		done := make(chan struct{})
+		go func() {
+			wait()
+			close(done)
+		}()
+		for waiting := true; waiting; {
+			select {
+			case sig := <-sigChan:
+				relaySignal(handler, sig, logf)
+			case <-done:
+				waiting = false
+			}
+		}
+		logf("RunWait returned, stopping")
+	} else {
+		for {
+			sig := <-sigChan
+			relaySignal(handler, sig, logf)
+			if sig == syscall.SIGTERM || sig == os.Interrupt {
+				logf("received %v, stopping", signalName(sig))
+				break
+			}
+		}
+	}
+	signal.Stop(sigChan)
+
+	begin := time.Now()
+	err = i.Stop(s)
+	logf("stop took %dms", time.Since(begin)/time.Millisecond)
+	if err != nil {
+		logf("stop failed: %v", err)
+		return c.onExit(err)
+	}
+	if err := c.recordLifecycle(false, time.Now()); err != nil {
+		logf("%v", err)
+	}
+	return c.onExit(nil)
+}
+
+// relaySignal passes sig to h, if set, and logs the error it returns.
+func relaySignal(h SignalHandler, sig os.Signal, logf func(format string, a ...interface{})) {
+	if h == nil {
+		return
+	}
+	if err := h.HandleSignal(sig); err != nil {
+		logf("handling %v failed: %v", signalName(sig), err)
+	}
+}
+
+// removePaths removes the files and directories an Uninstall deletes. It
+// attempts every path, so that what is left of a partial install is
+// cleaned up, such as a start link whose script is gone. Missing paths
+// are skipped, unless none exists: then the service is not installed
+// and the error for the first path is returned.
+func removePaths(paths ...string) error {
+	var errs []error
+	var missing error
+	removed := false
+	for _, p := range paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			if missing == nil {
+				missing = err
+			}
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = true
+	}
+	if !removed && len(errs) == 0 {
+		return missing
+	}
+	return joinErrors(errs...)
+}
+
+// signalName returns the conventional name of sig, such as SIGTERM.
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case os.Interrupt:
+		return "SIGINT"
+	case syscall.SIGHUP:
+		return "SIGHUP"
+	case syscall.SIGUSR1:
+		return "SIGUSR1"
+	case syscall.SIGUSR2:
+		return "SIGUSR2"
+	}
+	return sig.String()
+}
+
+// validateScriptName checks that the service can be installed as an init
+// script. The name is used both as a file name and as an unquoted shell
+// word, so it may not contain whitespace. fileName is the longest file
+// name the system derives from it, such as an rc link name.
+func (c *Config) validateScriptName(fileName string) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	name := c.instanceName()
+	bad := invalidNameChars(name, func(r rune) bool {
+		return r != '/' && !unicode.IsSpace(r) && !unicode.IsControl(r)
+	})
+	if bad != "" {
+		return fmt.Errorf("invalid service name %q: contains %s", name, bad)
+	}
+	if len(fileName) > maxNameLength {
+		return fmt.Errorf("invalid service name %q: %s is longer than %d bytes", name, fileName, maxNameLength)
+	}
+	return nil
+}
+
+// linkEnabled reports whether any of links exists, for the backends that
+// start a service at boot through a link Install creates. It returns
+// ErrNotInstalled if confPath, the main file Install writes, is missing.
+func linkEnabled(confPath string, links ...string) (bool, error) {
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		return false, ErrNotInstalled
+	} else if err != nil {
+		return false, err
+	}
+	for _, link := range links {
+		_, err := os.Lstat(link)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// symlink creates newname as a link to oldname. When replace is set, an
+// existing file at newname is removed first.
+func symlink(oldname, newname string, replace bool) error {
+	if replace {
+		if err := os.Remove(newname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Symlink(oldname, newname)
+}
+
+// commandRunner executes external commands for the backends until ctx is
+// done and returns the exit status, stdout and stderr. Tests replace it to
+// return canned output without spawning processes.
+var commandRunner = runCommandContext
 
 func run(command string, arguments ...string) error {
-	_, _, err := runCommand(command, false, arguments...)
+	return runContext(context.Background(), command, arguments...)
+}
+
+// runContext runs command like run, stopping it early when ctx is done.
+func runContext(ctx context.Context, command string, arguments ...string) error {
+	_, _, _, err := runCommand(ctx, command, false, arguments...)
 	return err
 }
 
 func runWithOutput(command string, arguments ...string) (int, string, error) {
-	return runCommand(command, true, arguments...)
+	exitStatus, stdout, _, err := runWithOutputAll(command, arguments...)
+	return exitStatus, stdout, err
 }
 
-func runCommand(command string, readStdout bool, arguments ...string) (int, string, error) {
-	cmd := exec.Command(command, arguments...)
-
-	var output string
-	var stdout io.ReadCloser
-	var err error
+// runWithOutputAll runs command and returns its exit status along with
+// everything it wrote to stdout and stderr.
+func runWithOutputAll(command string, arguments ...string) (int, string, string, error) {
+	return runCommand(context.Background(), command, true, arguments...)
+}
 
-	if readStdout {
-		// Connect pipe to read Stdout
-		stdout, err = cmd.StdoutPipe()
+// runCommand runs command through commandRunner, limited to
+// CommandTimeout.
+func runCommand(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	return commandRunner(ctx, command, readStdout, arguments...)
+}
 
-		if err != nil {
-			// Failed to connect pipe
-			return 0, "", fmt.Errorf("%q failed to connect stdout pipe: %v", command, err)
-		}
+// runStop runs the stop command of a service. With the StopTimeout option
+// set, a command still running after it is killed and an error wrapping
+// ErrStopTimeout is returned, telling a hung command from one that
+// reported failure. Otherwise only CommandTimeout applies.
+func (c *Config) runStop(command string, arguments ...string) error {
+	if _, ok := c.Option[optionStopTimeout]; !ok {
+		return run(command, arguments...)
+	}
+	timeout := c.Option.duration(optionStopTimeout, optionStopTimeoutDefault)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := runContext(ctx, command, arguments...)
+	// The CommandTimeout deadline may have expired instead.
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %v", ErrStopTimeout, err)
 	}
+	return err
+}
+
+// pipeDrainTimeout is how long the output of a command is still read
+// after it exits. A process the command left running in the background,
+// such as the supervisor started by an init script, may keep the output
+// open, so it is not read to the end.
+const pipeDrainTimeout = 100 * time.Millisecond
 
-	// Connect pipe to read Stderr
-	stderr, err := cmd.StderrPipe()
+// outputPipe collects what a command writes to one of its outputs.
+type outputPipe struct {
+	r    *os.File
+	buf  bytes.Buffer
+	done chan struct{}
+}
 
+// newOutputPipe returns a pipe collecting output and the file to pass to
+// the command as that output. The caller closes the file once the
+// command started.
+func newOutputPipe() (*outputPipe, *os.File, error) {
+	r, w, err := os.Pipe()
 	if err != nil {
-		// Failed to connect pipe
-		return 0, "", fmt.Errorf("%q failed to connect stderr pipe: %v", command, err)
+		return nil, nil, err
 	}
+	p := &outputPipe{r: r, done: make(chan struct{})}
+	go func() {
+		io.Copy(&p.buf, r)
+		close(p.done)
+	}()
+	return p, w, nil
+}
 
-	// Do not use cmd.Run()
-	if err := cmd.Start(); err != nil {
-		// Problem while copying stdin, stdout, or stderr
-		return 0, "", fmt.Errorf("%q failed: %v", command, err)
+// finish returns the output, waiting until deadline at most for the pipe
+// to be closed by the processes still holding it.
+func (p *outputPipe) finish(deadline time.Time) string {
+	if p == nil {
+		return ""
+	}
+	if err := p.r.SetReadDeadline(deadline); err != nil {
+		p.r.Close()
 	}
+	<-p.done
+	p.r.Close()
+	return p.buf.String()
+}
+
+// runCommandContext runs command and returns its exit status, stdout if
+// readStdout is set, and stderr. It kills the command together with any
+// process it started when ctx is done. It returns once the command
+// exits, even if a process it left running keeps its output open.
+func runCommandContext(ctx context.Context, command string, readStdout bool, arguments ...string) (int, string, string, error) {
+	cmd := exec.Command(command, arguments...)
+	// Run in a new process group so that children can be killed too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	// Zero exit status
-	// Darwin: launchctl can fail with a zero exit status,
-	// so check for emtpy stderr
-	if command == "launchctl" {
-		slurp, _ := ioutil.ReadAll(stderr)
-		if len(slurp) > 0 && !bytes.HasSuffix(slurp, []byte("Operation now in progress\n")) {
-			return 0, "", fmt.Errorf("%q failed with stderr: %s", command, slurp)
+	// The files are passed to the command as they are, so Wait does not
+	// wait for the output to be closed as it would with a Writer.
+	var stdout, stderr *outputPipe
+	var writers []*os.File
+	closeWriters := func() {
+		for _, w := range writers {
+			w.Close()
 		}
 	}
-
 	if readStdout {
-		out, err := ioutil.ReadAll(stdout)
+		p, w, err := newOutputPipe()
 		if err != nil {
-			return 0, "", fmt.Errorf("%q failed while attempting to read stdout: %v", command, err)
-		} else if len(out) > 0 {
-			output = string(out)
+			return 0, "", "", fmt.Errorf("%q failed to connect stdout pipe: %v", command, err)
 		}
+		stdout, cmd.Stdout = p, w
+		writers = append(writers, w)
+	}
+	p, w, err := newOutputPipe()
+	if err != nil {
+		closeWriters()
+		stdout.finish(time.Now())
+		return 0, "", "", fmt.Errorf("%q failed to connect stderr pipe: %v", command, err)
 	}
+	stderr, cmd.Stderr = p, w
+	writers = append(writers, w)
 
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Start()
+	// The command has its own copies now.
+	closeWriters()
+	if err != nil {
+		stdout.finish(time.Now())
+		stderr.finish(time.Now())
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return 0, "", "", fmt.Errorf("%q: %w", command, ErrCommandNotFound)
+		}
+		return 0, "", "", fmt.Errorf("%q failed: %v", command, err)
+	}
+
+	// The process group is only killed until Wait returns: once the
+	// command exited, the group holds what it started on purpose, such as
+	// the supervise loop of an init script.
+	var mu sync.Mutex
+	exited, killed := false, false
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !exited {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				killed = true
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	mu.Lock()
+	exited = true
+	mu.Unlock()
+	drainBy := time.Now().Add(pipeDrainTimeout)
+	outStr, errStr := stdout.finish(drainBy), stderr.finish(drainBy)
+	if killed {
+		return 0, outStr, errStr, fmt.Errorf("%q: %w", command, ctx.Err())
+	}
+	if err != nil {
 		exitStatus, ok := isExitError(err)
 		if ok {
 			// Command didn't exit with a zero exit status.
-			return exitStatus, output, err
+			return exitStatus, outStr, errStr, err
 		}
 
 		// An error occurred and there is no exit status.
-		return 0, output, fmt.Errorf("%q failed: %v", command, err)
+		return 0, outStr, errStr, fmt.Errorf("%q failed: %v", command, err)
 	}
 
-	return 0, output, nil
+	return 0, outStr, errStr, nil
 }
 
 func isExitError(err error) (int, bool) {
@@ -0,0 +1,454 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || solaris || aix || freebsd
+// +build linux darwin solaris aix freebsd
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestSysLogger returns a sysLogger writing to a local UDP listener and
+// a function returning the next message the listener received. The
+// returned close function releases both ends.
+func newTestSysLogger(t *testing.T) (sysLogger, func() string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := syslog.Dial("udp", conn.LocalAddr().String(), syslog.LOG_INFO, "test")
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	next := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	return sysLogger{w, nil}, next, func() {
+		w.Close()
+		conn.Close()
+	}
+}
+
+func TestSysLoggerWithFields(t *testing.T) {
+	l, next, closeLogger := newTestSysLogger(t)
+	defer closeLogger()
+
+	err := l.WithFields(map[string]interface{}{"user": "bob", "id": 7}).Info("msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); !strings.HasSuffix(strings.TrimSpace(got), "id=7 user=bob msg") {
+		t.Errorf("syslog message = %q, want fields inlined before msg", got)
+	}
+
+	err = l.WithFields(map[string]interface{}{"a": "x y"}).WithFields(map[string]interface{}{"b": 1}).Errorf("n=%d", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); !strings.HasSuffix(strings.TrimSpace(got), `a="x y" b=1 n=2`) {
+		t.Errorf("syslog message = %q, want chained fields", got)
+	}
+}
+
+func TestSyslogPriority(t *testing.T) {
+	for _, tt := range []struct {
+		facility interface{}
+		want     syslog.Priority
+		wantErr  bool
+	}{
+		{nil, syslog.LOG_INFO, false},
+		{"local0", syslog.LOG_LOCAL0 | syslog.LOG_INFO, false},
+		{"Daemon", syslog.LOG_DAEMON | syslog.LOG_INFO, false},
+		{"local8", 0, true},
+	} {
+		c := &Config{Name: "app", Option: KeyValue{}}
+		if tt.facility != nil {
+			c.Option[optionSyslogFacility] = tt.facility
+		}
+		got, err := c.syslogPriority()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("syslogPriority() with %v = %v, %v, want %v, error %v", tt.facility, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := newSysLogger(&Config{Name: "app", Option: KeyValue{optionSyslogFacility: "bogus"}}, nil); err == nil {
+		t.Error("newSysLogger() with an unknown facility succeeded")
+	}
+}
+
+func TestRemoteSysLogger(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Config{Name: "app", Option: KeyValue{
+		optionSyslogAddr:     conn.LocalAddr().String(),
+		optionSyslogFacility: "local0",
+	}}
+	l, err := newSysLogger(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.(sysLogger).Close()
+	if err := l.Info("hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// <134> is LOG_LOCAL0|LOG_INFO.
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<134>") || !strings.Contains(msg, "app") || !strings.HasSuffix(msg, "hello\n") {
+		t.Errorf("collector received %q", msg)
+	}
+
+	c.Option[optionSyslogNetwork] = "unix"
+	if _, err := newSysLogger(c, nil); err == nil {
+		t.Errorf("newSysLogger() with %s unix succeeded", optionSyslogNetwork)
+	}
+
+	// Nothing listens on a just closed TCP port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	c.Option = KeyValue{optionSyslogNetwork: "tcp", optionSyslogAddr: ln.Addr().String()}
+	l, err = newSysLogger(c, nil)
+	if err != nil {
+		if !strings.Contains(err.Error(), "logging locally") {
+			t.Errorf("newSysLogger() error = %v, want the unreachable collector reported", err)
+		}
+		t.Skipf("no local syslog to fall back to: %v", err)
+	}
+	l.(sysLogger).Close()
+}
+
+func TestSysLoggerCloseTwice(t *testing.T) {
+	l, _, closeLogger := newTestSysLogger(t)
+	defer closeLogger()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("first Close() = %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("second Close() = %v", err)
+	}
+}
+
+type runLoopProgram struct {
+	startErr error
+	stopErr  error
+	stopped  bool
+}
+
+func (p *runLoopProgram) Start(s Service) error { return p.startErr }
+func (p *runLoopProgram) Stop(s Service) error {
+	p.stopped = true
+	return p.stopErr
+}
+
+func TestRunLoopLogger(t *testing.T) {
+	var buf bytes.Buffer
+	p := &runLoopProgram{}
+	c := &Config{
+		Name: "runloop",
+		Option: KeyValue{
+			optionRunWait:   func() {},
+			optionRunLogger: &buf,
+		},
+	}
+	if err := runLoop(&stubService{name: "runloop"}, p, c); err != nil {
+		t.Fatal(err)
+	}
+	if !p.stopped {
+		t.Error("Stop was not called")
+	}
+	for _, want := range []string{"started runloop", "RunWait returned, stopping", "stop took "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("run log = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+
+	buf.Reset()
+	p = &runLoopProgram{startErr: errors.New("boom")}
+	if err := runLoop(&stubService{name: "runloop"}, p, c); err == nil {
+		t.Fatal("runLoop() = nil, want the Start error")
+	}
+	if p.stopped {
+		t.Error("Stop was called after a failed Start")
+	}
+	if !strings.Contains(buf.String(), "start failed: boom") {
+		t.Errorf("run log = %q, want the start failure", buf.String())
+	}
+}
+
+func TestRunLoopOnExit(t *testing.T) {
+	for _, stopErr := range []error{nil, errors.New("boom")} {
+		p := &runLoopProgram{stopErr: stopErr}
+		called := false
+		c := &Config{Name: "runloop", Option: KeyValue{
+			optionRunWait: func() {},
+			optionOnExit: func(err error) {
+				called = true
+				if !p.stopped {
+					t.Error("OnExit was called before Stop")
+				}
+				if err != stopErr {
+					t.Errorf("OnExit(%v), want %v", err, stopErr)
+				}
+			},
+		}}
+		if err := runLoop(&stubService{name: "runloop"}, p, c); err != stopErr {
+			t.Errorf("runLoop() = %v, want %v", err, stopErr)
+		}
+		if !called {
+			t.Errorf("OnExit was not called with stop error %v", stopErr)
+		}
+	}
+
+	c := &Config{Name: "runloop", Option: KeyValue{
+		optionRunWait: func() {},
+		optionOnExit:  func(error) { t.Error("OnExit was called after a failed Start") },
+	}}
+	runLoop(&stubService{name: "runloop"}, &runLoopProgram{startErr: errors.New("boom")}, c)
+}
+
+func TestRunLoopMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "runloop.prom")
+	c := &Config{Name: "runloop", Option: KeyValue{
+		optionRunWait:     func() {},
+		optionMetricsFile: path,
+	}}
+	for i := 0; i < 3; i++ {
+		begin := time.Now()
+		if err := runLoop(&stubService{name: "runloop"}, &runLoopProgram{}, c); err != nil {
+			t.Fatal(err)
+		}
+		m, err := readMetrics(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Restarts != int64(i) {
+			t.Errorf("run %d: restarts = %d, want %d", i, m.Restarts, i)
+		}
+		if from := float64(begin.Unix()); m.StartTime < from || m.StopTime < m.StartTime {
+			t.Errorf("run %d: start %v, stop %v, want both after %v", i, m.StartTime, m.StopTime, from)
+		}
+	}
+}
+
+// signalProgram records the signals relayed to it.
+type signalProgram struct {
+	runLoopProgram
+	started chan struct{}
+	signals chan os.Signal
+}
+
+func (p *signalProgram) Start(s Service) error {
+	close(p.started)
+	return nil
+}
+
+func (p *signalProgram) HandleSignal(sig os.Signal) error {
+	p.signals <- sig
+	if sig == syscall.SIGUSR2 {
+		return errors.New("not supported")
+	}
+	return nil
+}
+
+func TestRunLoopSignalHandler(t *testing.T) {
+	var buf bytes.Buffer
+	p := &signalProgram{started: make(chan struct{}), signals: make(chan os.Signal, 3)}
+	c := &Config{Name: "runloop", Option: KeyValue{optionRunLogger: &buf}}
+	errc := make(chan error, 1)
+	go func() { errc <- runLoop(&stubService{name: "runloop"}, p, c) }()
+	<-p.started
+
+	for _, sig := range []syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM} {
+		if err := syscall.Kill(os.Getpid(), sig); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-p.signals:
+			if got != sig {
+				t.Errorf("HandleSignal(%v), want %v", got, sig)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v was not relayed", sig)
+		}
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runLoop did not stop on SIGTERM")
+	}
+	if !p.stopped {
+		t.Error("Stop was not called")
+	}
+	for _, want := range []string{"handling SIGUSR2 failed: not supported", "received SIGTERM, stopping"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("run log = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestRemovePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	sub := filepath.Join(dir, "sub")
+	missing := filepath.Join(dir, "missing")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sub, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removePaths(missing, file, sub); err != nil {
+		t.Fatalf("removePaths() = %v", err)
+	}
+	for _, p := range []string{file, sub} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("removePaths() left %s", p)
+		}
+	}
+	if err := removePaths(missing, file); !os.IsNotExist(err) {
+		t.Errorf("removePaths() of missing paths = %v, want a not-exist error", err)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+	if err := joinErrors(nil, nil); err != nil {
+		t.Errorf("joinErrors(nil, nil) = %v", err)
+	}
+	one := errors.New("one")
+	if err := joinErrors(nil, one); err != one {
+		t.Errorf("joinErrors(nil, one) = %v, want one", err)
+	}
+	err := joinErrors(one, fmt.Errorf("wrapped: %w", ErrNotInstalled))
+	if err.Error() != "one\nwrapped: the service is not installed" {
+		t.Errorf("joinErrors() = %q", err)
+	}
+	if !errors.Is(err, one) || !errors.Is(err, ErrNotInstalled) || errors.Is(err, ErrNotSupported) {
+		t.Errorf("errors.Is does not match exactly the joined errors of %v", err)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	for _, command := range []string{"no-such-command-for-service-test", "/no/such/command"} {
+		_, _, _, err := runCommand(context.Background(), command, false)
+		if !errors.Is(err, ErrCommandNotFound) {
+			t.Errorf("runCommand(%q) error = %v, want ErrCommandNotFound", command, err)
+		}
+	}
+
+	exitStatus, _, _, err := runCommand(context.Background(), "false", false)
+	if err == nil || errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("runCommand(false) error = %v, want a command failure", err)
+	}
+	if exitStatus != 1 {
+		t.Errorf("runCommand(false) exit status = %d, want 1", exitStatus)
+	}
+}
+
+func TestRunWithOutputAll(t *testing.T) {
+	exitStatus, stdout, stderr, err := runWithOutputAll("sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil || exitStatus != 3 {
+		t.Errorf("runWithOutputAll() = %d, %v, want exit status 3", exitStatus, err)
+	}
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Errorf("runWithOutputAll() stdout = %q, stderr = %q, want %q and %q", stdout, stderr, "out\n", "err\n")
+	}
+
+	exitStatus, stdout, err = runWithOutput("sh", "-c", "echo out; echo err >&2")
+	if err != nil || exitStatus != 0 || stdout != "out\n" {
+		t.Errorf("runWithOutput() = %d, %q, %v, want 0, %q, nil", exitStatus, stdout, err, "out\n")
+	}
+}
+
+func TestRunCommandBackground(t *testing.T) {
+	// The background sleep keeps stdout and stderr open after the shell
+	// exits, which must not hold up the command.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, stdout, _, err := runCommandContext(ctx, "sh", true, "-c", "sleep 30 & echo $!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("runCommandContext() returned after %v", elapsed)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil {
+		t.Fatalf("stdout = %q, want the pid of the sleep", stdout)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	// The deadline passing after the command exited leaves the sleep
+	// running.
+	<-ctx.Done()
+	time.Sleep(100 * time.Millisecond)
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil || strings.HasPrefix(strings.TrimSpace(string(out)), "Z") {
+		t.Errorf("background process killed after the deadline: ps = %q, %v", out, err)
+	}
+}
+
+func TestRunCommandContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The background sleep holds stdout open, so the command only returns
+	// early if the whole process group is killed.
+	start := time.Now()
+	_, _, _, err := runCommandContext(ctx, "sh", true, "-c", "sleep 30 & wait")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("runCommandContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runCommandContext() returned after %v, want the command killed", elapsed)
+	}
+}
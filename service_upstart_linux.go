@@ -5,14 +5,14 @@
 package service
 
 import (
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
 	"regexp"
 	"strings"
-	"syscall"
 	"text/template"
+	"time"
 )
 
 func isUpstart() bool {
@@ -36,6 +36,9 @@ type upstart struct {
 }
 
 func newUpstartService(i Interface, platform string, c *Config) (Service, error) {
+	if err := c.validateScriptName(c.instanceName() + ".conf"); err != nil {
+		return nil, err
+	}
 	s := &upstart{
 		i:        i,
 		platform: platform,
@@ -56,17 +59,23 @@ func (s *upstart) Platform() string {
 	return s.platform
 }
 
+// optionCapabilities reports the options upstart honors: Restart maps to
+// respawn.
+func (s *upstart) optionCapabilities() Capabilities {
+	return Capabilities{RestartPolicy: true}
+}
+
 // Upstart has some support for user services in graphical sessions.
 // Due to the mix of actual support for user services over versions, just don't bother.
 // Upstart will be replaced by systemd in most cases anyway.
-var errNoUserServiceUpstart = errors.New("User services are not supported on Upstart.")
+var errNoUserServiceUpstart = notSupported("user services on Upstart")
 
 func (s *upstart) configPath() (cp string, err error) {
 	if s.Option.bool(optionUserService, optionUserServiceDefault) {
 		err = errNoUserServiceUpstart
 		return
 	}
-	cp = "/etc/init/" + s.Config.Name + ".conf"
+	cp = "/etc/init/" + s.instanceName() + ".conf"
 	return
 }
 
@@ -115,57 +124,126 @@ func (s *upstart) getUpstartVersion() []int {
 	return parseVersion(matches[1])
 }
 
+func (s *upstart) systemVersion() string {
+	version := s.getUpstartVersion()
+	if version == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+}
+
 func (s *upstart) template() *template.Template {
 	customScript := s.Option.string(optionUpstartScript, "")
 
 	if customScript != "" {
-		return template.Must(template.New("").Funcs(tf).Parse(customScript))
+		return template.Must(template.New("").Funcs(s.funcs()).Parse(customScript))
 	} else {
-		return template.Must(template.New("").Funcs(tf).Parse(upstartScript))
+		return template.Must(template.New("").Funcs(s.funcs()).Parse(upstartScript))
 	}
 }
 
+// InstallScript returns the file Install would write, without writing it.
+func (s *upstart) InstallScript() (string, error) {
+	return renderScript(s.writeScript)
+}
+
 func (s *upstart) Install() error {
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
+	if s.Option.bool(optionDryRun, optionDryRunDefault) {
+		_, err = s.InstallScript()
+		return err
+	}
 	_, err = os.Stat(confPath)
-	if err == nil {
+	if err == nil && !s.Option.bool(optionOverwrite, optionOverwriteDefault) {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
 
-	f, err := os.Create(confPath)
-	if err != nil {
+	if err = s.createLogDirectory(); err != nil {
+		return err
+	}
+	if err = checkWritable(confPath); err != nil {
+		return err
+	}
+	if err = s.checkExecutable(); err != nil {
 		return err
 	}
-	defer f.Close()
+	if err = s.checkWorkingDirectory(); err != nil {
+		return err
+	}
+
+	return guardInstall(func(rb *installRollback) error {
+		if err := rb.writeFile(confPath, 0644, s.writeScript); err != nil {
+			return err
+		}
+		return s.smokeTest(confPath)
+	})
+}
 
+// writeScript renders the upstart job for the service to w.
+func (s *upstart) writeScript(w io.Writer) error {
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
+	if err = s.checkNoTasksMax(s.Platform()); err != nil {
+		return err
+	}
+	workingDirectory, err := s.workingDirectory()
+	if err != nil {
+		return err
+	}
+	extra, err := s.extraLines(optionUpstartExtra)
+	if err != nil {
+		return err
+	}
+	umask, err := s.umask()
+	if err != nil {
+		return err
+	}
 
 	var to = &struct {
 		*Config
-		Path            string
-		HasKillStanza   bool
-		HasSetUIDStanza bool
-		LogOutput       bool
-		LogDirectory    string
+		Name             string
+		Path             string
+		WorkingDirectory string
+		HasKillStanza    bool
+		HasSetUIDStanza  bool
+		LogOutput        bool
+		LogDirectory     string
+		Respawn          bool
+		StartAtBoot      bool
+		ArgumentsRaw     []string
+		Description      string
+		Extra            []string
+		UMask            string
 	}{
 		s.Config,
+		s.instanceName(),
 		path,
+		workingDirectory,
 		s.hasKillStanza(),
 		s.hasSetUIDStanza(),
 		s.Option.bool(optionLogOutput, optionLogOutputDefault),
 		s.Option.string(optionLogDirectory, defaultLogDirectory),
+		s.restartPolicy("always") != "no",
+		s.startAtBoot(),
+		s.Option.strings(optionArgumentsRaw, nil),
+		s.description(),
+		extra,
+		umask,
 	}
 
-	return s.template().Execute(f, to)
+	return s.template().Execute(w, to)
 }
 
 func (s *upstart) Uninstall() error {
+	return guardUninstall(s.uninstall)
+}
+
+func (s *upstart) uninstall() error {
 	cp, err := s.configPath()
 	if err != nil {
 		return err
@@ -176,77 +254,101 @@ func (s *upstart) Uninstall() error {
 	return nil
 }
 
+// ReadLogs returns the tail of the log files the script writes.
+func (s *upstart) ReadLogs(lines int) ([]string, error) {
+	return s.readLogFiles(lines, ".out", ".err")
+}
+
+// ReadLogsSince returns the lines of the log files the script writes
+// that are timestamped at or after since.
+func (s *upstart) ReadLogsSince(since time.Time) ([]string, error) {
+	return s.readLogFilesSince(since, ".out", ".err")
+}
+
 func (s *upstart) Logger(errs chan<- error) (Logger, error) {
-	if system.Interactive() {
+	if s.interactive(system.Interactive()) {
 		return ConsoleLogger, nil
 	}
 	return s.SystemLogger(errs)
 }
 func (s *upstart) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Config, errs)
 }
 
-func (s *upstart) Run() (err error) {
-	err = s.i.Start(s)
-	if err != nil {
-		return err
-	}
-
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
-
-	return s.i.Stop(s)
+func (s *upstart) Run() error {
+	return runLoop(s, s.i, s.Config)
 }
 
 func (s *upstart) Status() (Status, error) {
-	exitCode, out, err := runWithOutput("initctl", "status", s.Name)
+	exitCode, out, err := runWithOutput("initctl", "status", s.instanceName())
 	if exitCode == 0 && err != nil {
 		return StatusUnknown, err
 	}
 
 	switch {
-	case strings.HasPrefix(out, fmt.Sprintf("%s start/running", s.Name)):
+	case strings.HasPrefix(out, fmt.Sprintf("%s start/running", s.instanceName())):
 		return StatusRunning, nil
-	case strings.HasPrefix(out, fmt.Sprintf("%s stop/waiting", s.Name)):
+	case strings.HasPrefix(out, fmt.Sprintf("%s stop/waiting", s.instanceName())):
 		return StatusStopped, nil
 	default:
 		return StatusUnknown, ErrNotInstalled
 	}
 }
 
+// IsEnabled reports whether the job has a start on stanza, which starts
+// it at boot.
+func (s *upstart) IsEnabled() (bool, error) {
+	confPath, err := s.configPath()
+	if err != nil {
+		return false, err
+	}
+	b, err := ioutil.ReadFile(confPath)
+	if os.IsNotExist(err) {
+		return false, ErrNotInstalled
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "start on ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s *upstart) Start() error {
-	return run("initctl", "start", s.Name)
+	return run("initctl", "start", s.instanceName())
 }
 
 func (s *upstart) Stop() error {
-	return run("initctl", "stop", s.Name)
+	return s.runStop("initctl", "stop", s.instanceName())
 }
 
 func (s *upstart) Restart() error {
-	return run("initctl", "restart", s.Name)
+	return run("initctl", "restart", s.instanceName())
 }
 
 // The upstart script should stop with an INT or the Go runtime will terminate
 // the program before the Stop handler can run.
-const upstartScript = `# {{.Description}}
+const upstartScript = `# Generated by {{.Name}}{{if .Version}} v{{.Version}}{{end}} (service pkg)
+# {{.Description}}
 
 {{if .DisplayName}}description    "{{.DisplayName}}"{{end}}
 
 {{if .HasKillStanza}}kill signal INT{{end}}
 {{if .ChRoot}}chroot {{.ChRoot}}{{end}}
 {{if .WorkingDirectory}}chdir {{.WorkingDirectory}}{{end}}
-start on filesystem or runlevel [2345]
+{{if .StartAtBoot}}start on filesystem or runlevel [2345]{{end}}
 stop on runlevel [!2345]
 
 {{if and .UserName .HasSetUIDStanza}}setuid {{.UserName}}{{end}}
 
-respawn
-respawn limit 10 5
-umask 022
-
+{{if .Respawn}}respawn
+respawn limit 10 5{{end}}
+umask {{if .UMask}}{{.UMask}}{{else}}022{{end}}
+{{range .Extra}}{{.}}
+{{end}}
 console none
 
 pre-start script
@@ -266,6 +368,6 @@ script
 		set +a
 	fi
 
-	exec {{if and .UserName (not .HasSetUIDStanza)}}sudo -E -u {{.UserName}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{if .LogOutput}} >> $stdout_log 2>> $stderr_log{{end}}
+	exec {{if and .UserName (not .HasSetUIDStanza)}}sudo -E -u {{.UserName}} {{end}}{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}{{range .ArgumentsRaw}} {{.|rawcmd}}{{end}}{{if .LogOutput}} >> $stdout_log 2>> $stderr_log{{end}}
 end script
 `
@@ -49,8 +49,9 @@ type windowsService struct {
 
 // WindowsLogger allows using windows specific logging methods.
 type WindowsLogger struct {
-	ev   *eventlog.Log
-	errs chan<- error
+	ev    *eventlog.Log
+	errs  chan<- error
+	close *sync.Once
 }
 
 type windowsSystem struct{}
@@ -65,6 +66,9 @@ func (windowsSystem) Interactive() bool {
 	return interactive
 }
 func (windowsSystem) New(i Interface, c *Config) (Service, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 	ws := &windowsService{
 		i:      i,
 		Config: c,
@@ -116,6 +120,20 @@ func (l WindowsLogger) Infof(format string, a ...interface{}) error {
 	return l.send(l.ev.Info(1, fmt.Sprintf(format, a...)))
 }
 
+// Close closes the event log handle. It is safe to call more than once.
+func (l WindowsLogger) Close() error {
+	var err error
+	l.close.Do(func() {
+		err = l.ev.Close()
+	})
+	return err
+}
+
+// WithFields returns a logger that prepends the given fields to every message.
+func (l WindowsLogger) WithFields(fields map[string]interface{}) Logger {
+	return fieldLogger{l, formatFields(fields)}
+}
+
 // NError logs an error message and an event ID.
 func (l WindowsLogger) NError(eventID uint32, v ...interface{}) error {
 	return l.send(l.ev.Error(eventID, fmt.Sprint(v...)))
@@ -167,6 +185,12 @@ func (ws *windowsService) Platform() string {
 	return version
 }
 
+// optionCapabilities reports the options the service control manager
+// honors: Restart maps to recovery actions.
+func (ws *windowsService) optionCapabilities() Capabilities {
+	return Capabilities{RestartPolicy: true}
+}
+
 func (ws *windowsService) setError(err error) {
 	ws.errSync.Lock()
 	defer ws.errSync.Unlock()
@@ -182,10 +206,27 @@ func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, cha
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
 	changes <- svc.Status{State: svc.StartPending}
 
+	logf := ws.runLogf()
 	if err := ws.i.Start(ws); err != nil {
+		logf("start failed: %v", err)
 		ws.setError(err)
 		return true, 1
 	}
+	logf("started %s", ws.Name)
+
+	// The metrics file is informational, failing to write it does not
+	// stop the service.
+	if err := ws.recordLifecycle(true, time.Now()); err != nil {
+		logf("%v", err)
+	}
+	defer func() {
+		if ws.getError() != nil {
+			return
+		}
+		if err := ws.recordLifecycle(false, time.Now()); err != nil {
+			logf("%v", err)
+		}
+	}()
 
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 loop:
@@ -196,20 +237,20 @@ loop:
 			changes <- c.CurrentStatus
 		case svc.Stop:
 			changes <- svc.Status{State: svc.StopPending}
-			if err := ws.i.Stop(ws); err != nil {
+			logf("received stop, stopping")
+			if err := ws.onExit(ws.stop(logf, ws.i.Stop)); err != nil {
 				ws.setError(err)
 				return true, 2
 			}
 			break loop
 		case svc.Shutdown:
 			changes <- svc.Status{State: svc.StopPending}
-			var err error
+			logf("received shutdown, stopping")
+			stop := ws.i.Stop
 			if wsShutdown, ok := ws.i.(Shutdowner); ok {
-				err = wsShutdown.Shutdown(ws)
-			} else {
-				err = ws.i.Stop(ws)
+				stop = wsShutdown.Shutdown
 			}
-			if err != nil {
+			if err := ws.onExit(ws.stop(logf, stop)); err != nil {
 				ws.setError(err)
 				return true, 2
 			}
@@ -222,6 +263,17 @@ loop:
 	return false, 0
 }
 
+// stop calls stop, reporting how long it took and its error to logf.
+func (ws *windowsService) stop(logf func(format string, a ...interface{}), stop func(s Service) error) error {
+	begin := time.Now()
+	err := stop(ws)
+	logf("stop took %dms", time.Since(begin)/time.Millisecond)
+	if err != nil {
+		logf("stop failed: %v", err)
+	}
+	return err
+}
+
 func lowPrivMgr() (*mgr.Mgr, error) {
 	h, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT|windows.SC_MANAGER_ENUMERATE_SERVICE)
 	if err != nil {
@@ -270,6 +322,13 @@ func (ws *windowsService) Install() error {
 	if err != nil {
 		return err
 	}
+	startType, delayedAutoStart, err := ws.startType()
+	if err != nil {
+		return err
+	}
+	if _, err = ws.recoveryActions(); err != nil {
+		return err
+	}
 
 	m, err := mgr.Connect()
 	if err != nil {
@@ -286,15 +345,6 @@ func (ws *windowsService) Install() error {
 		s.Close()
 		return fmt.Errorf("service %s already exists", ws.Name)
 	}
-	var startType int32
-	switch ws.Option.string(StartType, ServiceStartAutomatic) {
-	case ServiceStartAutomatic:
-		startType = mgr.StartAutomatic
-	case ServiceStartManual:
-		startType = mgr.StartManual
-	case ServiceStartDisabled:
-		startType = mgr.StartDisabled
-	}
 
 	serviceType := windows.SERVICE_WIN32_OWN_PROCESS
 	if ws.Option.bool("Interactive", false) {
@@ -304,50 +354,126 @@ func (ws *windowsService) Install() error {
 	s, err = m.CreateService(ws.Name, exepath, mgr.Config{
 		DisplayName:      ws.DisplayName,
 		Description:      ws.Description,
-		StartType:        uint32(startType),
+		StartType:        startType,
 		ServiceStartName: ws.UserName,
 		Password:         ws.Option.string("Password", ""),
 		Dependencies:     ws.Dependencies,
-		DelayedAutoStart: ws.Option.bool("DelayedAutoStart", false),
+		DelayedAutoStart: delayedAutoStart,
 		ServiceType:      uint32(serviceType),
 	}, ws.Arguments...)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
+	if err = ws.setRecovery(s); err != nil {
+		s.Delete()
+		return err
+	}
+	err = eventlog.InstallAsEventCreate(ws.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		if !strings.Contains(err.Error(), "exists") {
+			s.Delete()
+			return fmt.Errorf("SetupEventLogSource() failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// startType returns the SCM start type of the StartType option and
+// whether the start is delayed, which only automatic starts can be.
+func (ws *windowsService) startType() (uint32, bool, error) {
+	var startType uint32
+	switch name := ws.Option.string(StartType, ServiceStartAutomatic); name {
+	case ServiceStartAutomatic:
+		startType = mgr.StartAutomatic
+	case ServiceStartManual:
+		startType = mgr.StartManual
+	case ServiceStartDisabled:
+		startType = mgr.StartDisabled
+	default:
+		return 0, false, fmt.Errorf("invalid %s %q: must be %s, %s or %s", StartType, name, ServiceStartAutomatic, ServiceStartManual, ServiceStartDisabled)
+	}
+	delayed := ws.Option.bool(optionDelayedAutoStart, optionDelayedAutoStartDefault)
+	if delayed && startType != mgr.StartAutomatic {
+		return 0, false, fmt.Errorf("%s requires %s %s", optionDelayedAutoStart, StartType, ServiceStartAutomatic)
+	}
+	return startType, delayed, nil
+}
+
+// defaultRecoveryDelay is the wait before a recovery action without a
+// delay of its own.
+const defaultRecoveryDelay = 60 * time.Second
+
+// recoveryActionTypes maps the actions of the RecoveryActions option to
+// the SCM actions.
+var recoveryActionTypes = map[string]int{
+	OnFailureRestart:  mgr.ServiceRestart,
+	"run":             mgr.RunCommand,
+	OnFailureReboot:   mgr.ComputerReboot,
+	OnFailureNoAction: mgr.NoAction,
+}
+
+// recoveryActions returns the actions the SCM takes on the first, second
+// and subsequent failures of the service, from the RecoveryActions,
+// OnFailure or Restart options, in that order.
+func (ws *windowsService) recoveryActions() ([]mgr.RecoveryAction, error) {
+	if entries := ws.Option.strings(optionRecoveryActions, nil); len(entries) > 0 {
+		if len(entries) > 3 {
+			return nil, fmt.Errorf("invalid %s: at most 3 actions, for the first, second and subsequent failures", optionRecoveryActions)
+		}
+		actions := make([]mgr.RecoveryAction, 0, len(entries))
+		for _, entry := range entries {
+			name, delay := entry, defaultRecoveryDelay
+			if i := strings.IndexByte(entry, '/'); i >= 0 {
+				d, err := time.ParseDuration(entry[i+1:])
+				if err != nil || d < 0 {
+					return nil, fmt.Errorf("invalid %s entry %q: bad delay", optionRecoveryActions, entry)
+				}
+				name, delay = entry[:i], d
+			}
+			actionType, ok := recoveryActionTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid %s entry %q: must be restart, run, reboot or noaction", optionRecoveryActions, entry)
+			}
+			if actionType == mgr.RunCommand && ws.Option.string(optionRecoveryCommand, "") == "" {
+				return nil, fmt.Errorf("%s entry %q needs %s", optionRecoveryActions, entry, optionRecoveryCommand)
+			}
+			actions = append(actions, mgr.RecoveryAction{Type: actionType, Delay: delay})
+		}
+		return actions, nil
+	}
+
 	if onFailure := ws.Option.string(OnFailure, ""); onFailure != "" {
 		var delay = 1 * time.Second
 		if d, err := time.ParseDuration(ws.Option.string(OnFailureDelayDuration, "1s")); err == nil {
 			delay = d
 		}
-		var actionType int
-		switch onFailure {
-		case OnFailureReboot:
-			actionType = mgr.ComputerReboot
-		case OnFailureRestart:
-			actionType = mgr.ServiceRestart
-		case OnFailureNoAction:
-			actionType = mgr.NoAction
-		default:
+		actionType, ok := recoveryActionTypes[onFailure]
+		if !ok || actionType == mgr.RunCommand {
 			actionType = mgr.ServiceRestart
 		}
-		if err := s.SetRecoveryActions([]mgr.RecoveryAction{
-			{
-				Type:  actionType,
-				Delay: delay,
-			},
-		}, uint32(ws.Option.int(OnFailureResetPeriod, 10))); err != nil {
-			return err
-		}
+		return []mgr.RecoveryAction{{Type: actionType, Delay: delay}}, nil
 	}
-	defer s.Close()
-	err = eventlog.InstallAsEventCreate(ws.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
-	if err != nil {
-		if !strings.Contains(err.Error(), "exists") {
-			s.Delete()
-			return fmt.Errorf("SetupEventLogSource() failed: %s", err)
+
+	switch ws.restartPolicy("") {
+	case "always", "on-failure":
+		return []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: defaultRecoveryDelay}}, nil
+	}
+	return nil, nil
+}
+
+// setRecovery configures the recovery actions of the installed service s.
+func (ws *windowsService) setRecovery(s *mgr.Service) error {
+	actions, err := ws.recoveryActions()
+	if err != nil || len(actions) == 0 {
+		return err
+	}
+	if command := ws.Option.string(optionRecoveryCommand, ""); command != "" {
+		if err = s.SetRecoveryCommand(command); err != nil {
+			return err
 		}
 	}
-	return nil
+	return s.SetRecoveryActions(actions, uint32(ws.Option.int(OnFailureResetPeriod, 10)))
 }
 
 func (ws *windowsService) Uninstall() error {
@@ -365,8 +491,10 @@ func (ws *windowsService) Uninstall() error {
 	if err != nil {
 		return err
 	}
+	// The event source may be missing if it was never registered, as by
+	// an Install that failed half way, or already removed by hand.
 	err = eventlog.Remove(ws.Name)
-	if err != nil {
+	if err != nil && err != windows.ERROR_FILE_NOT_FOUND {
 		return fmt.Errorf("RemoveEventLogSource() failed: %s", err)
 	}
 	return nil
@@ -374,7 +502,7 @@ func (ws *windowsService) Uninstall() error {
 
 func (ws *windowsService) Run() error {
 	ws.setError(nil)
-	if !interactive {
+	if !ws.interactive(interactive) {
 		// Return error messages from start and stop routines
 		// that get executed in the Execute method.
 		// Guarded with a mutex as it may run a different thread
@@ -389,18 +517,22 @@ func (ws *windowsService) Run() error {
 		}
 		return nil
 	}
+	logf := ws.runLogf()
 	err := ws.i.Start(ws)
 	if err != nil {
+		logf("start failed: %v", err)
 		return err
 	}
+	logf("started %s", ws.Name)
 
 	sigChan := make(chan os.Signal)
 
 	signal.Notify(sigChan, os.Interrupt)
 
 	<-sigChan
+	logf("received interrupt, stopping")
 
-	return ws.i.Stop(ws)
+	return ws.onExit(ws.stop(logf, ws.i.Stop))
 }
 
 func (ws *windowsService) Status() (Status, error) {
@@ -444,6 +576,30 @@ func (ws *windowsService) Status() (Status, error) {
 	}
 }
 
+// IsEnabled reports whether the service starts automatically at boot.
+func (ws *windowsService) IsEnabled() (bool, error) {
+	m, err := lowPrivMgr()
+	if err != nil {
+		return false, err
+	}
+	defer m.Disconnect()
+
+	s, err := lowPrivSvc(m, ws.Name)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok && errno == errnoServiceDoesNotExist {
+			return false, ErrNotInstalled
+		}
+		return false, err
+	}
+	defer s.Close()
+
+	config, err := s.Config()
+	if err != nil {
+		return false, err
+	}
+	return config.StartType == mgr.StartAutomatic, nil
+}
+
 func (ws *windowsService) Start() error {
 	m, err := lowPrivMgr()
 	if err != nil {
@@ -543,16 +699,22 @@ func getStopTimeout() time.Duration {
 	return time.Millisecond * time.Duration(v)
 }
 
+// Logger returns the console logger when running interactively, and
+// otherwise the event log logger of SystemLogger.
 func (ws *windowsService) Logger(errs chan<- error) (Logger, error) {
-	if interactive {
+	if ws.interactive(interactive) {
 		return ConsoleLogger, nil
 	}
 	return ws.SystemLogger(errs)
 }
+
+// SystemLogger returns a WindowsLogger writing Info, Warning and Error
+// events to the event source Install registered for the service. Close
+// releases the source handle; Uninstall removes the source.
 func (ws *windowsService) SystemLogger(errs chan<- error) (Logger, error) {
 	el, err := eventlog.Open(ws.Name)
 	if err != nil {
 		return nil, err
 	}
-	return WindowsLogger{el, errs}, nil
+	return WindowsLogger{el, errs, &sync.Once{}}, nil
 }
@@ -5,10 +5,98 @@
 package service
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
 func TestTimeout(t *testing.T) {
 	stopSpan := getStopTimeout()
 	t.Log("Max Stop Duration", stopSpan)
 }
+
+func TestRecoveryActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KeyValue
+		want    []mgr.RecoveryAction
+		wantErr bool
+	}{
+		{"unset", nil, nil, false},
+		{"keep-alive", KeyValue{optionKeepAlive: true}, []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: time.Minute}}, false},
+		{"restart-no", KeyValue{optionRestart: "no"}, nil, false},
+		{"on-failure", KeyValue{OnFailure: OnFailureReboot, OnFailureDelayDuration: "5s"}, []mgr.RecoveryAction{{Type: mgr.ComputerReboot, Delay: 5 * time.Second}}, false},
+		{"actions", KeyValue{
+			optionRecoveryActions: []string{"restart/30s", "run", "reboot/10m"},
+			optionRecoveryCommand: "C:\\app\\notify.exe",
+			OnFailure:             OnFailureNoAction,
+		}, []mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+			{Type: mgr.RunCommand, Delay: time.Minute},
+			{Type: mgr.ComputerReboot, Delay: 10 * time.Minute},
+		}, false},
+		{"run-without-command", KeyValue{optionRecoveryActions: []string{"run"}}, nil, true},
+		{"unknown", KeyValue{optionRecoveryActions: []string{"retry"}}, nil, true},
+		{"bad-delay", KeyValue{optionRecoveryActions: []string{"restart/soon"}}, nil, true},
+		{"too-many", KeyValue{optionRecoveryActions: []string{"restart", "restart", "restart", "reboot"}}, nil, true},
+	}
+	for _, tt := range tests {
+		ws := &windowsService{Config: &Config{Name: "app", Option: tt.options}}
+		got, err := ws.recoveryActions()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: recoveryActions() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: recoveryActions() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStartType(t *testing.T) {
+	tests := []struct {
+		options     KeyValue
+		want        uint32
+		wantDelayed bool
+		wantErr     bool
+	}{
+		{nil, mgr.StartAutomatic, false, false},
+		{KeyValue{optionDelayedAutoStart: true}, mgr.StartAutomatic, true, false},
+		{KeyValue{StartType: ServiceStartManual}, mgr.StartManual, false, false},
+		{KeyValue{StartType: ServiceStartManual, optionDelayedAutoStart: true}, 0, false, true},
+		{KeyValue{StartType: ServiceStartDisabled, optionDelayedAutoStart: true}, 0, false, true},
+		{KeyValue{StartType: "boot"}, 0, false, true},
+	}
+	for _, tt := range tests {
+		ws := &windowsService{Config: &Config{Name: "app", Option: tt.options}}
+		got, delayed, err := ws.startType()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("startType() with %v error = %v, wantErr %v", tt.options, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || delayed != tt.wantDelayed {
+			t.Errorf("startType() with %v = %d, %v, want %d, %v", tt.options, got, delayed, tt.want, tt.wantDelayed)
+		}
+	}
+}
+
+func TestExecuteRunLogger(t *testing.T) {
+	var buf bytes.Buffer
+	ws := &windowsService{i: &fakeProgram{}, Config: &Config{Name: "app", Option: KeyValue{optionRunLogger: &buf}}}
+	r := make(chan svc.ChangeRequest, 1)
+	changes := make(chan svc.Status, 4)
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	if _, code := ws.Execute(nil, r, changes); code != 0 {
+		t.Fatalf("Execute() exit code = %d, want 0", code)
+	}
+	for _, want := range []string{"started app", "received stop, stopping", "stop took "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("run log = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+}